@@ -0,0 +1,305 @@
+package main
+
+import (
+        _ "embed"
+        "encoding/base64"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "log/slog"
+        "net/http"
+        "strings"
+)
+
+// openAPISpec describes the /api/v1 endpoints
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// Part types of a v1 chat message
+const (
+        partText  = "text"
+        partImage = "image"
+        partFile  = "file"
+)
+
+// chatRequestV1 is the JSON body of POST /api/v1/chat
+type chatRequestV1 struct {
+        Messages []messageV1 `json:"messages"`
+        // ConversationID continues a stored conversation; only the last message
+        // is used then, the history comes from the store
+        ConversationID string `json:"conversationId"`
+        Provider       string `json:"provider"`
+        Stream         bool   `json:"stream"`
+        // ImageParams apply when the prompt asks for images
+        ImageParams ImageParams `json:"imageParams"`
+}
+
+type messageV1 struct {
+        Role  string   `json:"role"`
+        Parts []partV1 `json:"parts"`
+}
+
+// partV1 is a typed message part: text, an inline base64 image or a file
+// uploaded to /api/v1/files
+type partV1 struct {
+        Type     string `json:"type"`
+        Text     string `json:"text,omitempty"`
+        MimeType string `json:"mimeType,omitempty"`
+        Data     string `json:"data,omitempty"`
+        FileID   string `json:"fileId,omitempty"`
+}
+
+// handleChatV1 serves POST /api/v1/chat. The response is a ChatResponse, or
+// Server-Sent Events as on /api/chat/stream when stream is set or the client
+// accepts text/event-stream.
+func (s *server) handleChatV1(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                slog.WarnContext(r.Context(), "Invalid method", "method", r.Method)
+                sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        req, stream, err := s.parseChatRequestV1(w, r)
+        if err != nil {
+                sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        if stream || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+                s.serveChatStream(w, r, req)
+                return
+        }
+        s.serveChat(w, r, req)
+}
+
+// parseChatRequestV1 decodes a /api/v1/chat body into the request shared with
+// the form API. The last message is the new user turn; its text becomes the
+// prompt and its image, at most one, the uploaded image.
+func (s *server) parseChatRequestV1(w http.ResponseWriter, r *http.Request) (*chatRequest, bool, error) {
+        if mediaType := r.Header.Get("Content-Type"); !strings.HasPrefix(mediaType, "application/json") {
+                return nil, false, fmt.Errorf("Content-Type must be application/json, got %q", mediaType)
+        }
+
+        r.Body = http.MaxBytesReader(w, r.Body, s.cfg.Uploads.MaxRequestBytes)
+        dec := json.NewDecoder(r.Body)
+        dec.DisallowUnknownFields()
+        var body chatRequestV1
+        if err := dec.Decode(&body); err != nil {
+                return nil, false, fmt.Errorf("Failed to parse request body: %v", err)
+        }
+        if len(body.Messages) == 0 {
+                return nil, false, errors.New("messages must contain at least one message")
+        }
+
+        req := &chatRequest{ConversationID: body.ConversationID, Provider: body.Provider, ImageParams: body.ImageParams}
+        for i, m := range body.Messages {
+                if m.Role != "user" && m.Role != "model" {
+                        return nil, false, fmt.Errorf("messages[%d].role must be user or model, got %q", i, m.Role)
+                }
+                msg := Message{Role: m.Role}
+                for j, p := range m.Parts {
+                        part, err := s.resolvePart(r, p)
+                        if err != nil {
+                                return nil, false, fmt.Errorf("messages[%d].parts[%d]: %v", i, j, err)
+                        }
+                        msg.Parts = append(msg.Parts, part)
+                }
+                req.Messages = append(req.Messages, msg)
+        }
+
+        last := req.Messages[len(req.Messages)-1]
+        if last.Role != "user" {
+                return nil, false, errors.New("the last message must have role user")
+        }
+        var texts []string
+        for _, part := range last.Parts {
+                if part.Text != "" {
+                        texts = append(texts, part.Text)
+                        continue
+                }
+                if req.hasImage() {
+                        return nil, false, errors.New("the last message may contain at most one image")
+                }
+                req.MimeType = part.MimeType
+                req.ImageData, _ = base64.StdEncoding.DecodeString(part.Data)
+        }
+        req.Prompt = strings.Join(texts, "\n")
+        if req.Prompt == "" && !req.hasImage() {
+                return nil, false, errors.New("the last message must contain text or an image")
+        }
+
+        slog.InfoContext(r.Context(), "Received prompt", "prompt", req.Prompt)
+        if req.hasImage() {
+                slog.InfoContext(r.Context(), "Processing image", "size", len(req.ImageData), "mime_type", req.MimeType)
+        }
+        return req, body.Stream, nil
+}
+
+// resolvePart converts a typed part to a stored message part, checking inline
+// images against the upload limits and loading referenced files
+func (s *server) resolvePart(r *http.Request, p partV1) (MessagePart, error) {
+        switch p.Type {
+        case partText:
+                if p.Text == "" {
+                        return MessagePart{}, errors.New("text must not be empty")
+                }
+                return MessagePart{Text: p.Text}, nil
+
+        case partImage:
+                data, err := base64.StdEncoding.DecodeString(p.Data)
+                if err != nil {
+                        return MessagePart{}, fmt.Errorf("data is not valid base64: %v", err)
+                }
+                if len(data) == 0 {
+                        return MessagePart{}, errors.New("data must not be empty")
+                }
+                if int64(len(data)) > s.cfg.Uploads.MaxImageBytes {
+                        return MessagePart{}, fmt.Errorf("Image is too large (%d bytes, limit %d bytes)", len(data), s.cfg.Uploads.MaxImageBytes)
+                }
+                if err := checkImageType(s.cfg.Uploads, p.MimeType); err != nil {
+                        return MessagePart{}, err
+                }
+                return MessagePart{MimeType: p.MimeType, Data: p.Data}, nil
+
+        case partFile:
+                file, err := s.files.get(userID(r.Context()), p.FileID)
+                if err != nil {
+                        return MessagePart{}, err
+                }
+                return MessagePart{MimeType: file.MimeType, Data: base64.StdEncoding.EncodeToString(file.data)}, nil
+        }
+        return MessagePart{}, fmt.Errorf("type must be text, image or file, got %q", p.Type)
+}
+
+// handleFilesV1 serves POST /api/v1/files, which stores an image uploaded as
+// the multipart field "file" for use in later chat requests
+func (s *server) handleFilesV1(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                slog.WarnContext(r.Context(), "Invalid method", "method", r.Method)
+                sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        if err := s.limiter.allow(r.Context(), r, capabilityUpload, 1); err != nil {
+                sendRateLimitError(w, err)
+                return
+        }
+
+        limits := s.cfg.Uploads
+        r.Body = http.MaxBytesReader(w, r.Body, limits.MaxRequestBytes)
+        if err := r.ParseMultipartForm(limits.MaxRequestBytes); err != nil {
+                sendErrorResponse(w, fmt.Sprintf("Failed to parse form data: %v", err), http.StatusBadRequest)
+                return
+        }
+        file, fileHeader, err := r.FormFile("file")
+        if err != nil {
+                sendErrorResponse(w, "File field is required", http.StatusBadRequest)
+                return
+        }
+        defer file.Close()
+
+        if fileHeader.Size > limits.MaxImageBytes {
+                sendErrorResponse(w, fmt.Sprintf("Image is too large (%d bytes, limit %d bytes)", fileHeader.Size, limits.MaxImageBytes), http.StatusBadRequest)
+                return
+        }
+        data, err := io.ReadAll(file)
+        if err != nil {
+                sendErrorResponse(w, fmt.Sprintf("Failed to read file: %v", err), http.StatusBadRequest)
+                return
+        }
+        mimeType := imageMimeType(fileHeader.Filename, data)
+        if err := checkImageType(limits, mimeType); err != nil {
+                sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        uploaded, err := s.files.add(userID(r.Context()), s.limiter.client(r), mimeType, data)
+        if err == errUploadsFull || err == errClientUploadsFull {
+                sendErrorResponse(w, err.Error(), http.StatusInsufficientStorage)
+                return
+        }
+        if err != nil {
+                slog.ErrorContext(r.Context(), "Failed to store file", "err", err)
+                sendErrorResponse(w, "Failed to store file", http.StatusInternalServerError)
+                return
+        }
+
+        slog.InfoContext(r.Context(), "File uploaded", "file_id", uploaded.ID, "size", uploaded.Size, "mime_type", mimeType)
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(uploaded)
+}
+
+// tokenCountResponse is the body of POST /api/v1/tokens
+type tokenCountResponse struct {
+        Provider    string `json:"provider"`
+        TotalTokens int    `json:"totalTokens"`
+        RequestID   string `json:"requestId,omitempty"`
+}
+
+// handleTokensV1 serves POST /api/v1/tokens, which counts the input tokens a
+// /api/v1/chat body would use with its provider without sending it
+func (s *server) handleTokensV1(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "POST" {
+                slog.WarnContext(r.Context(), "Invalid method", "method", r.Method)
+                sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        req, _, err := s.parseChatRequestV1(w, r)
+        if err != nil {
+                sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        provider, err := s.providers.get(req.Provider)
+        if err != nil {
+                sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        ctx, cancel := s.requestContext(r)
+        defer cancel()
+
+        // Counting a stored conversation includes its history
+        if req.ConversationID != "" {
+                if _, _, err := loadConversation(ctx, s.store, req); err == errConversationNotFound {
+                        sendErrorResponse(w, "Conversation not found", http.StatusNotFound)
+                        return
+                } else if err != nil {
+                        slog.ErrorContext(ctx, "Failed to load conversation", "conversation_id", req.ConversationID, "err", err)
+                        sendErrorResponse(w, "Failed to load conversation", http.StatusInternalServerError)
+                        return
+                }
+        }
+        if err := s.limiter.allow(ctx, r, capabilityText, 1); err != nil {
+                sendRateLimitError(w, err)
+                return
+        }
+
+        tokens, err := provider.CountTokens(ctx, req)
+        if err == errTokenCountUnsupported {
+                sendErrorResponse(w, "Token counting is not available with the "+provider.Name()+" provider", http.StatusNotImplemented)
+                return
+        }
+        if err != nil {
+                sendDownstreamError(w, r, ctx, "Failed to count tokens", err)
+                return
+        }
+        json.NewEncoder(w).Encode(tokenCountResponse{
+                Provider:    provider.Name(),
+                TotalTokens: tokens,
+                RequestID:   requestID(r.Context()),
+        })
+}
+
+// handleOpenAPI serves the OpenAPI description of the /api/v1 endpoints
+func (s *server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/yaml")
+        w.Write(openAPISpec)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+)
+
+func TestHandleTokensV1(t *testing.T) {
+        s := newTestServer(t)
+        body := `{"messages":[
+                {"role":"user","parts":[{"type":"text","text":"one two"}]},
+                {"role":"model","parts":[{"type":"text","text":"three"}]},
+                {"role":"user","parts":[{"type":"text","text":"four five six"}]}
+        ]}`
+        r := httptest.NewRequest("POST", "/api/v1/tokens", strings.NewReader(body))
+        r.Header.Set("Content-Type", "application/json")
+        rec := httptest.NewRecorder()
+
+        s.handleTokensV1(rec, r)
+        if rec.Code != http.StatusOK {
+                t.Fatalf("status = %d (%s), want 200", rec.Code, rec.Body.String())
+        }
+        var resp tokenCountResponse
+        if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+                t.Fatal(err)
+        }
+        if resp.Provider != "fake" || resp.TotalTokens != 6 {
+                t.Errorf("response = %+v, want 6 tokens from the fake provider", resp)
+        }
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+        "context"
+        "crypto/hmac"
+        "crypto/rand"
+        "crypto/sha256"
+        "encoding/base64"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "log/slog"
+        "net/http"
+        "strconv"
+        "strings"
+        "time"
+
+        "go.opentelemetry.io/otel/attribute"
+        "go.opentelemetry.io/otel/trace"
+)
+
+// Reasons a request is not authenticated
+var (
+        errNoCredentials  = errors.New("no bearer token or session cookie")
+        errInvalidToken   = errors.New("unknown bearer token")
+        errInvalidSession = errors.New("invalid session cookie")
+        errSessionExpired = errors.New("session cookie expired")
+)
+
+// authenticator identifies the user behind a request from a static bearer
+// token or a session cookie signed with HMAC-SHA256
+type authenticator struct {
+        enabled bool
+        // tokens maps the SHA-256 of each configured token to its user. Looking
+        // up the hash rather than the token keeps the lookup time independent of
+        // how much of a guessed token is right.
+        tokens     map[[sha256.Size]byte]string
+        secret     []byte
+        ttl        time.Duration
+        cookieName string
+        admins     map[string]bool
+}
+
+// newAuthenticator builds the authenticator for cfg. Without a configured
+// session secret a random one is generated, so sessions end on restart.
+func newAuthenticator(cfg AuthConfig) (*authenticator, error) {
+        a := &authenticator{
+                enabled:    cfg.Enabled,
+                tokens:     make(map[[sha256.Size]byte]string, len(cfg.Tokens)),
+                secret:     []byte(cfg.SessionSecret),
+                ttl:        time.Duration(cfg.SessionTTL),
+                cookieName: cfg.CookieName,
+                admins:     make(map[string]bool, len(cfg.Admins)),
+        }
+        for _, admin := range cfg.Admins {
+                a.admins[admin] = true
+        }
+        for _, t := range cfg.Tokens {
+                a.tokens[sha256.Sum256([]byte(t.Token))] = t.User
+        }
+        if len(a.secret) == 0 {
+                a.secret = make([]byte, 32)
+                if _, err := rand.Read(a.secret); err != nil {
+                        return nil, fmt.Errorf("failed to generate session secret: %v", err)
+                }
+        }
+        return a, nil
+}
+
+// tokenUser returns the user a static token belongs to
+func (a *authenticator) tokenUser(token string) (string, bool) {
+        user, ok := a.tokens[sha256.Sum256([]byte(token))]
+        return user, ok
+}
+
+// authenticate returns the user identified by the request's bearer token or,
+// without an Authorization header, by its session cookie
+func (a *authenticator) authenticate(r *http.Request) (string, error) {
+        if token, ok := bearerToken(r); ok {
+                user, ok := a.tokenUser(token)
+                if !ok {
+                        return "", errInvalidToken
+                }
+                return user, nil
+        }
+
+        cookie, err := r.Cookie(a.cookieName)
+        if err != nil {
+                return "", errNoCredentials
+        }
+        return a.verifySession(cookie.Value, time.Now())
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+        scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+        if !ok || !strings.EqualFold(scheme, "Bearer") {
+                return "", false
+        }
+        token = strings.TrimSpace(token)
+        return token, token != ""
+}
+
+// newSession returns a session cookie value for user that expires after the
+// session TTL. The value is the base64 user, the expiry as Unix seconds and
+// the base64 HMAC of both, separated by dots.
+func (a *authenticator) newSession(user string, now time.Time) (string, time.Time) {
+        expires := now.Add(a.ttl)
+        payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(expires.Unix(), 10)
+        return payload + "." + a.sign(payload), expires
+}
+
+// verifySession checks the signature and expiry of a session cookie value
+// and returns its user
+func (a *authenticator) verifySession(value string, now time.Time) (string, error) {
+        i := strings.LastIndexByte(value, '.')
+        if i < 0 {
+                return "", errInvalidSession
+        }
+        payload, signature := value[:i], value[i+1:]
+        if !hmac.Equal([]byte(signature), []byte(a.sign(payload))) {
+                return "", errInvalidSession
+        }
+
+        encodedUser, expiry, ok := strings.Cut(payload, ".")
+        if !ok {
+                return "", errInvalidSession
+        }
+        user, err := base64.RawURLEncoding.DecodeString(encodedUser)
+        if err != nil {
+                return "", errInvalidSession
+        }
+        expires, err := strconv.ParseInt(expiry, 10, 64)
+        if err != nil {
+                return "", errInvalidSession
+        }
+        if now.Unix() >= expires {
+                return "", errSessionExpired
+        }
+        return string(user), nil
+}
+
+func (a *authenticator) sign(payload string) string {
+        mac := hmac.New(sha256.New, a.secret)
+        mac.Write([]byte(payload))
+        return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type userKey struct{}
+
+// withUser returns a copy of ctx carrying the authenticated user's ID
+func withUser(ctx context.Context, user string) context.Context {
+        return context.WithValue(ctx, userKey{}, user)
+}
+
+// userID returns the ID of the user ctx belongs to, or "" when authentication
+// is disabled
+func userID(ctx context.Context) string {
+        id, _ := ctx.Value(userKey{}).(string)
+        return id
+}
+
+// requireUser rejects requests without a valid bearer token or session cookie
+// when authentication is enabled, and attaches the user to the request context
+func (s *server) requireUser(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                if !s.auth.enabled {
+                        next(w, r)
+                        return
+                }
+
+                ctx := r.Context()
+                user, err := s.auth.authenticate(r)
+                if err != nil {
+                        slog.WarnContext(ctx, "Authentication failed", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "err", err)
+                        w.Header().Set("Content-Type", "application/json")
+                        w.Header().Set("WWW-Authenticate", `Bearer realm="gemini-chat"`)
+                        sendErrorResponse(w, "Authentication required", http.StatusUnauthorized)
+                        return
+                }
+
+                trace.SpanFromContext(ctx).SetAttributes(attribute.String("enduser.id", user))
+                next(w, r.WithContext(withUser(ctx, user)))
+        }
+}
+
+// requireAdmin is requireUser restricted to the users listed in auth.admins
+func (s *server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+        return s.requireUser(func(w http.ResponseWriter, r *http.Request) {
+                if s.auth.enabled && !s.auth.admins[userID(r.Context())] {
+                        slog.WarnContext(r.Context(), "Admin access denied", "path", r.URL.Path)
+                        w.Header().Set("Content-Type", "application/json")
+                        sendErrorResponse(w, "Admin access required", http.StatusForbidden)
+                        return
+                }
+                next(w, r)
+        })
+}
+
+// sessionResponse is the body of the /api/session endpoints
+type sessionResponse struct {
+        User         string `json:"user"`
+        AuthRequired bool   `json:"authRequired"`
+        // ExpiresAt is when a newly issued session cookie expires
+        ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// handleSession manages browser sessions:
+//
+//	GET    /api/session  the user behind the request's credentials
+//	POST   /api/session  exchange a bearer token for a session cookie
+//	DELETE /api/session  clear the session cookie
+//
+// POST accepts the token in an Authorization header or as {"token": "..."}.
+func (s *server) handleSession(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", "no-store")
+
+        ctx := r.Context()
+        if !s.auth.enabled {
+                json.NewEncoder(w).Encode(sessionResponse{})
+                return
+        }
+
+        switch r.Method {
+        case "GET":
+                user, err := s.auth.authenticate(r)
+                if err != nil {
+                        sendErrorResponse(w, "Not signed in", http.StatusUnauthorized)
+                        return
+                }
+                json.NewEncoder(w).Encode(sessionResponse{User: user, AuthRequired: true})
+
+        case "POST":
+                // Every attempt counts, so tokens cannot be guessed quickly
+                if err := s.limiter.allow(ctx, r, capabilityAuth, 1); err != nil {
+                        sendRateLimitError(w, err)
+                        return
+                }
+
+                token, ok := bearerToken(r)
+                if !ok {
+                        var body struct {
+                                Token string `json:"token"`
+                        }
+                        if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+                                sendErrorResponse(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+                                return
+                        }
+                        token = body.Token
+                }
+
+                user, ok := s.auth.tokenUser(token)
+                if !ok {
+                        slog.WarnContext(ctx, "Sign-in failed", "remote_addr", r.RemoteAddr, "err", errInvalidToken)
+                        sendErrorResponse(w, "Invalid token", http.StatusUnauthorized)
+                        return
+                }
+
+                value, expires := s.auth.newSession(user, time.Now())
+                http.SetCookie(w, s.auth.cookie(r, value, expires))
+                slog.InfoContext(withUser(ctx, user), "Session started", "expires_at", expires)
+                json.NewEncoder(w).Encode(sessionResponse{User: user, AuthRequired: true, ExpiresAt: &expires})
+
+        case "DELETE":
+                cookie := s.auth.cookie(r, "", time.Time{})
+                cookie.MaxAge = -1
+                http.SetCookie(w, cookie)
+                w.WriteHeader(http.StatusNoContent)
+
+        default:
+                slog.WarnContext(ctx, "Invalid method", "method", r.Method)
+                sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+// cookie returns the session cookie holding value. It is only sent over
+// HTTPS when the request arrived over HTTPS, directly or through a proxy.
+func (a *authenticator) cookie(r *http.Request, value string, expires time.Time) *http.Cookie {
+        return &http.Cookie{
+                Name:     a.cookieName,
+                Value:    value,
+                Path:     "/",
+                Expires:  expires,
+                HttpOnly: true,
+                Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+                SameSite: http.SameSiteLaxMode,
+        }
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+        "time"
+)
+
+// newTestAuthenticator authenticates alice, an admin, and bob by token
+func newTestAuthenticator(t *testing.T, enabled bool) *authenticator {
+        t.Helper()
+
+        a, err := newAuthenticator(AuthConfig{
+                Enabled: enabled,
+                Tokens: []AuthToken{
+                        {User: "alice", Token: "alice-token"},
+                        {User: "bob", Token: "bob-token"},
+                },
+                SessionSecret: "0123456789abcdef0123456789abcdef",
+                SessionTTL:    Duration(time.Hour),
+                CookieName:    "session",
+                Admins:        []string{"alice"},
+        })
+        if err != nil {
+                t.Fatal(err)
+        }
+        return a
+}
+
+func TestVerifySession(t *testing.T) {
+        a := newTestAuthenticator(t, true)
+        now := time.Now()
+        valid, _ := a.newSession("alice", now)
+        payload := valid[:strings.LastIndexByte(valid, '.')]
+
+        tests := []struct {
+                name  string
+                value string
+                now   time.Time
+                want  error
+        }{
+                {"valid", valid, now, nil},
+                {"tampered signature", payload + ".AAAA", now, errInvalidSession},
+                {"tampered user", "Ym9i" + valid[strings.IndexByte(valid, '.'):], now, errInvalidSession},
+                {"expired", valid, now.Add(time.Hour), errSessionExpired},
+                {"missing dot", "garbage", now, errInvalidSession},
+                {"empty", "", now, errInvalidSession},
+                {"signed without expiry", "YWxpY2U." + a.sign("YWxpY2U"), now, errInvalidSession},
+                {"signed bad base64 user", "!!!.9999999999." + a.sign("!!!.9999999999"), now, errInvalidSession},
+                {"signed bad expiry", "YWxpY2U.soon." + a.sign("YWxpY2U.soon"), now, errInvalidSession},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        user, err := a.verifySession(tt.value, tt.now)
+                        if err != tt.want {
+                                t.Fatalf("err = %v, want %v", err, tt.want)
+                        }
+                        if err == nil && user != "alice" {
+                                t.Errorf("user = %q, want alice", user)
+                        }
+                })
+        }
+}
+
+func TestAuthenticate(t *testing.T) {
+        a := newTestAuthenticator(t, true)
+        session, _ := a.newSession("bob", time.Now())
+
+        tests := []struct {
+                name     string
+                header   string
+                cookie   string
+                wantUser string
+                want     error
+        }{
+                {"bearer token", "Bearer alice-token", "", "alice", nil},
+                {"lower case scheme", "bearer bob-token", "", "bob", nil},
+                {"unknown bearer token", "Bearer mallory-token", "", "", errInvalidToken},
+                {"unknown token wins over a valid cookie", "Bearer mallory-token", session, "", errInvalidToken},
+                {"session cookie", "", session, "bob", nil},
+                {"nothing", "", "", "", errNoCredentials},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        r := httptest.NewRequest("GET", "/api/conversations", nil)
+                        if tt.header != "" {
+                                r.Header.Set("Authorization", tt.header)
+                        }
+                        if tt.cookie != "" {
+                                r.AddCookie(&http.Cookie{Name: "session", Value: tt.cookie})
+                        }
+                        user, err := a.authenticate(r)
+                        if err != tt.want || user != tt.wantUser {
+                                t.Errorf("got %q, %v, want %q, %v", user, err, tt.wantUser, tt.want)
+                        }
+                })
+        }
+}
+
+func TestRequireAdmin(t *testing.T) {
+        tests := []struct {
+                name     string
+                enabled  bool
+                header   string
+                wantCode int
+                wantUser string
+        }{
+                {"admin", true, "Bearer alice-token", http.StatusOK, "alice"},
+                {"not an admin", true, "Bearer bob-token", http.StatusForbidden, ""},
+                {"unknown token", true, "Bearer mallory-token", http.StatusUnauthorized, ""},
+                {"anonymous", true, "", http.StatusUnauthorized, ""},
+                {"anonymous without auth", false, "", http.StatusOK, ""},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        s := newTestServer(t)
+                        s.auth = newTestAuthenticator(t, tt.enabled)
+                        var gotUser string
+                        handler := s.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+                                gotUser = userID(r.Context())
+                        })
+
+                        r := httptest.NewRequest("GET", "/api/admin/models", nil)
+                        if tt.header != "" {
+                                r.Header.Set("Authorization", tt.header)
+                        }
+                        rec := httptest.NewRecorder()
+                        handler(rec, r)
+                        if rec.Code != tt.wantCode {
+                                t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+                        }
+                        if gotUser != tt.wantUser {
+                                t.Errorf("user = %q, want %q", gotUser, tt.wantUser)
+                        }
+                })
+        }
+}
+
+func TestHandleSession(t *testing.T) {
+        s := newTestServer(t)
+        s.auth = newTestAuthenticator(t, true)
+
+        post := func(body string) *httptest.ResponseRecorder {
+                rec := httptest.NewRecorder()
+                s.handleSession(rec, httptest.NewRequest("POST", "/api/session", strings.NewReader(body)))
+                return rec
+        }
+
+        rec := post(`{"token":"bob-token"}`)
+        if rec.Code != http.StatusOK {
+                t.Fatalf("sign-in status = %d, want 200", rec.Code)
+        }
+        cookies := rec.Result().Cookies()
+        if len(cookies) != 1 || !cookies[0].HttpOnly {
+                t.Fatalf("cookies = %v, want one HttpOnly session cookie", cookies)
+        }
+        if user, err := s.auth.verifySession(cookies[0].Value, time.Now()); err != nil || user != "bob" {
+                t.Errorf("session cookie is for %q, %v, want bob", user, err)
+        }
+
+        if rec := post(`{"token":"mallory-token"}`); rec.Code != http.StatusUnauthorized {
+                t.Errorf("unknown token status = %d, want 401", rec.Code)
+        }
+}
+
+func TestHandleSessionRateLimited(t *testing.T) {
+        s := newTestServer(t)
+        s.auth = newTestAuthenticator(t, true)
+        s.limiter = newLimiter(LimitsConfig{Auth: RateLimit{PerMinute: 1, Burst: 2}}, newMemoryStore())
+
+        for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+                rec := httptest.NewRecorder()
+                s.handleSession(rec, httptest.NewRequest("POST", "/api/session", strings.NewReader(`{"token":"guess"}`)))
+                if rec.Code != want {
+                        t.Fatalf("attempt %d: status = %d, want %d", i+1, rec.Code, want)
+                }
+        }
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+        "log/slog"
+        "net/http"
+        "strconv"
+        "sync"
+        "time"
+)
+
+// Circuit states of a model in the fallback chain
+const (
+        circuitClosed   = "closed"
+        circuitOpen     = "open"
+        circuitHalfOpen = "half_open"
+)
+
+// circuitStateValue is the chat_image_circuit_state value of each state
+var circuitStateValue = map[string]float64{
+        circuitClosed:   0,
+        circuitHalfOpen: 1,
+        circuitOpen:     2,
+}
+
+// CircuitState is the circuit breaker of one model as served by
+// /api/admin/models
+type CircuitState struct {
+        State string `json:"state"`
+        // Failures counts the consecutive failures while closed
+        Failures int `json:"failures"`
+        // OpenUntil is when an open circuit lets a trial request through
+        OpenUntil *time.Time `json:"openUntil,omitempty"`
+}
+
+// circuitBreaker is the state of one model: closed while it works, open after
+// it failed, and half-open once the cool-down ends, when a single trial
+// request decides whether it closes or opens again
+type circuitBreaker struct {
+        state     string
+        failures  int
+        openUntil time.Time
+        // trial is set while the half-open trial request is in flight
+        trial bool
+}
+
+// breakerSet keeps a circuit breaker per model so that models known to fail
+// are skipped until their cool-down ends
+type breakerSet struct {
+        backend       string
+        threshold     int
+        coolDown      time.Duration
+        maxRetryAfter time.Duration
+
+        mu       sync.Mutex
+        breakers map[string]*circuitBreaker
+}
+
+func newBreakerSet(backend string, cfg BreakerConfig) *breakerSet {
+        return &breakerSet{
+                backend:       backend,
+                threshold:     cfg.FailureThreshold,
+                coolDown:      time.Duration(cfg.CoolDown),
+                maxRetryAfter: time.Duration(cfg.MaxRetryAfter),
+                breakers:      make(map[string]*circuitBreaker),
+        }
+}
+
+// get returns the breaker of model, creating it closed. b.mu must be held.
+func (b *breakerSet) get(model string) *circuitBreaker {
+        cb, ok := b.breakers[model]
+        if !ok {
+                cb = &circuitBreaker{state: circuitClosed}
+                b.breakers[model] = cb
+        }
+        return cb
+}
+
+// allow reports whether a request to model may be sent. An open circuit
+// whose cool-down has ended turns half-open and lets this one request through.
+// When the request is refused, allow also returns when the cool-down ends.
+func (b *breakerSet) allow(model string) (bool, time.Time) {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+
+        cb := b.get(model)
+        switch cb.state {
+        case circuitOpen:
+                if time.Now().Before(cb.openUntil) {
+                        return false, cb.openUntil
+                }
+                b.transition(model, cb, circuitHalfOpen)
+                cb.trial = true
+        case circuitHalfOpen:
+                if cb.trial {
+                        return false, cb.openUntil
+                }
+                cb.trial = true
+        }
+        return true, time.Time{}
+}
+
+// success closes the circuit of model
+func (b *breakerSet) success(model string) {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+
+        cb := b.get(model)
+        cb.failures = 0
+        cb.trial = false
+        if cb.state != circuitClosed {
+                b.transition(model, cb, circuitClosed)
+        }
+}
+
+// release ends a request to model that says nothing about its health, such
+// as one cancelled by the client, without changing the circuit
+func (b *breakerSet) release(model string) {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        b.get(model).trial = false
+}
+
+// failure records a failed request to model. status is the HTTP status of
+// the response, 0 when there was none. A 404 or 429 opens the circuit at once,
+// as does a failed half-open trial; other failures open it once threshold of
+// them follow each other. retryAfter, when set, is how long the model asked
+// to be left alone and replaces the cool-down.
+func (b *breakerSet) failure(model string, status int, retryAfter time.Duration) {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+
+        cb := b.get(model)
+        cb.trial = false
+        cb.failures++
+
+        immediate := status == http.StatusNotFound || status == http.StatusTooManyRequests || retryAfter > 0
+        if cb.state != circuitHalfOpen && !immediate && cb.failures < b.threshold {
+                return
+        }
+
+        openFor := b.coolDown
+        if retryAfter > 0 {
+                openFor = retryAfter
+                if openFor > b.maxRetryAfter {
+                        openFor = b.maxRetryAfter
+                }
+        }
+        cb.openUntil = time.Now().Add(openFor)
+        if cb.state != circuitOpen {
+                b.transition(model, cb, circuitOpen)
+        }
+        slog.Warn("Model circuit opened", "backend", b.backend, "model", model, "status", status, "failures", cb.failures, "open_for", openFor)
+}
+
+// transition moves cb to state. b.mu must be held.
+func (b *breakerSet) transition(model string, cb *circuitBreaker, state string) {
+        slog.Info("Model circuit changed", "backend", b.backend, "model", model, "from", cb.state, "to", state)
+        cb.state = state
+        imageCircuitState.WithLabelValues(b.backend, model).Set(circuitStateValue[state])
+}
+
+// state returns the circuit of model
+func (b *breakerSet) state(model string) CircuitState {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+
+        cb := b.get(model)
+        s := CircuitState{State: cb.state, Failures: cb.failures}
+        if cb.state == circuitOpen {
+                until := cb.openUntil.UTC()
+                s.OpenUntil = &until
+        }
+        return s
+}
+
+// circuitTracker is implemented by image backends that keep a circuit
+// breaker per model
+type circuitTracker interface {
+        circuitBreakers() *breakerSet
+}
+
+// parseRetryAfter returns the delay requested by a Retry-After header, given
+// in seconds or as an HTTP date, or 0 when it is missing or invalid
+func parseRetryAfter(value string) time.Duration {
+        if value == "" {
+                return 0
+        }
+        if seconds, err := strconv.Atoi(value); err == nil {
+                if seconds <= 0 {
+                        return 0
+                }
+                return time.Duration(seconds) * time.Second
+        }
+        if t, err := http.ParseTime(value); err == nil {
+                if d := time.Until(t); d > 0 {
+                        return d
+                }
+        }
+        return 0
+}
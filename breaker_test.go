@@ -0,0 +1,168 @@
+package main
+
+import (
+        "context"
+        "net/http"
+        "strings"
+        "testing"
+        "time"
+)
+
+func newTestBreakers(coolDown time.Duration) *breakerSet {
+        return newBreakerSet("test", BreakerConfig{
+                FailureThreshold: 3,
+                CoolDown:         Duration(coolDown),
+                MaxRetryAfter:    Duration(time.Hour),
+        })
+}
+
+// expectState fails the test unless the circuit of model is in state
+func expectState(t *testing.T, b *breakerSet, model, state string) {
+        t.Helper()
+        if got := b.state(model).State; got != state {
+                t.Fatalf("circuit of %s is %s, want %s", model, got, state)
+        }
+}
+
+func TestBreakerOpensAtThreshold(t *testing.T) {
+        b := newTestBreakers(time.Minute)
+
+        for i := 0; i < 2; i++ {
+                if ok, _ := b.allow("m"); !ok {
+                        t.Fatalf("request %d refused while closed", i)
+                }
+                b.failure("m", http.StatusInternalServerError, 0)
+                expectState(t, b, "m", circuitClosed)
+        }
+
+        // A success in between starts the count again
+        b.success("m")
+        for i := 0; i < 3; i++ {
+                b.failure("m", http.StatusInternalServerError, 0)
+        }
+        expectState(t, b, "m", circuitOpen)
+        if ok, until := b.allow("m"); ok || time.Until(until) <= 0 {
+                t.Errorf("allow = %v, %v, want refused until the cool-down ends", ok, until)
+        }
+}
+
+func TestBreakerOpensImmediately(t *testing.T) {
+        tests := []struct {
+                name       string
+                status     int
+                retryAfter time.Duration
+                openFor    time.Duration
+        }{
+                {"not found", http.StatusNotFound, 0, time.Minute},
+                {"too many requests", http.StatusTooManyRequests, 0, time.Minute},
+                {"retry after", http.StatusServiceUnavailable, 10 * time.Minute, 10 * time.Minute},
+                {"retry after capped", http.StatusTooManyRequests, 5 * time.Hour, time.Hour},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        b := newTestBreakers(time.Minute)
+                        b.failure("m", tt.status, tt.retryAfter)
+                        expectState(t, b, "m", circuitOpen)
+
+                        openFor := time.Until(*b.state("m").OpenUntil)
+                        if openFor > tt.openFor || openFor < tt.openFor-time.Second {
+                                t.Errorf("open for %v, want %v", openFor, tt.openFor)
+                        }
+                })
+        }
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+        const coolDown = 20 * time.Millisecond
+
+        // openBreaker returns a breaker whose circuit of "m" has just turned
+        // half-open and let a trial request through
+        openBreaker := func(t *testing.T) *breakerSet {
+                b := newTestBreakers(coolDown)
+                b.failure("m", http.StatusNotFound, 0)
+                time.Sleep(coolDown)
+                if ok, _ := b.allow("m"); !ok {
+                        t.Fatal("trial request refused after the cool-down")
+                }
+                expectState(t, b, "m", circuitHalfOpen)
+                if ok, _ := b.allow("m"); ok {
+                        t.Fatal("second request allowed while the trial is in flight")
+                }
+                return b
+        }
+
+        t.Run("success closes", func(t *testing.T) {
+                b := openBreaker(t)
+                b.success("m")
+                expectState(t, b, "m", circuitClosed)
+                if s := b.state("m"); s.Failures != 0 || s.OpenUntil != nil {
+                        t.Errorf("state = %+v, want a reset circuit", s)
+                }
+                if ok, _ := b.allow("m"); !ok {
+                        t.Error("request refused after the circuit closed")
+                }
+        })
+
+        t.Run("failure opens again", func(t *testing.T) {
+                b := openBreaker(t)
+                b.failure("m", http.StatusInternalServerError, 0)
+                expectState(t, b, "m", circuitOpen)
+                if ok, _ := b.allow("m"); ok {
+                        t.Error("request allowed after the trial failed")
+                }
+        })
+
+        t.Run("release is not a failure", func(t *testing.T) {
+                b := openBreaker(t)
+                b.release("m")
+                expectState(t, b, "m", circuitHalfOpen)
+                if ok, _ := b.allow("m"); !ok {
+                        t.Error("new trial refused after the previous one was released")
+                }
+        })
+}
+
+func TestBreakerReleaseWhileClosed(t *testing.T) {
+        b := newTestBreakers(time.Minute)
+        for i := 0; i < 5; i++ {
+                b.allow("m")
+                b.release("m")
+        }
+        expectState(t, b, "m", circuitClosed)
+        if s := b.state("m"); s.Failures != 0 {
+                t.Errorf("failures = %d, want 0", s.Failures)
+        }
+}
+
+func TestHuggingFaceSkipsOpenCircuit(t *testing.T) {
+        png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 120)
+        srv := newScriptedServer(t,
+                scriptedResponse{status: http.StatusNotFound, body: `{"error":"Model not found"}`},
+                scriptedResponse{status: http.StatusOK, body: png},
+        )
+
+        cfg := defaultConfig().Images.HuggingFace
+        cfg.BaseURL = srv.URL
+        cfg.Models = []string{"org/gone", "org/ready"}
+        h := newHuggingFaceGenerator(cfg)
+        params := ImageParams{Model: "org/gone"}
+
+        // The 404 opens the circuit of the first model and the second answers
+        img, err := h.Generate(context.Background(), "a cat", params)
+        if err != nil {
+                t.Fatalf("Generate: %v", err)
+        }
+        if img.Model != "org/ready" || len(srv.requests()) != 2 {
+                t.Fatalf("image from %s after %d requests, want org/ready after 2", img.Model, len(srv.requests()))
+        }
+        expectState(t, h.breakers, "org/gone", circuitOpen)
+
+        // Though preferred, the first model is skipped while its circuit is open
+        img, err = h.Generate(context.Background(), "a cat", params)
+        if err != nil {
+                t.Fatalf("Generate: %v", err)
+        }
+        if img.Model != "org/ready" || len(srv.requests()) != 3 {
+                t.Errorf("image from %s after %d requests, want org/ready after 3", img.Model, len(srv.requests()))
+        }
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+        "encoding/json"
+        "log/slog"
+        "net/http"
+)
+
+// BackendStatus reports whether a backend could be enabled with the current
+// configuration and, if not, what is missing
+type BackendStatus struct {
+        Name string `json:"name"`
+        // Capability is "chat" or "image_generation"
+        Capability string `json:"capability"`
+        Enabled    bool   `json:"enabled"`
+        Reason     string `json:"reason,omitempty"`
+}
+
+// Capabilities lists the features this server can offer, detected at startup
+type Capabilities struct {
+        Chat            bool            `json:"chat"`
+        Vision          bool            `json:"vision"`
+        ImageGeneration bool            `json:"imageGeneration"`
+        Backends        []BackendStatus `json:"backends"`
+        // ImageModels lists the image models and the parameters they accept
+        ImageModels []ImageModel `json:"imageModels,omitempty"`
+}
+
+// detectCapabilities combines the configured chat providers and the status of
+// each image backend into the features the server can offer
+func detectCapabilities(cfg *Config, providers *providerSet, imageBackends []BackendStatus) *Capabilities {
+        caps := &Capabilities{}
+
+        for _, name := range providers.names() {
+                p, _ := providers.get(name)
+                caps.Chat = true
+                caps.Vision = caps.Vision || p.SupportsVision()
+                caps.Backends = append(caps.Backends, BackendStatus{Name: name, Capability: "chat", Enabled: true})
+        }
+        if cfg.Gemini.APIKey == "" {
+                caps.Backends = append(caps.Backends, BackendStatus{
+                        Name:       "gemini",
+                        Capability: "chat",
+                        Reason:     "GEMINI_API_KEY is not set",
+                })
+        }
+        if cfg.OpenAI.BaseURL == "" {
+                caps.Backends = append(caps.Backends, BackendStatus{
+                        Name:       "openai",
+                        Capability: "chat",
+                        Reason:     "OPENAI_BASE_URL is not set",
+                })
+        }
+
+        for _, status := range imageBackends {
+                caps.ImageGeneration = caps.ImageGeneration || status.Enabled
+                caps.Backends = append(caps.Backends, status)
+        }
+        return caps
+}
+
+// logCapabilities prints the detected features and why any backend is disabled
+func logCapabilities(caps *Capabilities) {
+        slog.Info("Capabilities detected", "chat", caps.Chat, "vision", caps.Vision, "image_generation", caps.ImageGeneration)
+        for _, b := range caps.Backends {
+                if !b.Enabled {
+                        slog.Info("Backend disabled", "backend", b.Name, "capability", b.Capability, "reason", b.Reason)
+                }
+        }
+}
+
+// handleCapabilities serves GET /api/capabilities
+func (s *server) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "GET" {
+                slog.WarnContext(r.Context(), "Invalid method", "method", r.Method)
+                sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        json.NewEncoder(w).Encode(s.capabilities)
+}
+
+// checkCapabilities returns an error message when req needs a feature that is
+// not available, for a 501 response
+func (s *server) checkCapabilities(req *chatRequest, provider ChatProvider, intent *IntentResult) string {
+        if intent.wantsImage() && s.images == nil {
+                return "Image generation is not available on this server: no image backend is configured (set HUGGINGFACE_API_KEY or IMAGE_GENERATORS)"
+        }
+        if !intent.wantsImage() && req.hasImage() && !provider.SupportsVision() {
+                return "Image analysis is not available with the " + provider.Name() + " provider"
+        }
+        return ""
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+        "bytes"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "log/slog"
+        "net/url"
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "time"
+
+        "gopkg.in/yaml.v3"
+)
+
+// Config is the server configuration. It is read from the file named by
+// CONFIG_FILE (YAML, or JSON for .json files), overridden by environment
+// variables and validated before the server starts. See config.example.yaml.
+type Config struct {
+        Server     ServerConfig     `yaml:"server" json:"server"`
+        Chat       ChatConfig       `yaml:"chat" json:"chat"`
+        Generation GenerationConfig `yaml:"generation" json:"generation"`
+        Gemini     GeminiConfig     `yaml:"gemini" json:"gemini"`
+        OpenAI     OpenAIConfig     `yaml:"openai" json:"openai"`
+        Images     ImagesConfig     `yaml:"images" json:"images"`
+        Uploads    UploadsConfig    `yaml:"uploads" json:"uploads"`
+        Storage    StorageConfig    `yaml:"storage" json:"storage"`
+        Logging    LoggingConfig    `yaml:"logging" json:"logging"`
+        Tracing    TracingConfig    `yaml:"tracing" json:"tracing"`
+        Auth       AuthConfig       `yaml:"auth" json:"auth"`
+        Limits     LimitsConfig     `yaml:"limits" json:"limits"`
+        Jobs       JobsConfig       `yaml:"jobs" json:"jobs"`
+}
+
+type ServerConfig struct {
+        Port      string `yaml:"port" json:"port"`
+        StaticDir string `yaml:"static_dir" json:"static_dir"`
+        // RequestTimeout bounds all downstream calls made for one chat request
+        RequestTimeout Duration `yaml:"request_timeout" json:"request_timeout"`
+
+        // HTTP server timeouts; zero disables a timeout. WriteTimeout must
+        // leave room for RequestTimeout since streams stay open that long.
+        ReadHeaderTimeout Duration `yaml:"read_header_timeout" json:"read_header_timeout"`
+        ReadTimeout       Duration `yaml:"read_timeout" json:"read_timeout"`
+        WriteTimeout      Duration `yaml:"write_timeout" json:"write_timeout"`
+        IdleTimeout       Duration `yaml:"idle_timeout" json:"idle_timeout"`
+
+        // ShutdownGracePeriod is how long in-flight requests may run after
+        // SIGINT or SIGTERM before they are cancelled
+        ShutdownGracePeriod Duration `yaml:"shutdown_grace_period" json:"shutdown_grace_period"`
+        // ShutdownDelay keeps serving while /readyz fails so load balancers
+        // notice before the listener closes
+        ShutdownDelay Duration `yaml:"shutdown_delay" json:"shutdown_delay"`
+        // CORSOrigins lists the origins allowed to call the API; "*" allows any
+        CORSOrigins []string `yaml:"cors_origins" json:"cors_origins"`
+        // CORSMethods and CORSHeaders are allowed in cross-origin requests
+        CORSMethods []string `yaml:"cors_methods" json:"cors_methods"`
+        CORSHeaders []string `yaml:"cors_headers" json:"cors_headers"`
+        // CORSExposedHeaders are response headers readable by cross-origin
+        // scripts besides the always readable ones such as Content-Type
+        CORSExposedHeaders []string `yaml:"cors_exposed_headers" json:"cors_exposed_headers"`
+        // CORSAllowCredentials lets cross-origin requests send cookies, such
+        // as the session cookie. It cannot be combined with "*".
+        CORSAllowCredentials bool `yaml:"cors_allow_credentials" json:"cors_allow_credentials"`
+        // CORSMaxAge is how long browsers may cache a preflight response
+        CORSMaxAge Duration `yaml:"cors_max_age" json:"cors_max_age"`
+
+        // StatusCacheTTL is how long /api/status reuses a backend probe result
+        // before contacting the backend again
+        StatusCacheTTL Duration `yaml:"status_cache_ttl" json:"status_cache_ttl"`
+        // ProbeTimeout bounds a single backend reachability probe
+        ProbeTimeout Duration `yaml:"probe_timeout" json:"probe_timeout"`
+}
+
+type ChatConfig struct {
+        // DefaultProvider is used when a request does not name a provider
+        DefaultProvider string `yaml:"default_provider" json:"default_provider"`
+}
+
+// GenerationConfig holds sampling parameters applied by every chat provider.
+// Unset values leave the provider's own default in place.
+type GenerationConfig struct {
+        Temperature     *float32 `yaml:"temperature" json:"temperature"`
+        TopP            *float32 `yaml:"top_p" json:"top_p"`
+        TopK            *int32   `yaml:"top_k" json:"top_k"`
+        MaxOutputTokens *int32   `yaml:"max_output_tokens" json:"max_output_tokens"`
+}
+
+type GeminiConfig struct {
+        APIKey            string   `yaml:"api_key" json:"api_key"`
+        Model             string   `yaml:"model" json:"model"`
+        ClassifierModel   string   `yaml:"classifier_model" json:"classifier_model"`
+        ClassifierTimeout Duration `yaml:"classifier_timeout" json:"classifier_timeout"`
+        // ClientPoolSize is the number of long-lived clients shared by requests
+        ClientPoolSize int `yaml:"client_pool_size" json:"client_pool_size"`
+}
+
+// OpenAIConfig configures the optional OpenAI-compatible provider, which is
+// enabled when BaseURL is set
+type OpenAIConfig struct {
+        BaseURL string `yaml:"base_url" json:"base_url"`
+        APIKey  string `yaml:"api_key" json:"api_key"`
+        Model   string `yaml:"model" json:"model"`
+        // Vision is whether the model accepts image input
+        Vision  bool     `yaml:"vision" json:"vision"`
+        Timeout Duration `yaml:"timeout" json:"timeout"`
+}
+
+type ImagesConfig struct {
+        // Generators is the ordered fallback chain: "huggingface", "local" or
+        // "fake". Hugging Face is skipped when it has no API key.
+        Generators []string `yaml:"generators" json:"generators"`
+        // MaxImagesPerRequest bounds the numImages of a chat request
+        MaxImagesPerRequest int                  `yaml:"max_images_per_request" json:"max_images_per_request"`
+        HuggingFace         HuggingFaceConfig    `yaml:"huggingface" json:"huggingface"`
+        Local               LocalDiffusionConfig `yaml:"local" json:"local"`
+}
+
+type HuggingFaceConfig struct {
+        APIKey        string   `yaml:"api_key" json:"api_key"`
+        BaseURL       string   `yaml:"base_url" json:"base_url"`
+        Models        []string `yaml:"models" json:"models"`
+        Steps         int      `yaml:"steps" json:"steps"`
+        GuidanceScale float64  `yaml:"guidance_scale" json:"guidance_scale"`
+        Timeout       Duration `yaml:"timeout" json:"timeout"`
+        // MaxRetries is how many times a model that is loading is retried
+        MaxRetries int `yaml:"max_retries" json:"max_retries"`
+        // RetryDelay is the backoff before the first retry of a model that is
+        // loading and gives no estimated_time, doubled for each following one
+        RetryDelay Duration `yaml:"retry_delay" json:"retry_delay"`
+        // MaxRetryDelay caps the backoff and the estimated_time waited for
+        MaxRetryDelay Duration `yaml:"max_retry_delay" json:"max_retry_delay"`
+        // HealthInterval is how often every model is probed in the background
+        // to order the fallback chain; 0 disables the probes
+        HealthInterval Duration `yaml:"health_interval" json:"health_interval"`
+        // ProbeTimeout bounds a single model probe
+        ProbeTimeout Duration `yaml:"probe_timeout" json:"probe_timeout"`
+        // Breaker configures the circuit breaker of each model
+        Breaker BreakerConfig `yaml:"breaker" json:"breaker"`
+}
+
+// BreakerConfig tunes the per-model circuit breakers that skip failing models
+type BreakerConfig struct {
+        // FailureThreshold is how many consecutive failures open a circuit.
+        // A 404 or 429 opens it at once.
+        FailureThreshold int `yaml:"failure_threshold" json:"failure_threshold"`
+        // CoolDown is how long a circuit stays open before a trial request
+        CoolDown Duration `yaml:"cool_down" json:"cool_down"`
+        // MaxRetryAfter caps how long a model's Retry-After keeps its circuit
+        // open
+        MaxRetryAfter Duration `yaml:"max_retry_after" json:"max_retry_after"`
+}
+
+type LocalDiffusionConfig struct {
+        URL      string   `yaml:"url" json:"url"`
+        Steps    int      `yaml:"steps" json:"steps"`
+        CFGScale float64  `yaml:"cfg_scale" json:"cfg_scale"`
+        Timeout  Duration `yaml:"timeout" json:"timeout"`
+}
+
+type UploadsConfig struct {
+        // MaxRequestBytes bounds the whole multipart chat request
+        MaxRequestBytes int64 `yaml:"max_request_bytes" json:"max_request_bytes"`
+        MaxImageBytes   int64 `yaml:"max_image_bytes" json:"max_image_bytes"`
+        // AllowedImageTypes lists the accepted MIME types of uploaded images
+        AllowedImageTypes []string `yaml:"allowed_image_types" json:"allowed_image_types"`
+        // FileTTL is how long images uploaded to /api/v1/files are kept
+        FileTTL Duration `yaml:"file_ttl" json:"file_ttl"`
+        // MaxStoredBytes bounds the memory used by all uploaded files
+        MaxStoredBytes int64 `yaml:"max_stored_bytes" json:"max_stored_bytes"`
+        // MaxStoredBytesPerClient bounds the uploaded files of one client, as
+        // identified by the rate limits, so no client can fill the store
+        MaxStoredBytesPerClient int64 `yaml:"max_stored_bytes_per_client" json:"max_stored_bytes_per_client"`
+}
+
+type StorageConfig struct {
+        // Driver is "sqlite" or "memory"
+        Driver     string `yaml:"driver" json:"driver"`
+        SQLitePath string `yaml:"sqlite_path" json:"sqlite_path"`
+}
+
+type LoggingConfig struct {
+        // Level is "debug", "info", "warn" or "error"
+        Level string `yaml:"level" json:"level"`
+        // Format is "text" or "json"
+        Format string `yaml:"format" json:"format"`
+        // Content controls how prompts, messages and model output appear in
+        // logs: "redact" logs only their length, "truncate" the first
+        // MaxContentLength characters and "full" everything
+        Content          string `yaml:"content" json:"content"`
+        MaxContentLength int    `yaml:"max_content_length" json:"max_content_length"`
+}
+
+type TracingConfig struct {
+        // Exporter is "none", "stdout" or "otlp"
+        Exporter string `yaml:"exporter" json:"exporter"`
+        // OTLPEndpoint is the host:port of an OTLP/HTTP collector. When empty
+        // the exporter uses OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318.
+        OTLPEndpoint string `yaml:"otlp_endpoint" json:"otlp_endpoint"`
+        OTLPInsecure bool   `yaml:"otlp_insecure" json:"otlp_insecure"`
+        ServiceName  string `yaml:"service_name" json:"service_name"`
+        // SampleRatio is the fraction of new traces recorded, from 0 to 1
+        SampleRatio float64 `yaml:"sample_ratio" json:"sample_ratio"`
+}
+
+type AuthConfig struct {
+        // Enabled requires a bearer token or session cookie on the chat and
+        // conversation APIs. Conversations then belong to the signed-in user.
+        Enabled bool        `yaml:"enabled" json:"enabled"`
+        Tokens  []AuthToken `yaml:"tokens" json:"tokens"`
+        // SessionSecret signs session cookies. When empty a random secret is
+        // generated at startup and sessions end on restart.
+        SessionSecret string   `yaml:"session_secret" json:"session_secret"`
+        SessionTTL    Duration `yaml:"session_ttl" json:"session_ttl"`
+        CookieName    string   `yaml:"cookie_name" json:"cookie_name"`
+        // Admins lists the users allowed on the /api/admin endpoints. Without
+        // authentication those endpoints are open like the rest of the API.
+        Admins []string `yaml:"admins" json:"admins"`
+}
+
+// AuthToken is a static API token and the user it authenticates
+type AuthToken struct {
+        User  string `yaml:"user" json:"user"`
+        Token string `yaml:"token" json:"token"`
+}
+
+// LimitsConfig limits each client, the signed-in user or the client IP when
+// authentication is disabled, separately for every capability
+type LimitsConfig struct {
+        Text   RateLimit `yaml:"text" json:"text"`
+        Vision RateLimit `yaml:"vision" json:"vision"`
+        Image  RateLimit `yaml:"image" json:"image"`
+        // Upload limits images stored with /api/v1/files
+        Upload RateLimit `yaml:"upload" json:"upload"`
+        // Auth limits sign-in attempts at POST /api/session, which are always
+        // counted against the client IP
+        Auth RateLimit `yaml:"auth" json:"auth"`
+        // TrustForwardedFor identifies anonymous clients by the first
+        // X-Forwarded-For address, for servers behind a reverse proxy
+        TrustForwardedFor bool `yaml:"trust_forwarded_for" json:"trust_forwarded_for"`
+}
+
+// JobsConfig sizes the worker pool that generates images in the background
+type JobsConfig struct {
+        // Workers is the number of images generated at once across all clients
+        Workers int `yaml:"workers" json:"workers"`
+        // QueueSize is how many jobs may wait for a worker before requests
+        // are refused with 429
+        QueueSize int `yaml:"queue_size" json:"queue_size"`
+        // Timeout bounds one job, including every model it tries
+        Timeout Duration `yaml:"timeout" json:"timeout"`
+        // ResultTTL is how long finished jobs can still be fetched
+        ResultTTL Duration `yaml:"result_ttl" json:"result_ttl"`
+}
+
+// RateLimit is a token bucket refilled at PerMinute requests a minute and
+// holding up to Burst requests, plus a daily quota. Zero values disable the
+// rate limit or quota. Image limits count images, so a request for several
+// takes as many tokens and quota units.
+type RateLimit struct {
+        PerMinute float64 `yaml:"per_minute" json:"per_minute"`
+        Burst     int     `yaml:"burst" json:"burst"`
+        // Daily is the number of requests allowed per UTC day
+        Daily int `yaml:"daily" json:"daily"`
+}
+
+// minTokenLength and minSessionSecretLength reject secrets short enough to guess
+const (
+        minTokenLength         = 16
+        minSessionSecretLength = 32
+)
+
+// Duration is a time.Duration written as a string such as "20s" in config files
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+        v, err := time.ParseDuration(string(text))
+        if err != nil {
+                return err
+        }
+        *d = Duration(v)
+        return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+        return []byte(time.Duration(d).String()), nil
+}
+
+// defaultConfig returns the settings used for anything the config file and
+// environment leave unset
+func defaultConfig() *Config {
+        return &Config{
+                Server: ServerConfig{
+                        Port:           "5000",
+                        StaticDir:      "./public/",
+                        RequestTimeout: Duration(5 * time.Minute),
+
+                        ReadHeaderTimeout:   Duration(10 * time.Second),
+                        ReadTimeout:         Duration(60 * time.Second),
+                        WriteTimeout:        Duration(6 * time.Minute),
+                        IdleTimeout:         Duration(120 * time.Second),
+                        ShutdownGracePeriod: Duration(60 * time.Second),
+                        CORSOrigins:         []string{"*"},
+                        CORSMethods:         []string{"GET", "POST", "DELETE"},
+                        CORSHeaders:         []string{"Authorization", "Content-Type", requestIDHeader},
+                        CORSExposedHeaders:  []string{requestIDHeader, "Retry-After"},
+                        CORSMaxAge:          Duration(10 * time.Minute),
+                        StatusCacheTTL:      Duration(30 * time.Second),
+                        ProbeTimeout:        Duration(10 * time.Second),
+                },
+                Chat: ChatConfig{DefaultProvider: "gemini"},
+                Gemini: GeminiConfig{
+                        Model:             "gemini-1.5-flash",
+                        ClassifierModel:   "gemini-1.5-flash",
+                        ClassifierTimeout: Duration(10 * time.Second),
+                        ClientPoolSize:    4,
+                },
+                OpenAI: OpenAIConfig{
+                        Model:   "gpt-4o-mini",
+                        Vision:  true,
+                        Timeout: Duration(120 * time.Second),
+                },
+                Images: ImagesConfig{
+                        Generators:          []string{"huggingface"},
+                        MaxImagesPerRequest: 4,
+                        HuggingFace: HuggingFaceConfig{
+                                BaseURL:        "https://api-inference.huggingface.co",
+                                Models:         defaultHuggingFaceModels,
+                                Steps:          25,
+                                GuidanceScale:  7.5,
+                                Timeout:        Duration(120 * time.Second),
+                                MaxRetries:     2,
+                                RetryDelay:     Duration(5 * time.Second),
+                                MaxRetryDelay:  Duration(60 * time.Second),
+                                HealthInterval: Duration(time.Minute),
+                                ProbeTimeout:   Duration(10 * time.Second),
+                                Breaker: BreakerConfig{
+                                        FailureThreshold: 3,
+                                        CoolDown:         Duration(time.Minute),
+                                        MaxRetryAfter:    Duration(10 * time.Minute),
+                                },
+                        },
+                        Local: LocalDiffusionConfig{
+                                Steps:    25,
+                                CFGScale: 7.5,
+                                Timeout:  Duration(120 * time.Second),
+                        },
+                },
+                Uploads: UploadsConfig{
+                        MaxRequestBytes:         10 << 20,
+                        MaxImageBytes:           10 << 20,
+                        AllowedImageTypes:       []string{"image/jpeg", "image/png", "image/gif", "image/webp"},
+                        FileTTL:                 Duration(time.Hour),
+                        MaxStoredBytes:          256 << 20,
+                        MaxStoredBytesPerClient: 32 << 20,
+                },
+                Storage: StorageConfig{
+                        Driver:     "sqlite",
+                        SQLitePath: "chat.db",
+                },
+                Logging: LoggingConfig{
+                        Level:            "info",
+                        Format:           "text",
+                        Content:          "truncate",
+                        MaxContentLength: 100,
+                },
+                Tracing: TracingConfig{
+                        Exporter:    "none",
+                        ServiceName: "gemini-chat",
+                        SampleRatio: 1,
+                },
+                Auth: AuthConfig{
+                        SessionTTL: Duration(7 * 24 * time.Hour),
+                        CookieName: "session",
+                },
+                Limits: LimitsConfig{
+                        Text:   RateLimit{PerMinute: 20, Burst: 10},
+                        Vision: RateLimit{PerMinute: 10, Burst: 5},
+                        Image:  RateLimit{PerMinute: 3, Burst: 4, Daily: 50},
+                        Upload: RateLimit{PerMinute: 10, Burst: 5},
+                        Auth:   RateLimit{PerMinute: 5, Burst: 5},
+                },
+                Jobs: JobsConfig{
+                        Workers:   4,
+                        QueueSize: 16,
+                        Timeout:   Duration(10 * time.Minute),
+                        ResultTTL: Duration(time.Hour),
+                },
+        }
+}
+
+// loadConfig reads the config file at path, if any, applies environment
+// overrides and validates the result
+func loadConfig(path string) (*Config, error) {
+        cfg := defaultConfig()
+
+        if path != "" {
+                data, err := os.ReadFile(path)
+                if err != nil {
+                        return nil, fmt.Errorf("failed to read config file: %v", err)
+                }
+                if err := cfg.decode(data, strings.ToLower(filepath.Ext(path)) == ".json"); err != nil {
+                        return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+                }
+        }
+
+        if err := cfg.applyEnv(); err != nil {
+                return nil, err
+        }
+        if err := cfg.validate(); err != nil {
+                return nil, fmt.Errorf("invalid configuration:\n%v", err)
+        }
+        return cfg, nil
+}
+
+// decode merges a YAML or JSON document into c, rejecting unknown keys so
+// typos are not silently ignored
+func (c *Config) decode(data []byte, isJSON bool) error {
+        if isJSON {
+                dec := json.NewDecoder(bytes.NewReader(data))
+                dec.DisallowUnknownFields()
+                return dec.Decode(c)
+        }
+
+        dec := yaml.NewDecoder(bytes.NewReader(data))
+        dec.KnownFields(true)
+        // An empty file decodes to io.EOF and keeps the defaults
+        if err := dec.Decode(c); err != nil && err != io.EOF {
+                return err
+        }
+        return nil
+}
+
+// applyEnv overrides config values with the environment variables that are set
+func (c *Config) applyEnv() error {
+        envString(&c.Server.Port, "PORT")
+        envList(&c.Server.CORSOrigins, "CORS_ORIGINS")
+        if err := envBool(&c.Server.CORSAllowCredentials, "CORS_ALLOW_CREDENTIALS"); err != nil {
+                return err
+        }
+        envString(&c.Chat.DefaultProvider, "CHAT_PROVIDER")
+        envString(&c.Gemini.APIKey, "GEMINI_API_KEY")
+        envString(&c.Gemini.Model, "GEMINI_MODEL")
+        envString(&c.OpenAI.BaseURL, "OPENAI_BASE_URL")
+        envString(&c.OpenAI.APIKey, "OPENAI_API_KEY")
+        envString(&c.OpenAI.Model, "OPENAI_MODEL")
+        envList(&c.Images.Generators, "IMAGE_GENERATORS")
+        envString(&c.Images.HuggingFace.APIKey, "HUGGINGFACE_API_KEY")
+        envList(&c.Images.HuggingFace.Models, "HUGGINGFACE_MODELS")
+        envString(&c.Images.Local.URL, "LOCAL_DIFFUSION_URL")
+        envString(&c.Storage.Driver, "CONVERSATION_STORE")
+        envString(&c.Storage.SQLitePath, "SQLITE_PATH")
+        envString(&c.Logging.Level, "LOG_LEVEL")
+        envString(&c.Logging.Format, "LOG_FORMAT")
+        envString(&c.Logging.Content, "LOG_CONTENT")
+        envString(&c.Tracing.Exporter, "TRACING_EXPORTER")
+        envString(&c.Tracing.ServiceName, "OTEL_SERVICE_NAME")
+        envString(&c.Auth.SessionSecret, "SESSION_SECRET")
+        envList(&c.Auth.Admins, "ADMIN_USERS")
+        if err := envAuthTokens(&c.Auth.Tokens, "AUTH_TOKENS"); err != nil {
+                return err
+        }
+        if err := envBool(&c.Auth.Enabled, "AUTH_ENABLED"); err != nil {
+                return err
+        }
+        if err := envBool(&c.Limits.TrustForwardedFor, "TRUST_FORWARDED_FOR"); err != nil {
+                return err
+        }
+        if err := envDuration(&c.Server.RequestTimeout, "REQUEST_TIMEOUT"); err != nil {
+                return err
+        }
+        return envInt64(&c.Uploads.MaxRequestBytes, "MAX_UPLOAD_BYTES")
+}
+
+func envString(dst *string, name string) {
+        if v := os.Getenv(name); v != "" {
+                *dst = v
+        }
+}
+
+func envList(dst *[]string, name string) {
+        if v := os.Getenv(name); v != "" {
+                *dst = splitList(v)
+        }
+}
+
+func envBool(dst *bool, name string) error {
+        v := os.Getenv(name)
+        if v == "" {
+                return nil
+        }
+        b, err := strconv.ParseBool(v)
+        if err != nil {
+                return fmt.Errorf("%s must be true or false: %v", name, err)
+        }
+        *dst = b
+        return nil
+}
+
+// envAuthTokens reads tokens written as comma-separated user:token pairs
+func envAuthTokens(dst *[]AuthToken, name string) error {
+        v := os.Getenv(name)
+        if v == "" {
+                return nil
+        }
+        var tokens []AuthToken
+        for _, pair := range splitList(v) {
+                user, token, ok := strings.Cut(pair, ":")
+                if !ok {
+                        return fmt.Errorf("%s must be comma-separated user:token pairs", name)
+                }
+                tokens = append(tokens, AuthToken{User: strings.TrimSpace(user), Token: strings.TrimSpace(token)})
+        }
+        *dst = tokens
+        return nil
+}
+
+func envDuration(dst *Duration, name string) error {
+        v := os.Getenv(name)
+        if v == "" {
+                return nil
+        }
+        d, err := time.ParseDuration(v)
+        if err != nil {
+                return fmt.Errorf("%s must be a duration such as 90s: %v", name, err)
+        }
+        *dst = Duration(d)
+        return nil
+}
+
+func envInt64(dst *int64, name string) error {
+        v := os.Getenv(name)
+        if v == "" {
+                return nil
+        }
+        n, err := strconv.ParseInt(v, 10, 64)
+        if err != nil {
+                return fmt.Errorf("%s must be an integer: %v", name, err)
+        }
+        *dst = n
+        return nil
+}
+
+// secrets returns the configured API keys, tokens and signing secrets, which
+// are scrubbed from logs
+func (c *Config) secrets() []string {
+        secrets := []string{c.Gemini.APIKey, c.OpenAI.APIKey, c.Images.HuggingFace.APIKey, c.Auth.SessionSecret}
+        for _, t := range c.Auth.Tokens {
+                secrets = append(secrets, t.Token)
+        }
+        return secrets
+}
+
+// validate reports every problem with the configuration at once
+func (c *Config) validate() error {
+        var errs []error
+        check := func(ok bool, format string, args ...interface{}) {
+                if !ok {
+                        errs = append(errs, fmt.Errorf(format, args...))
+                }
+        }
+
+        port, err := strconv.Atoi(c.Server.Port)
+        check(err == nil && port > 0 && port < 65536, "server.port must be a port number, got %q", c.Server.Port)
+        check(c.Server.RequestTimeout > 0, "server.request_timeout must be positive")
+        check(c.Server.ReadHeaderTimeout >= 0 && c.Server.ReadTimeout >= 0 && c.Server.IdleTimeout >= 0, "server timeouts must not be negative")
+        check(c.Server.WriteTimeout == 0 || c.Server.WriteTimeout > c.Server.RequestTimeout, "server.write_timeout must be longer than server.request_timeout, or 0")
+        check(c.Server.ShutdownGracePeriod > 0, "server.shutdown_grace_period must be positive")
+        check(c.Server.ShutdownDelay >= 0, "server.shutdown_delay must not be negative")
+        check(c.Server.StatusCacheTTL >= 0, "server.status_cache_ttl must not be negative")
+        check(c.Server.ProbeTimeout > 0, "server.probe_timeout must be positive")
+        for _, origin := range c.Server.CORSOrigins {
+                if origin == "*" {
+                        check(!c.Server.CORSAllowCredentials, "server.cors_origins must list origins, not \"*\", when server.cors_allow_credentials is set")
+                        continue
+                }
+                u, err := url.Parse(origin)
+                check(err == nil && u.Scheme != "" && u.Host != "" && u.Path == "", "server.cors_origins: %q is not an origin like https://example.com", origin)
+        }
+        check(len(c.Server.CORSMethods) > 0, "server.cors_methods must list at least one method")
+        check(c.Server.CORSMaxAge >= 0, "server.cors_max_age must not be negative")
+
+        check(c.Gemini.APIKey != "" || c.Chat.DefaultProvider != "gemini", "gemini.api_key is required when chat.default_provider is gemini (set GEMINI_API_KEY, e.g. in Replit Secrets)")
+        check(c.Gemini.Model != "", "gemini.model is required")
+        check(c.Gemini.ClassifierModel != "", "gemini.classifier_model is required")
+        check(c.Gemini.ClassifierTimeout > 0, "gemini.classifier_timeout must be positive")
+        check(c.Gemini.ClientPoolSize > 0, "gemini.client_pool_size must be positive")
+
+        switch c.Chat.DefaultProvider {
+        case "gemini", "fake":
+        case "openai":
+                check(c.OpenAI.BaseURL != "", "chat.default_provider is openai but openai.base_url is not set")
+        default:
+                check(false, "chat.default_provider must be gemini, openai or fake, got %q", c.Chat.DefaultProvider)
+        }
+        if c.OpenAI.BaseURL != "" {
+                check(c.OpenAI.Model != "", "openai.model is required")
+                check(c.OpenAI.Timeout > 0, "openai.timeout must be positive")
+        }
+
+        g := c.Generation
+        check(g.Temperature == nil || (*g.Temperature >= 0 && *g.Temperature <= 2), "generation.temperature must be between 0 and 2")
+        check(g.TopP == nil || (*g.TopP > 0 && *g.TopP <= 1), "generation.top_p must be in (0, 1]")
+        check(g.TopK == nil || *g.TopK > 0, "generation.top_k must be positive")
+        check(g.MaxOutputTokens == nil || *g.MaxOutputTokens > 0, "generation.max_output_tokens must be positive")
+
+        check(len(c.Images.Generators) > 0, "images.generators must list at least one generator")
+        check(c.Images.MaxImagesPerRequest > 0, "images.max_images_per_request must be positive")
+        for _, name := range c.Images.Generators {
+                switch name {
+                case "huggingface":
+                        // A missing API key disables the backend rather than failing startup
+                        hf := c.Images.HuggingFace
+                        check(hf.BaseURL != "", "images.huggingface.base_url is required")
+                        check(len(hf.Models) > 0, "images.huggingface.models must list at least one model")
+                        check(hf.Steps > 0, "images.huggingface.steps must be positive")
+                        check(hf.GuidanceScale > 0, "images.huggingface.guidance_scale must be positive")
+                        check(hf.Timeout > 0, "images.huggingface.timeout must be positive")
+                        check(hf.MaxRetries >= 0, "images.huggingface.max_retries must not be negative")
+                        check(hf.RetryDelay >= 0, "images.huggingface.retry_delay must not be negative")
+                        check(hf.MaxRetryDelay >= hf.RetryDelay, "images.huggingface.max_retry_delay must not be less than retry_delay")
+                        check(hf.HealthInterval >= 0, "images.huggingface.health_interval must not be negative")
+                        check(hf.ProbeTimeout > 0, "images.huggingface.probe_timeout must be positive")
+                        check(hf.Breaker.FailureThreshold > 0, "images.huggingface.breaker.failure_threshold must be positive")
+                        check(hf.Breaker.CoolDown > 0, "images.huggingface.breaker.cool_down must be positive")
+                        check(hf.Breaker.MaxRetryAfter > 0, "images.huggingface.breaker.max_retry_after must be positive")
+                case "local":
+                        local := c.Images.Local
+                        check(local.URL != "", "images.local.url is required by the local generator (set LOCAL_DIFFUSION_URL)")
+                        check(local.Steps > 0, "images.local.steps must be positive")
+                        check(local.CFGScale > 0, "images.local.cfg_scale must be positive")
+                        check(local.Timeout > 0, "images.local.timeout must be positive")
+                case "fake":
+                default:
+                        check(false, "images.generators: unknown generator %q", name)
+                }
+        }
+
+        u := c.Uploads
+        check(u.MaxRequestBytes > 0, "uploads.max_request_bytes must be positive")
+        check(u.MaxImageBytes > 0 && u.MaxImageBytes <= u.MaxRequestBytes, "uploads.max_image_bytes must be positive and at most uploads.max_request_bytes")
+        check(len(u.AllowedImageTypes) > 0, "uploads.allowed_image_types must list at least one type")
+        for _, t := range u.AllowedImageTypes {
+                check(strings.HasPrefix(t, "image/"), "uploads.allowed_image_types: %q is not an image type", t)
+        }
+        check(u.FileTTL > 0, "uploads.file_ttl must be positive")
+        check(u.MaxStoredBytes >= u.MaxImageBytes, "uploads.max_stored_bytes must be at least uploads.max_image_bytes")
+        check(u.MaxStoredBytesPerClient >= u.MaxImageBytes && u.MaxStoredBytesPerClient <= u.MaxStoredBytes, "uploads.max_stored_bytes_per_client must be between uploads.max_image_bytes and uploads.max_stored_bytes")
+
+        switch c.Storage.Driver {
+        case "sqlite":
+                check(c.Storage.SQLitePath != "", "storage.sqlite_path is required by the sqlite driver")
+        case "memory":
+        default:
+                check(false, "storage.driver must be sqlite or memory, got %q", c.Storage.Driver)
+        }
+
+        var level slog.Level
+        check(level.UnmarshalText([]byte(c.Logging.Level)) == nil, "logging.level must be debug, info, warn or error, got %q", c.Logging.Level)
+        check(c.Logging.Format == "text" || c.Logging.Format == "json", "logging.format must be text or json, got %q", c.Logging.Format)
+        switch c.Logging.Content {
+        case "redact", "full":
+        case "truncate":
+                check(c.Logging.MaxContentLength > 0, "logging.max_content_length must be positive")
+        default:
+                check(false, "logging.content must be redact, truncate or full, got %q", c.Logging.Content)
+        }
+
+        switch c.Tracing.Exporter {
+        case "none", "stdout", "otlp":
+        default:
+                check(false, "tracing.exporter must be none, stdout or otlp, got %q", c.Tracing.Exporter)
+        }
+        check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+        a := c.Auth
+        if a.Enabled {
+                check(len(a.Tokens) > 0, "auth.tokens must list at least one token when auth is enabled (set AUTH_TOKENS)")
+        }
+        seen := make(map[string]bool)
+        users := make(map[string]bool)
+        for i, t := range a.Tokens {
+                check(t.User != "", "auth.tokens[%d].user is required", i)
+                check(len(t.Token) >= minTokenLength, "auth.tokens[%d].token must be at least %d characters", i, minTokenLength)
+                check(!seen[t.Token], "auth.tokens[%d].token is used more than once", i)
+                seen[t.Token] = true
+                users[t.User] = true
+        }
+        for _, admin := range a.Admins {
+                check(users[admin], "auth.admins lists %q, which has no token in auth.tokens", admin)
+        }
+        check(a.SessionSecret == "" || len(a.SessionSecret) >= minSessionSecretLength, "auth.session_secret must be at least %d characters", minSessionSecretLength)
+        check(a.SessionTTL > 0, "auth.session_ttl must be positive")
+        check(a.CookieName != "" && !strings.ContainsAny(a.CookieName, " ;,="), "auth.cookie_name must be a cookie name, got %q", a.CookieName)
+
+        for name, limit := range map[string]RateLimit{"text": c.Limits.Text, "vision": c.Limits.Vision, "image": c.Limits.Image, "upload": c.Limits.Upload, "auth": c.Limits.Auth} {
+                check(limit.PerMinute >= 0, "limits.%s.per_minute must not be negative", name)
+                check(limit.PerMinute == 0 || limit.Burst > 0, "limits.%s.burst must be positive when per_minute is set", name)
+                check(limit.Daily >= 0, "limits.%s.daily must not be negative", name)
+        }
+        // Requests for the most images would otherwise always be refused
+        image := c.Limits.Image
+        check(image.PerMinute == 0 || image.Burst >= c.Images.MaxImagesPerRequest, "limits.image.burst must be at least images.max_images_per_request (%d)", c.Images.MaxImagesPerRequest)
+        check(image.Daily == 0 || image.Daily >= c.Images.MaxImagesPerRequest, "limits.image.daily must be at least images.max_images_per_request (%d)", c.Images.MaxImagesPerRequest)
+
+        check(c.Jobs.Workers > 0, "jobs.workers must be positive")
+        check(c.Jobs.QueueSize >= 0, "jobs.queue_size must not be negative")
+        check(c.Jobs.Timeout > 0, "jobs.timeout must be positive")
+        check(c.Jobs.ResultTTL > 0, "jobs.result_ttl must be positive")
+
+        return errors.Join(errs...)
+}
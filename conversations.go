@@ -0,0 +1,149 @@
+package main
+
+import (
+        "context"
+        "encoding/base64"
+        "encoding/json"
+        "log/slog"
+        "net/http"
+        "strings"
+)
+
+// handleConversations serves the conversation collection and its items:
+//
+//	GET    /api/conversations       list conversations
+//	POST   /api/conversations       create a conversation
+//	GET    /api/conversations/{id}  get a conversation with its messages
+//	DELETE /api/conversations/{id}  delete a conversation
+func (s *server) handleConversations(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/conversations"), "/")
+        ctx := r.Context()
+        store := s.store
+        owner := userID(ctx)
+
+        switch {
+        case id == "" && r.Method == "GET":
+                list, err := store.ListConversations(ctx, owner)
+                if err != nil {
+                        slog.ErrorContext(ctx, "Failed to list conversations", "err", err)
+                        sendErrorResponse(w, "Failed to list conversations", http.StatusInternalServerError)
+                        return
+                }
+                json.NewEncoder(w).Encode(map[string]interface{}{"conversations": list})
+
+        case id == "" && r.Method == "POST":
+                var body struct {
+                        Title string `json:"title"`
+                }
+                // An empty body creates an untitled conversation
+                if r.ContentLength != 0 {
+                        if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+                                sendErrorResponse(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+                                return
+                        }
+                }
+
+                conv, err := store.CreateConversation(ctx, owner, body.Title)
+                if err != nil {
+                        slog.ErrorContext(ctx, "Failed to create conversation", "err", err)
+                        sendErrorResponse(w, "Failed to create conversation", http.StatusInternalServerError)
+                        return
+                }
+                w.WriteHeader(http.StatusCreated)
+                json.NewEncoder(w).Encode(conv)
+
+        case id != "" && r.Method == "GET":
+                conv, err := store.GetConversation(ctx, owner, id)
+                if err == errConversationNotFound {
+                        sendErrorResponse(w, "Conversation not found", http.StatusNotFound)
+                        return
+                }
+                if err != nil {
+                        slog.ErrorContext(ctx, "Failed to get conversation", "conversation_id", id, "err", err)
+                        sendErrorResponse(w, "Failed to get conversation", http.StatusInternalServerError)
+                        return
+                }
+                json.NewEncoder(w).Encode(conv)
+
+        case id != "" && r.Method == "DELETE":
+                err := store.DeleteConversation(ctx, owner, id)
+                if err == errConversationNotFound {
+                        sendErrorResponse(w, "Conversation not found", http.StatusNotFound)
+                        return
+                }
+                if err != nil {
+                        slog.ErrorContext(ctx, "Failed to delete conversation", "conversation_id", id, "err", err)
+                        sendErrorResponse(w, "Failed to delete conversation", http.StatusInternalServerError)
+                        return
+                }
+                w.WriteHeader(http.StatusNoContent)
+
+        default:
+                slog.WarnContext(r.Context(), "Invalid method", "method", r.Method)
+                sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+// loadConversation replaces req.Messages with the stored history of
+// req.ConversationID, which must belong to the request's user, followed by the
+// new user turn, which is returned so it can be saved once the response is
+// ready
+func loadConversation(ctx context.Context, store ConversationStore, req *chatRequest) (*Conversation, Message, error) {
+        conv, err := store.GetConversation(ctx, userID(ctx), req.ConversationID)
+        if err != nil {
+                return nil, Message{}, err
+        }
+
+        userMessage := Message{Role: "user"}
+        if req.Prompt != "" {
+                userMessage.Parts = append(userMessage.Parts, MessagePart{Text: req.Prompt})
+        }
+        if req.hasImage() {
+                userMessage.Parts = append(userMessage.Parts, MessagePart{
+                        MimeType: req.MimeType,
+                        Data:     base64.StdEncoding.EncodeToString(req.ImageData),
+                })
+        }
+
+        req.Messages = append(conv.Messages, userMessage)
+        return conv, userMessage, nil
+}
+
+// saveTurn appends the user turn and the model response, with any generated
+// images, to the conversation and titles untitled conversations from the
+// prompt. Nil images are skipped.
+func saveTurn(ctx context.Context, store ConversationStore, conv *Conversation, userMessage Message, response string, images ...*GeneratedImage) {
+        modelMessage := Message{Role: "model", Parts: []MessagePart{{Text: response}}}
+        for _, image := range images {
+                if image == nil {
+                        continue
+                }
+                modelMessage.Parts = append(modelMessage.Parts, MessagePart{
+                        MimeType: image.MimeType,
+                        Data:     image.Base64(),
+                })
+        }
+
+        if err := store.AppendMessages(ctx, conv.ID, userMessage, modelMessage); err != nil {
+                slog.ErrorContext(ctx, "Failed to save messages", "conversation_id", conv.ID, "err", err)
+                return
+        }
+
+        if conv.Title == "" {
+                for _, part := range userMessage.Parts {
+                        if part.Text == "" {
+                                continue
+                        }
+                        title := []rune(part.Text)
+                        if len(title) > 60 {
+                                title = append(title[:60], '…')
+                        }
+                        if err := store.SetTitle(ctx, conv.ID, string(title)); err != nil {
+                                slog.ErrorContext(ctx, "Failed to set conversation title", "conversation_id", conv.ID, "err", err)
+                        }
+                        break
+                }
+        }
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+        "net/http"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// corsPolicy answers CORS preflight requests and adds CORS headers to the API
+// responses sent to allowed origins. Requests from other origins are served
+// without CORS headers, so browsers do not expose the responses to them.
+type corsPolicy struct {
+        anyOrigin   bool
+        origins     map[string]bool
+        methods     string
+        headers     string
+        exposed     string
+        credentials bool
+        maxAge      string
+}
+
+func newCORSPolicy(cfg ServerConfig) *corsPolicy {
+        p := &corsPolicy{
+                origins:     make(map[string]bool),
+                methods:     strings.Join(cfg.CORSMethods, ", "),
+                headers:     strings.Join(cfg.CORSHeaders, ", "),
+                exposed:     strings.Join(cfg.CORSExposedHeaders, ", "),
+                credentials: cfg.CORSAllowCredentials,
+                maxAge:      strconv.Itoa(int(time.Duration(cfg.CORSMaxAge).Seconds())),
+        }
+        for _, origin := range cfg.CORSOrigins {
+                if origin == "*" {
+                        p.anyOrigin = true
+                }
+                p.origins[origin] = true
+        }
+        return p
+}
+
+// handler applies the policy to next. Preflight requests are answered here
+// and never reach next.
+func (p *corsPolicy) handler(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                origin := r.Header.Get("Origin")
+                preflight := r.Method == "OPTIONS" && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+
+                h := w.Header()
+                // Responses differ by origin unless every origin gets "*"
+                if !p.anyOrigin {
+                        h.Add("Vary", "Origin")
+                }
+                if preflight {
+                        h.Add("Vary", "Access-Control-Request-Method")
+                        h.Add("Vary", "Access-Control-Request-Headers")
+                }
+
+                if origin != "" && (p.anyOrigin || p.origins[origin]) {
+                        // Credentials are never combined with "*", see Config.validate
+                        if p.anyOrigin {
+                                h.Set("Access-Control-Allow-Origin", "*")
+                        } else {
+                                h.Set("Access-Control-Allow-Origin", origin)
+                        }
+                        if p.credentials {
+                                h.Set("Access-Control-Allow-Credentials", "true")
+                        }
+
+                        if preflight {
+                                h.Set("Access-Control-Allow-Methods", p.methods)
+                                h.Set("Access-Control-Allow-Headers", p.headers)
+                                h.Set("Access-Control-Max-Age", p.maxAge)
+                        } else if p.exposed != "" {
+                                h.Set("Access-Control-Expose-Headers", p.exposed)
+                        }
+                }
+
+                if preflight {
+                        w.WriteHeader(http.StatusNoContent)
+                        return
+                }
+                next(w, r)
+        }
+}
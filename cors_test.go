@@ -0,0 +1,113 @@
+package main
+
+import (
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+)
+
+// serveCORS sends a request from origin through the CORS policy of cfg and
+// reports whether it reached the handler behind it
+func serveCORS(cfg ServerConfig, method, origin string, preflight bool) (*httptest.ResponseRecorder, bool) {
+        reached := false
+        handler := newCORSPolicy(cfg).handler(func(w http.ResponseWriter, r *http.Request) {
+                reached = true
+        })
+
+        r := httptest.NewRequest(method, "/api/chat", nil)
+        if origin != "" {
+                r.Header.Set("Origin", origin)
+        }
+        if preflight {
+                r.Header.Set("Access-Control-Request-Method", "POST")
+        }
+        rec := httptest.NewRecorder()
+        handler(rec, r)
+        return rec, reached
+}
+
+func TestCORSPreflight(t *testing.T) {
+        cfg := defaultConfig().Server
+        cfg.CORSOrigins = []string{"https://app.example.com"}
+
+        rec, reached := serveCORS(cfg, "OPTIONS", "https://app.example.com", true)
+        if rec.Code != http.StatusNoContent || reached {
+                t.Fatalf("status = %d, reached handler = %v, want 204 answered by the policy", rec.Code, reached)
+        }
+        h := rec.Header()
+        if got := h.Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+                t.Errorf("Access-Control-Allow-Origin = %q, want the origin", got)
+        }
+        if got := h.Get("Access-Control-Allow-Methods"); got != "GET, POST, DELETE" {
+                t.Errorf("Access-Control-Allow-Methods = %q", got)
+        }
+        if got := h.Get("Access-Control-Max-Age"); got != "600" {
+                t.Errorf("Access-Control-Max-Age = %q, want 600", got)
+        }
+        if vary := strings.Join(h.Values("Vary"), ", "); vary != "Origin, Access-Control-Request-Method, Access-Control-Request-Headers" {
+                t.Errorf("Vary = %q", vary)
+        }
+
+        // OPTIONS without Access-Control-Request-Method is not a preflight
+        if _, reached := serveCORS(cfg, "OPTIONS", "https://app.example.com", false); !reached {
+                t.Error("plain OPTIONS request did not reach the handler")
+        }
+}
+
+func TestCORSOrigins(t *testing.T) {
+        listed := defaultConfig().Server
+        listed.CORSOrigins = []string{"https://app.example.com"}
+        listed.CORSAllowCredentials = true
+        anyOrigin := defaultConfig().Server
+
+        tests := []struct {
+                name            string
+                cfg             ServerConfig
+                origin          string
+                wantOrigin      string
+                wantCredentials string
+                wantVary        string
+        }{
+                {"allowed origin with credentials", listed, "https://app.example.com", "https://app.example.com", "true", "Origin"},
+                {"disallowed origin", listed, "https://evil.example.com", "", "", "Origin"},
+                {"same-origin request", listed, "", "", "", "Origin"},
+                {"any origin", anyOrigin, "https://evil.example.com", "*", "", ""},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        rec, reached := serveCORS(tt.cfg, "POST", tt.origin, false)
+                        if !reached {
+                                t.Fatal("request did not reach the handler")
+                        }
+                        h := rec.Header()
+                        if got := h.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+                                t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+                        }
+                        if got := h.Get("Access-Control-Allow-Credentials"); got != tt.wantCredentials {
+                                t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got, tt.wantCredentials)
+                        }
+                        if got := h.Get("Vary"); got != tt.wantVary {
+                                t.Errorf("Vary = %q, want %q", got, tt.wantVary)
+                        }
+                        if tt.wantOrigin != "" && h.Get("Access-Control-Expose-Headers") == "" {
+                                t.Error("no Access-Control-Expose-Headers for an allowed origin")
+                        }
+                })
+        }
+}
+
+func TestValidateCORSCredentials(t *testing.T) {
+        cfg := defaultConfig()
+        cfg.Gemini.APIKey = "test"
+        cfg.Server.CORSAllowCredentials = true
+
+        cfg.Server.CORSOrigins = []string{"*"}
+        if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "cors_allow_credentials") {
+                t.Errorf("credentials with \"*\": err = %v, want it rejected", err)
+        }
+        cfg.Server.CORSOrigins = []string{"https://app.example.com"}
+        if err := cfg.validate(); err != nil {
+                t.Errorf("credentials with an explicit origin: %v", err)
+        }
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+        "errors"
+        "fmt"
+        "sync"
+        "time"
+)
+
+// errFileNotFound is returned for unknown, expired or other users' file IDs
+var errFileNotFound = errors.New("file not found or expired")
+
+// errUploadsFull is returned when storing a file would exceed the limit on
+// the total size of uploaded files
+var errUploadsFull = errors.New("upload storage is full, try again later")
+
+// errClientUploadsFull is returned when storing a file would exceed the limit
+// on the size of the files uploaded by one client
+var errClientUploadsFull = errors.New("too many uploaded files are stored for this client, try again once some have expired")
+
+// UploadedFile describes an image stored with POST /api/v1/files
+type UploadedFile struct {
+        ID        string    `json:"id"`
+        MimeType  string    `json:"mimeType"`
+        Size      int       `json:"size"`
+        ExpiresAt time.Time `json:"expiresAt"`
+
+        owner  string
+        client string
+        data   []byte
+}
+
+// fileStore keeps uploaded images in memory until they expire, so chat
+// requests can refer to them by ID instead of carrying them inline
+type fileStore struct {
+        ttl            time.Duration
+        maxBytes       int64
+        maxClientBytes int64
+
+        mu          sync.Mutex
+        files       map[string]*UploadedFile
+        bytes       int64
+        clientBytes map[string]int64
+}
+
+func newFileStore(cfg UploadsConfig) *fileStore {
+        return &fileStore{
+                ttl:            time.Duration(cfg.FileTTL),
+                maxBytes:       cfg.MaxStoredBytes,
+                maxClientBytes: cfg.MaxStoredBytesPerClient,
+                files:          make(map[string]*UploadedFile),
+                clientBytes:    make(map[string]int64),
+        }
+}
+
+// add stores data for owner and returns its description. Its size counts
+// against client, as identified by limiter.client, which is also set without
+// authentication, when every owner is "".
+func (f *fileStore) add(owner, client, mimeType string, data []byte) (*UploadedFile, error) {
+        id, err := newID()
+        if err != nil {
+                return nil, fmt.Errorf("failed to generate file ID: %v", err)
+        }
+
+        f.mu.Lock()
+        defer f.mu.Unlock()
+
+        now := time.Now()
+        f.expire(now)
+        if f.bytes+int64(len(data)) > f.maxBytes {
+                return nil, errUploadsFull
+        }
+        if f.clientBytes[client]+int64(len(data)) > f.maxClientBytes {
+                return nil, errClientUploadsFull
+        }
+
+        file := &UploadedFile{
+                ID:        id,
+                MimeType:  mimeType,
+                Size:      len(data),
+                ExpiresAt: now.Add(f.ttl).UTC(),
+                owner:     owner,
+                client:    client,
+                data:      data,
+        }
+        f.files[id] = file
+        f.bytes += int64(len(data))
+        f.clientBytes[client] += int64(len(data))
+        return file, nil
+}
+
+// get returns the file with id if it belongs to owner and has not expired
+func (f *fileStore) get(owner, id string) (*UploadedFile, error) {
+        f.mu.Lock()
+        defer f.mu.Unlock()
+
+        f.expire(time.Now())
+        file, ok := f.files[id]
+        if !ok || file.owner != owner {
+                return nil, errFileNotFound
+        }
+        return file, nil
+}
+
+// expire drops the files that expired before now
+func (f *fileStore) expire(now time.Time) {
+        for id, file := range f.files {
+                if now.After(file.ExpiresAt) {
+                        delete(f.files, id)
+                        f.bytes -= int64(file.Size)
+                        f.clientBytes[file.client] -= int64(file.Size)
+                        if f.clientBytes[file.client] == 0 {
+                                delete(f.clientBytes, file.client)
+                        }
+                }
+        }
+}
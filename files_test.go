@@ -0,0 +1,24 @@
+package main
+
+import (
+        "testing"
+        "time"
+)
+
+func TestFileStoreClientLimit(t *testing.T) {
+        f := newFileStore(UploadsConfig{FileTTL: Duration(time.Hour), MaxStoredBytes: 100, MaxStoredBytesPerClient: 60})
+        data := make([]byte, 40)
+
+        if _, err := f.add("", "ip:10.0.0.1", "image/png", data); err != nil {
+                t.Fatalf("first upload: %v", err)
+        }
+        if _, err := f.add("", "ip:10.0.0.1", "image/png", data); err != errClientUploadsFull {
+                t.Fatalf("second upload of the same client: err = %v, want %v", err, errClientUploadsFull)
+        }
+        if _, err := f.add("", "ip:10.0.0.2", "image/png", data); err != nil {
+                t.Fatalf("upload of another client: %v", err)
+        }
+        if _, err := f.add("", "ip:10.0.0.3", "image/png", data); err != errUploadsFull {
+                t.Fatalf("upload over the total: err = %v, want %v", err, errUploadsFull)
+        }
+}
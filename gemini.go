@@ -0,0 +1,359 @@
+package main
+
+import (
+        "context"
+        "encoding/base64"
+        "fmt"
+        "net/http"
+        "strings"
+
+        "github.com/google/generative-ai-go/genai"
+        "google.golang.org/api/iterator"
+)
+
+// geminiProvider implements ChatProvider on top of the Gemini API. Tools in
+// the registry are offered to the model and run when it calls them.
+type geminiProvider struct {
+        clients    *geminiClientPool
+        model      string
+        generation GenerationConfig
+        tools      *ToolRegistry
+}
+
+func newGeminiProvider(clients *geminiClientPool, cfg GeminiConfig, generation GenerationConfig, tools *ToolRegistry) *geminiProvider {
+        return &geminiProvider{clients: clients, model: cfg.Model, generation: generation, tools: tools}
+}
+
+func (g *geminiProvider) Name() string {
+        return "gemini"
+}
+
+func (g *geminiProvider) SupportsVision() bool {
+        return true
+}
+
+// Probe fetches the chat model's metadata, which checks both reachability
+// and the API key without generating anything
+func (g *geminiProvider) Probe(ctx context.Context) error {
+        client, release, err := g.clients.acquire()
+        if err != nil {
+                return err
+        }
+        defer release()
+
+        if _, err := g.generativeModel(client).Info(ctx); err != nil {
+                return fmt.Errorf("failed to get model info: %v", err)
+        }
+        return nil
+}
+
+func (g *geminiProvider) Generate(ctx context.Context, req *chatRequest) (*ChatResult, error) {
+        client, release, err := g.clients.acquire()
+        if err != nil {
+                return nil, err
+        }
+        defer release()
+
+        cs, parts, err := prepareChat(g.generativeModel(client), req)
+        if err != nil {
+                return nil, err
+        }
+
+        resp, err := g.sendMessage(ctx, cs, parts)
+        if err != nil {
+                if req.hasImage() {
+                        return nil, fmt.Errorf("failed to generate content with image: %v", err)
+                }
+                return nil, fmt.Errorf("failed to generate content: %v", err)
+        }
+
+        // Run requested tools and send their results back until the model answers
+        result := &ChatResult{}
+        for i := 0; ; i++ {
+                calls := functionCalls(resp)
+                if len(calls) == 0 {
+                        break
+                }
+                if i == maxToolIterations {
+                        return nil, fmt.Errorf("model was still calling tools after %d rounds", maxToolIterations)
+                }
+
+                resp, err = g.sendMessage(ctx, cs, g.runTools(ctx, calls, result))
+                if err != nil {
+                        return nil, fmt.Errorf("failed to send tool results: %v", err)
+                }
+        }
+
+        result.Text = responseText(resp)
+        addResponseMetadata(result, resp)
+        if result.Text == "" {
+                if result.Image != nil {
+                        result.Text = generatedImageResponse
+                } else if req.hasImage() {
+                        result.Text = "Maaf, saya tidak dapat menganalisis gambar ini."
+                } else {
+                        result.Text = "Maaf, saya tidak dapat menghasilkan respons saat ini."
+                }
+        }
+        return result, nil
+}
+
+func (g *geminiProvider) Stream(ctx context.Context, req *chatRequest, onChunk func(string) error) (*ChatResult, error) {
+        client, release, err := g.clients.acquire()
+        if err != nil {
+                return nil, err
+        }
+        defer release()
+
+        cs, parts, err := prepareChat(g.generativeModel(client), req)
+        if err != nil {
+                return nil, err
+        }
+
+        result := &ChatResult{}
+        for i := 0; ; i++ {
+                calls, err := g.streamMessage(ctx, cs, parts, result, onChunk)
+                if err != nil {
+                        return result, err
+                }
+
+                // Run requested tools and stream the model's follow-up
+                if len(calls) == 0 {
+                        break
+                }
+                if i == maxToolIterations {
+                        return result, fmt.Errorf("model was still calling tools after %d rounds", maxToolIterations)
+                }
+                parts = g.runTools(ctx, calls, result)
+        }
+
+        if result.Text == "" && result.Image != nil {
+                result.Text = generatedImageResponse
+                if err := onChunk(result.Text); err != nil {
+                        return result, fmt.Errorf("failed to write response: %v", err)
+                }
+        }
+        return result, nil
+}
+
+// sendMessage sends one turn of cs in its own span and records its token usage
+func (g *geminiProvider) sendMessage(ctx context.Context, cs *genai.ChatSession, parts []genai.Part) (*genai.GenerateContentResponse, error) {
+        ctx, span := startGeminiSpan(ctx, "gemini.send_message", g.model)
+        resp, err := cs.SendMessage(ctx, parts...)
+        if err != nil {
+                endGeminiSpan(span, nil, err)
+                return nil, err
+        }
+        endGeminiSpan(span, resp.UsageMetadata, nil)
+        observeTokenUsage(g.model, "chat", resp.UsageMetadata)
+        return resp, nil
+}
+
+// streamMessage streams one turn of cs in its own span, adding the text to
+// result and passing each chunk to onChunk. It returns the function calls
+// the model made.
+func (g *geminiProvider) streamMessage(ctx context.Context, cs *genai.ChatSession, parts []genai.Part, result *ChatResult, onChunk func(string) error) (calls []genai.FunctionCall, err error) {
+        ctx, span := startGeminiSpan(ctx, "gemini.stream_message", g.model)
+        // Each chunk repeats the running usage, so only the last counts
+        var usage *genai.UsageMetadata
+        defer func() {
+                endGeminiSpan(span, usage, err)
+                observeTokenUsage(g.model, "chat", usage)
+        }()
+
+        iter := cs.SendMessageStream(ctx, parts...)
+        for {
+                resp, err := iter.Next()
+                if err == iterator.Done {
+                        return calls, nil
+                }
+                if err != nil {
+                        return calls, fmt.Errorf("failed to stream content: %v", err)
+                }
+
+                if text := responseText(resp); text != "" {
+                        result.Text += text
+                        if err := onChunk(text); err != nil {
+                                // The client went away; stop consuming the stream
+                                return calls, fmt.Errorf("failed to write response: %v", err)
+                        }
+                }
+                calls = append(calls, functionCalls(resp)...)
+                addResponseMetadata(result, resp)
+                if resp.UsageMetadata != nil {
+                        usage = resp.UsageMetadata
+                }
+        }
+}
+
+// generativeModel returns the chat model cached on client, configured with
+// the generation parameters and registered tools
+func (g *geminiProvider) generativeModel(client *pooledClient) *genai.GenerativeModel {
+        return client.model("chat/"+g.model, g.model, func(model *genai.GenerativeModel) {
+                if g.generation.Temperature != nil {
+                        model.SetTemperature(*g.generation.Temperature)
+                }
+                if g.generation.TopP != nil {
+                        model.SetTopP(*g.generation.TopP)
+                }
+                if g.generation.TopK != nil {
+                        model.SetTopK(*g.generation.TopK)
+                }
+                if g.generation.MaxOutputTokens != nil {
+                        model.SetMaxOutputTokens(*g.generation.MaxOutputTokens)
+                }
+                model.Tools = g.tools.genaiTools()
+        })
+}
+
+// runTools executes the model's function calls and returns the responses to
+// send back. A generated image is kept on result for the user.
+func (g *geminiProvider) runTools(ctx context.Context, calls []genai.FunctionCall, result *ChatResult) []genai.Part {
+        parts := make([]genai.Part, 0, len(calls))
+        for _, fc := range calls {
+                response, image := g.tools.call(ctx, fc)
+                if image != nil {
+                        result.Image = image
+                }
+                parts = append(parts, response)
+        }
+        return parts
+}
+
+func (g *geminiProvider) CountTokens(ctx context.Context, req *chatRequest) (int, error) {
+        client, release, err := g.clients.acquire()
+        if err != nil {
+                return 0, err
+        }
+        defer release()
+
+        model := g.generativeModel(client)
+        cs, parts, err := prepareChat(model, req)
+        if err != nil {
+                return 0, err
+        }
+
+        // CountTokens takes a single turn, so flatten the history into it
+        var all []genai.Part
+        for _, content := range cs.History {
+                all = append(all, content.Parts...)
+        }
+        all = append(all, parts...)
+
+        ctx, span := startGeminiSpan(ctx, "gemini.count_tokens", g.model)
+        resp, err := model.CountTokens(ctx, all...)
+        endSpan(span, err)
+        if err != nil {
+                return 0, fmt.Errorf("failed to count tokens: %v", err)
+        }
+        return int(resp.TotalTokens), nil
+}
+
+// addResponseMetadata copies the finish reason and token usage from a Gemini
+// response into result, keeping earlier values when a chunk omits them
+func addResponseMetadata(result *ChatResult, resp *genai.GenerateContentResponse) {
+        if len(resp.Candidates) > 0 && resp.Candidates[0].FinishReason != genai.FinishReasonUnspecified {
+                result.FinishReason = resp.Candidates[0].FinishReason.String()
+        }
+        if resp.UsageMetadata != nil {
+                result.Usage = &TokenUsage{
+                        PromptTokens:     resp.UsageMetadata.PromptTokenCount,
+                        CandidatesTokens: resp.UsageMetadata.CandidatesTokenCount,
+                        TotalTokens:      resp.UsageMetadata.TotalTokenCount,
+                }
+        }
+}
+
+// prepareChat starts a chat session seeded with the earlier turns of req and
+// returns the parts of the turn to send
+func prepareChat(model *genai.GenerativeModel, req *chatRequest) (*genai.ChatSession, []genai.Part, error) {
+        messages, turn := req.splitTurns()
+
+        history, err := toGenaiHistory(messages)
+        if err != nil {
+                return nil, nil, err
+        }
+
+        parts, err := toGenaiParts(turn)
+        if err != nil {
+                return nil, nil, err
+        }
+
+        if len(parts) == 0 {
+                return nil, nil, fmt.Errorf("no text content to send to Gemini")
+        }
+
+        cs := model.StartChat()
+        cs.History = history
+        return cs, parts, nil
+}
+
+// toGenaiHistory converts chat messages into Gemini content, skipping empty messages
+func toGenaiHistory(messages []Message) ([]*genai.Content, error) {
+        var history []*genai.Content
+        for i, msg := range messages {
+                role := "user"
+                msgParts := msg.Parts
+                if msg.Role == "model" || msg.Role == "assistant" {
+                        role = "model"
+                        // Generated images are stored for display, not replayed to the model
+                        msgParts = textParts(msgParts)
+                }
+
+                parts, err := toGenaiParts(msgParts)
+                if err != nil {
+                        return nil, fmt.Errorf("message %d: %v", i, err)
+                }
+                if len(parts) == 0 {
+                        continue
+                }
+
+                history = append(history, &genai.Content{Role: role, Parts: parts})
+        }
+        return history, nil
+}
+
+// toGenaiParts converts message parts into Gemini parts, decoding inline image data
+func toGenaiParts(messageParts []MessagePart) ([]genai.Part, error) {
+        var parts []genai.Part
+        for _, part := range messageParts {
+                if part.Text != "" {
+                        parts = append(parts, genai.Text(part.Text))
+                }
+                if part.Data != "" {
+                        data, err := base64.StdEncoding.DecodeString(part.Data)
+                        if err != nil {
+                                return nil, fmt.Errorf("invalid base64 image data: %v", err)
+                        }
+                        mimeType := part.MimeType
+                        if mimeType == "" {
+                                mimeType = http.DetectContentType(data)
+                        }
+                        parts = append(parts, genai.Blob{MIMEType: mimeType, Data: data})
+                }
+        }
+        return parts, nil
+}
+
+// functionCalls returns the function calls in the first candidate of a Gemini response
+func functionCalls(resp *genai.GenerateContentResponse) []genai.FunctionCall {
+        if resp == nil || len(resp.Candidates) == 0 {
+                return nil
+        }
+        return resp.Candidates[0].FunctionCalls()
+}
+
+// responseText joins the text parts of the first candidate in a Gemini response
+func responseText(resp *genai.GenerateContentResponse) string {
+        if resp == nil || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+                return ""
+        }
+
+        var sb strings.Builder
+        for _, part := range resp.Candidates[0].Content.Parts {
+                if textPart, ok := part.(genai.Text); ok {
+                        sb.WriteString(string(textPart))
+                }
+        }
+        return sb.String()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "sync"
+        "sync/atomic"
+
+        "github.com/google/generative-ai-go/genai"
+        "google.golang.org/api/option"
+)
+
+// errClientPoolClosed is returned when a request arrives after shutdown began
+var errClientPoolClosed = errors.New("gemini client pool is closed")
+
+// geminiClientPool shares a fixed set of long-lived Gemini clients across
+// requests instead of connecting per request. Clients are handed out round
+// robin; each one caches its configured GenerativeModels.
+type geminiClientPool struct {
+        clients []*pooledClient
+        next    atomic.Uint64
+
+        mu       sync.RWMutex
+        closed   bool
+        inFlight sync.WaitGroup
+}
+
+// pooledClient is a Gemini client and the models configured on it
+type pooledClient struct {
+        client *genai.Client
+
+        mu     sync.Mutex
+        models map[string]*genai.GenerativeModel
+}
+
+// newGeminiClientPool creates size clients authenticated with apiKey. opts
+// are passed on to every client, e.g. to point them at another endpoint.
+func newGeminiClientPool(ctx context.Context, apiKey string, size int, opts ...option.ClientOption) (*geminiClientPool, error) {
+        pool := &geminiClientPool{}
+        opts = append([]option.ClientOption{option.WithAPIKey(apiKey)}, opts...)
+        for i := 0; i < size; i++ {
+                client, err := genai.NewClient(ctx, opts...)
+                if err != nil {
+                        pool.Close()
+                        return nil, fmt.Errorf("failed to initialize Gemini client: %v", err)
+                }
+                pool.clients = append(pool.clients, &pooledClient{
+                        client: client,
+                        models: make(map[string]*genai.GenerativeModel),
+                })
+        }
+        return pool, nil
+}
+
+// acquire returns the next client. release must be called once the request
+// is done with it so Close can wait for in-flight requests.
+func (p *geminiClientPool) acquire() (c *pooledClient, release func(), err error) {
+        p.mu.RLock()
+        defer p.mu.RUnlock()
+        if p.closed {
+                return nil, nil, errClientPoolClosed
+        }
+
+        p.inFlight.Add(1)
+        c = p.clients[(p.next.Add(1)-1)%uint64(len(p.clients))]
+        return c, p.inFlight.Done, nil
+}
+
+// Close stops handing out clients, waits for in-flight requests to release
+// theirs and then closes every client
+func (p *geminiClientPool) Close() error {
+        p.mu.Lock()
+        if p.closed {
+                p.mu.Unlock()
+                return nil
+        }
+        p.closed = true
+        p.mu.Unlock()
+
+        p.inFlight.Wait()
+
+        var errs []error
+        for _, c := range p.clients {
+                if err := c.client.Close(); err != nil {
+                        errs = append(errs, err)
+                }
+        }
+        return errors.Join(errs...)
+}
+
+// model returns the GenerativeModel cached under key, creating it for name
+// and applying configure on first use. Cached models are shared between
+// requests and must not be modified after configure returns.
+func (c *pooledClient) model(key, name string, configure func(*genai.GenerativeModel)) *genai.GenerativeModel {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+
+        if model, ok := c.models[key]; ok {
+                return model
+        }
+        model := c.client.GenerativeModel(name)
+        configure(model)
+        c.models[key] = model
+        return model
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+        "context"
+        "io"
+        "net/http"
+        "net/http/httptest"
+        "testing"
+
+        "github.com/google/generative-ai-go/genai"
+        "google.golang.org/api/option"
+)
+
+// benchmarkModel is the model the benchmarks request; the stand-in server
+// answers for any model
+const benchmarkModel = "gemini-1.5-flash"
+
+// newGeminiStandIn serves a fixed generateContent response for every request
+func newGeminiStandIn(b *testing.B) *httptest.Server {
+        b.Helper()
+        srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                io.Copy(io.Discard, r.Body)
+                w.Header().Set("Content-Type", "application/json")
+                io.WriteString(w, `{"candidates":[{"content":{"role":"model","parts":[{"text":"ok"}]},"finishReason":"STOP"}]}`)
+        }))
+        b.Cleanup(srv.Close)
+        return srv
+}
+
+// BenchmarkGeminiClientPool compares a request through the shared pool with
+// the previous behavior of creating and closing a client per request, under
+// concurrent load against a local stand-in for the Gemini API
+func BenchmarkGeminiClientPool(b *testing.B) {
+        ctx := context.Background()
+        endpoint := option.WithEndpoint(newGeminiStandIn(b).URL)
+
+        b.Run("PerRequestClient", func(b *testing.B) {
+                b.RunParallel(func(pb *testing.PB) {
+                        for pb.Next() {
+                                client, err := genai.NewClient(ctx, option.WithAPIKey("test"), endpoint)
+                                if err != nil {
+                                        b.Error(err)
+                                        return
+                                }
+                                _, err = client.GenerativeModel(benchmarkModel).GenerateContent(ctx, genai.Text("hi"))
+                                client.Close()
+                                if err != nil {
+                                        b.Error(err)
+                                        return
+                                }
+                        }
+                })
+        })
+
+        b.Run("Pool", func(b *testing.B) {
+                pool, err := newGeminiClientPool(ctx, "test", defaultConfig().Gemini.ClientPoolSize, endpoint)
+                if err != nil {
+                        b.Fatal(err)
+                }
+                defer pool.Close()
+
+                b.ResetTimer()
+                b.RunParallel(func(pb *testing.PB) {
+                        for pb.Next() {
+                                client, release, err := pool.acquire()
+                                if err != nil {
+                                        b.Error(err)
+                                        return
+                                }
+                                model := client.model(benchmarkModel, benchmarkModel, func(*genai.GenerativeModel) {})
+                                _, err = model.GenerateContent(ctx, genai.Text("hi"))
+                                release()
+                                if err != nil {
+                                        b.Error(err)
+                                        return
+                                }
+                        }
+                })
+        })
+}
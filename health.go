@@ -0,0 +1,224 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "fmt"
+        "log/slog"
+        "net/http"
+        "sync"
+        "time"
+
+        "go.opentelemetry.io/otel/attribute"
+        "go.opentelemetry.io/otel/trace"
+)
+
+// Prober is implemented by backends that can check whether they are
+// reachable without doing real work
+type Prober interface {
+        Probe(ctx context.Context) error
+}
+
+// probeURL sends a GET to url, authenticated with apiKey when set, and fails
+// unless the backend answers 200
+func probeURL(ctx context.Context, client *http.Client, url, apiKey string) error {
+        req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+        if err != nil {
+                return fmt.Errorf("failed to create request: %v", err)
+        }
+        if apiKey != "" {
+                req.Header.Set("Authorization", "Bearer "+apiKey)
+        }
+
+        resp, err := client.Do(req)
+        if err != nil {
+                return fmt.Errorf("failed to send request: %v", err)
+        }
+        defer resp.Body.Close()
+
+        trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+        if resp.StatusCode != http.StatusOK {
+                return fmt.Errorf("status %d", resp.StatusCode)
+        }
+        return nil
+}
+
+// BackendHealth is the result of the most recent probe of one backend
+type BackendHealth struct {
+        Name       string    `json:"name"`
+        Capability string    `json:"capability"`
+        Reachable  bool      `json:"reachable"`
+        Error      string    `json:"error,omitempty"`
+        LatencyMs  int64     `json:"latencyMs"`
+        CheckedAt  time.Time `json:"checkedAt"`
+}
+
+// statusBackend is a backend tracked by the statusChecker
+type statusBackend struct {
+        name       string
+        capability string
+        prober     Prober
+}
+
+// statusChecker probes every backend for /api/status and caches the results
+// for ttl so that frequent polling does not reach the upstream APIs each time
+type statusChecker struct {
+        backends []statusBackend
+        ttl      time.Duration
+        timeout  time.Duration
+
+        // mu is held while probing so concurrent callers wait for one refresh
+        // instead of probing the same backends again
+        mu      sync.Mutex
+        results map[string]BackendHealth
+}
+
+// newStatusChecker tracks the chat providers and image backends that support
+// probing
+func newStatusChecker(cfg ServerConfig, providers *providerSet, images ImageGenerator) *statusChecker {
+        c := &statusChecker{
+                ttl:     time.Duration(cfg.StatusCacheTTL),
+                timeout: time.Duration(cfg.ProbeTimeout),
+                results: make(map[string]BackendHealth),
+        }
+        for _, name := range providers.names() {
+                p, _ := providers.get(name)
+                if prober, ok := p.(Prober); ok {
+                        c.backends = append(c.backends, statusBackend{name: name, capability: "chat", prober: prober})
+                }
+        }
+        for _, g := range imageBackends(images) {
+                if prober, ok := g.(Prober); ok {
+                        c.backends = append(c.backends, statusBackend{name: g.Name(), capability: "image_generation", prober: prober})
+                }
+        }
+        return c
+}
+
+// check returns the health of every backend, probing in parallel those whose
+// cached result is older than the ttl
+func (c *statusChecker) check() []BackendHealth {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+
+        var wg sync.WaitGroup
+        var resultsMu sync.Mutex
+        for _, b := range c.backends {
+                if cached, ok := c.results[b.name]; ok && time.Since(cached.CheckedAt) < c.ttl {
+                        continue
+                }
+                wg.Add(1)
+                go func(b statusBackend) {
+                        defer wg.Done()
+                        health := c.probe(b)
+                        resultsMu.Lock()
+                        c.results[b.name] = health
+                        resultsMu.Unlock()
+                }(b)
+        }
+        wg.Wait()
+
+        results := make([]BackendHealth, 0, len(c.backends))
+        for _, b := range c.backends {
+                results = append(results, c.results[b.name])
+        }
+        return results
+}
+
+// probe runs one probe. It is not tied to the request that triggered it since
+// the result is cached for other callers.
+func (c *statusChecker) probe(b statusBackend) BackendHealth {
+        ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+        defer cancel()
+        ctx, span := tracer.Start(ctx, "status.probe", trace.WithAttributes(
+                attribute.String("backend", b.name),
+                attribute.String("capability", b.capability),
+        ))
+
+        start := time.Now()
+        err := b.prober.Probe(ctx)
+        endSpan(span, err)
+        health := BackendHealth{
+                Name:       b.name,
+                Capability: b.capability,
+                Reachable:  err == nil,
+                LatencyMs:  time.Since(start).Milliseconds(),
+                CheckedAt:  start,
+        }
+        if err != nil {
+                slog.Warn("Backend probe failed", "backend", b.name, "capability", b.capability, "err", err)
+                health.Error = err.Error()
+        }
+        return health
+}
+
+// handleHealthz reports that the process is alive and serving HTTP
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", "no-store")
+        json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the server accepts new work: the configuration
+// is valid, the chat providers and conversation store are initialized and the
+// server is not draining for shutdown
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", "no-store")
+
+        if reason := s.notReadyReason(); reason != "" {
+                w.WriteHeader(http.StatusServiceUnavailable)
+                json.NewEncoder(w).Encode(map[string]string{"status": "unavailable", "reason": reason})
+                return
+        }
+        json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
+
+// notReadyReason returns why the server should not receive traffic, or ""
+func (s *server) notReadyReason() string {
+        if !s.ready.Load() {
+                return "draining"
+        }
+        if err := s.cfg.validate(); err != nil {
+                return fmt.Sprintf("invalid configuration: %v", err)
+        }
+        if s.providers == nil || len(s.providers.names()) == 0 {
+                return "no chat provider is initialized"
+        }
+        if s.store == nil {
+                return "conversation store is not initialized"
+        }
+        return ""
+}
+
+// statusResponse is the body of GET /api/status
+type statusResponse struct {
+        // Status is "ok" when every backend is reachable and "degraded" otherwise
+        Status   string          `json:"status"`
+        Ready    bool            `json:"ready"`
+        Backends []BackendHealth `json:"backends"`
+}
+
+// handleStatus serves GET /api/status with the cached reachability of every
+// chat and image backend
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "GET" {
+                slog.WarnContext(r.Context(), "Invalid method", "method", r.Method)
+                sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        resp := statusResponse{
+                Status:   "ok",
+                Ready:    s.notReadyReason() == "",
+                Backends: s.status.check(),
+        }
+        for _, b := range resp.Backends {
+                if !b.Reachable {
+                        resp.Status = "degraded"
+                }
+        }
+        json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/json"
+        "fmt"
+        "io"
+        "log/slog"
+        "net/http"
+        "strings"
+        "time"
+
+        "go.opentelemetry.io/otel/attribute"
+        "go.opentelemetry.io/otel/trace"
+)
+
+// defaultHuggingFaceModels is the fallback chain used when no models are
+// configured, ordered by how likely each model is to be available
+var defaultHuggingFaceModels = []string{
+        "black-forest-labs/FLUX.1-dev",
+        "black-forest-labs/FLUX.1-schnell",
+        "stabilityai/stable-diffusion-xl-base-1.0",
+        "stabilityai/sdxl-turbo",
+        "Lykon/DreamShaper",
+        "prompthero/openjourney",
+        "nitrosocke/Arcane-Diffusion",
+        "runwayml/stable-diffusion-v1-5",
+        "CompVis/stable-diffusion-v1-4",
+        "stabilityai/stable-diffusion-2-1",
+}
+
+// huggingFaceGenerator generates images with the Hugging Face inference API,
+// falling back through its configured models in order
+type huggingFaceGenerator struct {
+        apiKey        string
+        baseURL       string
+        models        []string
+        steps         int
+        guidanceScale float64
+        timeout       time.Duration
+        retry         retryPolicy
+        health        *modelHealth
+        breakers      *breakerSet
+}
+
+func newHuggingFaceGenerator(cfg HuggingFaceConfig) *huggingFaceGenerator {
+        h := &huggingFaceGenerator{
+                apiKey:        cfg.APIKey,
+                baseURL:       strings.TrimRight(cfg.BaseURL, "/"),
+                models:        cfg.Models,
+                steps:         cfg.Steps,
+                guidanceScale: cfg.GuidanceScale,
+                timeout:       time.Duration(cfg.Timeout),
+                retry: retryPolicy{
+                        maxRetries: cfg.MaxRetries,
+                        baseDelay:  time.Duration(cfg.RetryDelay),
+                        maxDelay:   time.Duration(cfg.MaxRetryDelay),
+                },
+        }
+        h.breakers = newBreakerSet(h.Name(), cfg.Breaker)
+        h.health = newModelHealth(h.Name(), cfg.Models, h.probeModel, time.Duration(cfg.HealthInterval), time.Duration(cfg.ProbeTimeout))
+        return h
+}
+
+func (h *huggingFaceGenerator) Name() string {
+        return "huggingface"
+}
+
+// huggingFaceModel describes the parameters model accepts. Only Stable
+// Diffusion models take any; other models reject requests that set them.
+func huggingFaceModel(model string) ImageModel {
+        m := ImageModel{Name: model, Backend: "huggingface"}
+        switch {
+        case strings.Contains(model, "sdxl") || strings.Contains(model, "stable-diffusion-xl"):
+                m.MaxWidth, m.MaxHeight = 1024, 1024
+        case strings.Contains(model, "stable-diffusion"):
+                m.MaxWidth, m.MaxHeight = 768, 768
+        default:
+                return m
+        }
+        m.NegativePrompt = true
+        m.MaxSteps = 100
+        m.Guidance = true
+        m.Seed = true
+        return m
+}
+
+// Models returns the configured models in fallback order
+func (h *huggingFaceGenerator) Models() []ImageModel {
+        models := make([]ImageModel, len(h.models))
+        for i, model := range h.models {
+                models[i] = huggingFaceModel(model)
+        }
+        return models
+}
+
+// parameters returns the inference parameters sent with a request to model
+// and the parameters the image is generated with. Unset steps and guidance
+// take the configured defaults, and an unset seed a random one.
+func (h *huggingFaceGenerator) parameters(model string, params ImageParams) (map[string]interface{}, ImageParams) {
+        applied := ImageParams{Model: model}
+        if huggingFaceModel(model).MaxSteps == 0 {
+                return nil, applied
+        }
+
+        applied = ImageParams{
+                NegativePrompt: params.NegativePrompt,
+                Width:          params.Width,
+                Height:         params.Height,
+                Steps:          params.Steps,
+                Guidance:       params.Guidance,
+                Model:          model,
+        }.withSeed(seedFor(params))
+        if applied.Steps == 0 {
+                applied.Steps = h.steps
+        }
+        if applied.Guidance == 0 {
+                applied.Guidance = h.guidanceScale
+        }
+        parameters := map[string]interface{}{
+                "num_inference_steps": applied.Steps,
+                "guidance_scale":      applied.Guidance,
+                "seed":                *applied.Seed,
+        }
+        if applied.NegativePrompt != "" {
+                parameters["negative_prompt"] = applied.NegativePrompt
+        }
+        if applied.Width > 0 {
+                parameters["width"] = applied.Width
+        }
+        if applied.Height > 0 {
+                parameters["height"] = applied.Height
+        }
+        return parameters, applied
+}
+
+// candidates returns the models that accept params, healthiest first, with
+// the preferred model, if any, ahead of the others
+func (h *huggingFaceGenerator) candidates(params ImageParams) []string {
+        var preferred, others []string
+        for _, model := range h.health.order() {
+                switch {
+                case huggingFaceModel(model).accepts(params) != nil:
+                        continue
+                case model == params.Model:
+                        preferred = append(preferred, model)
+                default:
+                        others = append(others, model)
+                }
+        }
+        return append(preferred, others...)
+}
+
+// healthRegistry returns the health of the configured models
+func (h *huggingFaceGenerator) healthRegistry() *modelHealth {
+        return h.health
+}
+
+// circuitBreakers returns the circuit breakers of the configured models
+func (h *huggingFaceGenerator) circuitBreakers() *breakerSet {
+        return h.breakers
+}
+
+// probeModel asks the inference API for the state of model. Models that are
+// still loading answer 503, or 200 with "loaded": false.
+func (h *huggingFaceGenerator) probeModel(ctx context.Context, model string) (check modelCheck) {
+        ctx, span := tracer.Start(ctx, "huggingface.check_model", trace.WithAttributes(attribute.String("model", model)))
+        defer func() {
+                span.SetAttributes(attribute.String("state", check.state()))
+                endSpan(span, check.err)
+        }()
+
+        req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/models/%s", h.baseURL, model), nil)
+        if err != nil {
+                return modelCheck{err: fmt.Errorf("failed to create request: %v", err)}
+        }
+        req.Header.Set("Authorization", "Bearer "+h.apiKey)
+
+        start := time.Now()
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+                return modelCheck{latency: time.Since(start), err: fmt.Errorf("failed to send request: %v", err)}
+        }
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+        check = modelCheck{status: resp.StatusCode, latency: time.Since(start)}
+        span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+        var state struct {
+                Loaded *bool `json:"loaded"`
+        }
+        switch {
+        case resp.StatusCode == http.StatusServiceUnavailable:
+                check.loading = true
+                check.err = fmt.Errorf("model is loading")
+        case resp.StatusCode != http.StatusOK:
+                check.err = fmt.Errorf("status %d", resp.StatusCode)
+        case json.Unmarshal(body, &state) == nil && state.Loaded != nil && !*state.Loaded:
+                check.loading = true
+                check.err = fmt.Errorf("model is not loaded")
+        }
+        return check
+}
+
+// Probe refreshes the model health registry and reports the backend reachable
+// when at least one configured model is available
+func (h *huggingFaceGenerator) Probe(ctx context.Context) error {
+        if len(h.models) == 0 {
+                return fmt.Errorf("no Hugging Face models configured")
+        }
+        h.health.probeAll(ctx)
+        if ctx.Err() != nil {
+                return ctx.Err()
+        }
+        return h.health.available()
+}
+
+// Generate tries each configured model that accepts params in turn,
+// preferred model and then healthiest first, and returns the first valid
+// image. Models whose circuit is open are skipped, and a 401 ends the search
+// since every model shares the API key.
+func (h *huggingFaceGenerator) Generate(ctx context.Context, prompt string, params ImageParams) (*GeneratedImage, error) {
+        models := h.models
+        if len(models) == 0 {
+                return nil, fmt.Errorf("no Hugging Face models configured")
+        }
+        
+        slog.InfoContext(ctx, "Starting image generation", "prompt", prompt)
+        
+        var lastError error
+        
+        // Start with the models that worked most recently. The registry is
+        // kept up to date in the background, so no model is checked here.
+        modelsToTry := h.candidates(params)
+        if len(modelsToTry) == 0 {
+                return nil, fmt.Errorf("no Hugging Face model accepts these parameters")
+        }
+        slog.DebugContext(ctx, "Model order", "models", modelsToTry)
+        
+        // Each model attempt gets a span, ended when the next attempt starts
+        // or Generate returns. Ending it also settles the model's circuit
+        // breaker with the attempt's final status.
+        var attempt trace.Span
+        var attemptModel string
+        var attemptStatus int
+        var attemptRetryAfter time.Duration
+        endAttempt := func(err error) {
+                if attempt != nil {
+                        endSpan(attempt, err)
+                        attempt = nil
+                }
+                if attemptModel == "" {
+                        return
+                }
+                switch {
+                case err == nil:
+                        h.breakers.success(attemptModel)
+                case ctx.Err() != nil || attemptStatus == http.StatusUnauthorized:
+                        // Cancelled requests and a bad API key say nothing
+                        // about the model
+                        h.breakers.release(attemptModel)
+                default:
+                        h.breakers.failure(attemptModel, attemptStatus, attemptRetryAfter)
+                }
+                attemptModel = ""
+        }
+        defer func() {
+                if lastError == nil {
+                        lastError = ctx.Err()
+                }
+                endAttempt(lastError)
+        }()
+
+        for _, model := range modelsToTry {
+                endAttempt(lastError)
+                // Stop as soon as the request is cancelled or times out
+                if ctx.Err() != nil {
+                        return nil, ctx.Err()
+                }
+                if ok, until := h.breakers.allow(model); !ok {
+                        slog.InfoContext(ctx, "Skipping model with open circuit", "model", model, "until", until)
+                        lastError = fmt.Errorf("model %s skipped, circuit open until %s", model, until.UTC().Format(time.RFC3339))
+                        continue
+                }
+                _, attempt = tracer.Start(ctx, "huggingface.generate", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("model", model)))
+                attemptModel, attemptStatus, attemptRetryAfter = model, 0, 0
+                lastError = nil
+
+                slog.InfoContext(ctx, "Trying image generation", "model", model)
+                reportProgress(ctx, h.Name(), model)
+                url := fmt.Sprintf("%s/models/%s", h.baseURL, model)
+                
+                // Prepare request payload - simplified for better compatibility
+                payload := map[string]interface{}{
+                        "inputs": prompt,
+                }
+                
+                // Add parameters only for models that accept them
+                parameters, applied := h.parameters(model, params)
+                if len(parameters) > 0 {
+                        payload["parameters"] = parameters
+                }
+                
+                jsonPayload, err := json.Marshal(payload)
+                if err != nil {
+                        lastError = fmt.Errorf("failed to marshal payload: %v", err)
+                        continue
+                }
+                
+                slog.DebugContext(ctx, "Sending request", "url", url, "body", string(jsonPayload))
+                
+                // The request is rebuilt for every retry since sending it
+                // consumes its body
+                newRequest := func(ctx context.Context) (*http.Request, error) {
+                        req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonPayload))
+                        if err != nil {
+                                return nil, err
+                        }
+                        req.Header.Set("Authorization", "Bearer "+h.apiKey)
+                        req.Header.Set("Content-Type", "application/json")
+                        req.Header.Set("User-Agent", "GeminiChatApp/1.0")
+                        return req, nil
+                }
+                
+                // A model that is loading answers 503 and is retried after its
+                // estimated_time, or the backoff when it gives none
+                retryLoading := func(resp *http.Response, body []byte) (bool, time.Duration) {
+                        if resp.StatusCode != http.StatusServiceUnavailable {
+                                return false, 0
+                        }
+                        observeHuggingFaceStatus(model, resp.StatusCode)
+                        attempt.SetAttributes(attribute.Bool("retried", true))
+                        wait := huggingFaceRetryAfter(resp, body)
+                        slog.InfoContext(ctx, "Model is loading (503), will retry", "model", model, "estimated_time", wait)
+                        return true, wait
+                }
+                
+                // Send request with longer timeout for image generation
+                client := &http.Client{
+                        Timeout: h.timeout,
+                }
+                
+                slog.DebugContext(ctx, "Sending request to model", "model", model)
+                startTime := time.Now()
+                
+                resp, body, err := h.retry.do(ctx, client, newRequest, retryLoading)
+                if err != nil {
+                        huggingFaceRequestsTotal.WithLabelValues(model, hfResultFailure).Inc()
+                        lastError = err
+                        slog.WarnContext(ctx, "Request failed", "model", model, "duration", time.Since(startTime), "err", err)
+                        if ctx.Err() == nil {
+                                h.health.record(model, modelCheck{latency: time.Since(startTime), err: lastError}, checkGeneration)
+                        }
+                        continue
+                }
+                
+                slog.InfoContext(ctx, "Received response", "model", model, "duration", time.Since(startTime), "status", resp.StatusCode, "body_length", len(body))
+                observeHuggingFaceStatus(model, resp.StatusCode)
+                attempt.SetAttributes(
+                        attribute.Int("http.response.status_code", resp.StatusCode),
+                        attribute.Int("http.response.body.size", len(body)),
+                )
+                
+                // Log first 200 characters of response for debugging
+                if len(body) > 0 {
+                        preview := string(body)
+                        if len(preview) > 200 {
+                                preview = preview[:200] + "..."
+                        }
+                        slog.DebugContext(ctx, "Response preview", "body", preview)
+                }
+                
+                // Any error status counts against the model's health and
+                // circuit, which honors Retry-After on 429 and 503 and the
+                // estimated_time of a model still loading
+                attemptStatus = resp.StatusCode
+                attemptRetryAfter = huggingFaceRetryAfter(resp, body)
+                if resp.StatusCode != http.StatusOK {
+                        h.health.record(model, modelCheck{
+                                status:  resp.StatusCode,
+                                loading: resp.StatusCode == http.StatusServiceUnavailable,
+                                latency: time.Since(startTime),
+                                err:     fmt.Errorf("status %d", resp.StatusCode),
+                        }, checkGeneration)
+                }
+
+                if resp.StatusCode == 404 {
+                        slog.WarnContext(ctx, "Model not found (404), trying next model", "model", model)
+                        lastError = fmt.Errorf("model %s not found", model)
+                        continue
+                } else if resp.StatusCode == 401 {
+                        // Every model shares the API key, so the others would fail too
+                        slog.ErrorContext(ctx, "Unauthorized (401) - check your Hugging Face API key, skipping the remaining models", "model", model)
+                        lastError = fmt.Errorf("unauthorized - invalid API key")
+                        return nil, lastError
+                } else if resp.StatusCode == 429 {
+                        slog.WarnContext(ctx, "Rate limit exceeded (429), trying next model", "model", model)
+                        lastError = fmt.Errorf("rate limit exceeded")
+                        continue
+                }
+
+                if resp.StatusCode != http.StatusOK {
+                        slog.WarnContext(ctx, "API request failed", "model", model, "status", resp.StatusCode, "body", string(body))
+                        lastError = fmt.Errorf("API request failed for model %s with status %d: %s", model, resp.StatusCode, string(body))
+                        continue
+                }
+
+                // Check if response is JSON error
+                var errorResp map[string]interface{}
+                if json.Unmarshal(body, &errorResp) == nil {
+                        if errorMsg, exists := errorResp["error"]; exists {
+                                huggingFaceRequestsTotal.WithLabelValues(model, hfResultFailure).Inc()
+                                slog.WarnContext(ctx, "Model returned error", "model", model, "error", errorMsg)
+                                lastError = fmt.Errorf("model %s returned error: %v", model, errorMsg)
+                                continue
+                        }
+                }
+
+                // Validate response is image data
+                if len(body) < 100 {
+                        huggingFaceRequestsTotal.WithLabelValues(model, hfResultFailure).Inc()
+                        slog.WarnContext(ctx, "Response too short to be an image", "model", model, "body_length", len(body))
+                        lastError = fmt.Errorf("response too short for model %s", model)
+                        continue
+                }
+                        
+                // Check if it's actually image data by checking magic bytes
+                if len(body) >= 4 {
+                        // Check for common image file signatures
+                        isImage := false
+                        if body[0] == 0xFF && body[1] == 0xD8 && body[2] == 0xFF { // JPEG
+                                isImage = true
+                        } else if body[0] == 0x89 && body[1] == 0x50 && body[2] == 0x4E && body[3] == 0x47 { // PNG
+                                isImage = true
+                        } else if body[0] == 0x47 && body[1] == 0x49 && body[2] == 0x46 { // GIF
+                                isImage = true
+                        } else if body[0] == 0x52 && body[1] == 0x49 && body[2] == 0x46 && body[3] == 0x46 { // WEBP (starts with RIFF)
+                                isImage = true
+                        }
+
+                        if !isImage {
+                                huggingFaceRequestsTotal.WithLabelValues(model, hfResultFailure).Inc()
+                                slog.WarnContext(ctx, "Response doesn't appear to be image data", "model", model, "first_bytes", fmt.Sprintf("%v", body[:min(20, len(body))]))
+                                lastError = fmt.Errorf("invalid image data from model %s", model)
+                                continue
+                        }
+                }
+                        
+                // Success!
+                slog.InfoContext(ctx, "Successfully generated image", "model", model, "size", len(body))
+                huggingFaceRequestsTotal.WithLabelValues(model, hfResultSuccess).Inc()
+                h.health.record(model, modelCheck{status: resp.StatusCode, latency: time.Since(startTime)}, checkGeneration)
+                img := &GeneratedImage{
+                        Data:     body,
+                        MimeType: http.DetectContentType(body),
+                        Model:    model,
+                        Params:   applied,
+                }
+                observeGeneratedImage(h.Name(), img)
+                endAttempt(nil)
+                return img, nil
+        }
+        
+        // All models failed
+        return nil, fmt.Errorf("all image generation models failed, last error: %v", lastError)
+}
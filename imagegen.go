@@ -0,0 +1,352 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "crypto/sha256"
+        "encoding/base64"
+        "encoding/json"
+        "fmt"
+        "image"
+        "image/color"
+        "image/png"
+        "io"
+        "log/slog"
+        "net/http"
+        "strings"
+        "time"
+)
+
+// generatedImageResponse is the reply text sent with a generated image
+const generatedImageResponse = "Saya telah membuat gambar sesuai permintaan Anda!"
+
+// ImageGenerator is a text-to-image backend used for image generation requests
+type ImageGenerator interface {
+        // Name identifies the backend in configuration and logs
+        Name() string
+
+        // Generate renders an image for prompt with the models that accept
+        // params, starting with params.Model when it is one of them
+        Generate(ctx context.Context, prompt string, params ImageParams) (*GeneratedImage, error)
+
+        // Models lists the models of the backend and the parameters they accept
+        Models() []ImageModel
+}
+
+// GeneratedImage is the output of an ImageGenerator
+type GeneratedImage struct {
+        Data     []byte
+        MimeType string
+        // Model is the backend model that produced the image
+        Model string
+        // Params are the parameters the image was generated with, including
+        // the model and the seed, if the model takes one
+        Params ImageParams
+}
+
+// Base64 returns the image data encoded for JSON responses
+func (g *GeneratedImage) Base64() string {
+        return base64.StdEncoding.EncodeToString(g.Data)
+}
+
+// imageGeneratorChain tries each generator in order until one succeeds
+type imageGeneratorChain struct {
+        generators []ImageGenerator
+}
+
+func (c *imageGeneratorChain) Name() string {
+        names := make([]string, len(c.generators))
+        for i, g := range c.generators {
+                names[i] = g.Name()
+        }
+        return strings.Join(names, ",")
+}
+
+func (c *imageGeneratorChain) Models() []ImageModel {
+        var models []ImageModel
+        for _, g := range c.generators {
+                models = append(models, g.Models()...)
+        }
+        return models
+}
+
+// Generate tries the backend of the preferred model first, if any, and skips
+// backends without a model that accepts params
+func (c *imageGeneratorChain) Generate(ctx context.Context, prompt string, params ImageParams) (*GeneratedImage, error) {
+        var preferred, others []ImageGenerator
+        for _, g := range c.generators {
+                if params.Model != "" && hasModel(g.Models(), params.Model) {
+                        preferred = append(preferred, g)
+                } else {
+                        others = append(others, g)
+                }
+        }
+
+        var lastError error
+        for _, g := range append(preferred, others...) {
+                if _, err := acceptingModels(g.Models(), params); err != nil {
+                        lastError = fmt.Errorf("%s: %v", g.Name(), err)
+                        continue
+                }
+                img, err := g.Generate(ctx, prompt, params)
+                if err == nil {
+                        return img, nil
+                }
+                // A cancelled or timed out request would fail on every backend
+                if ctx.Err() != nil {
+                        return nil, ctx.Err()
+                }
+                slog.WarnContext(ctx, "Image generator failed", "generator", g.Name(), "err", err)
+                lastError = fmt.Errorf("%s: %v", g.Name(), err)
+        }
+        return nil, fmt.Errorf("all image generators failed, last error: %v", lastError)
+}
+
+// imageBackends returns the individual backends behind images, which may be
+// a chain, a single generator or nil
+func imageBackends(images ImageGenerator) []ImageGenerator {
+        switch g := images.(type) {
+        case nil:
+                return nil
+        case *imageGeneratorChain:
+                return g.generators
+        }
+        return []ImageGenerator{images}
+}
+
+// newImageGenerator builds the fallback chain from the ordered list of backend
+// names in cfg.Generators: "huggingface", "local" or "fake". The backend
+// settings are expected to have been validated with the rest of the Config.
+// Backends without credentials are left out and reported as disabled; when
+// none remain the generator is nil and image generation is unavailable.
+func newImageGenerator(cfg ImagesConfig) (ImageGenerator, []BackendStatus, error) {
+        var generators []ImageGenerator
+        var statuses []BackendStatus
+        for _, name := range cfg.Generators {
+                name = strings.TrimSpace(name)
+                status := BackendStatus{Name: name, Capability: "image_generation", Enabled: true}
+                switch name {
+                case "huggingface":
+                        if cfg.HuggingFace.APIKey == "" {
+                                status.Enabled = false
+                                status.Reason = "HUGGINGFACE_API_KEY is not set"
+                                break
+                        }
+                        generators = append(generators, newHuggingFaceGenerator(cfg.HuggingFace))
+                case "local":
+                        generators = append(generators, newLocalDiffusionGenerator(cfg.Local))
+                case "fake":
+                        generators = append(generators, fakeImageGenerator{})
+                case "":
+                        continue
+                default:
+                        return nil, nil, fmt.Errorf("unknown image generator %q", name)
+                }
+                statuses = append(statuses, status)
+        }
+
+        switch len(generators) {
+        case 0:
+                return nil, statuses, nil
+        case 1:
+                return generators[0], statuses, nil
+        }
+        return &imageGeneratorChain{generators: generators}, statuses, nil
+}
+
+// localDiffusionGenerator talks to a self-hosted Stable Diffusion server
+// exposing the Automatic1111 txt2img API (also served by SD.Next, Forge and
+// ComfyUI API bridges)
+type localDiffusionGenerator struct {
+        baseURL  string
+        steps    int
+        cfgScale float64
+        client   *http.Client
+}
+
+func newLocalDiffusionGenerator(cfg LocalDiffusionConfig) *localDiffusionGenerator {
+        return &localDiffusionGenerator{
+                baseURL:  strings.TrimRight(cfg.URL, "/"),
+                steps:    cfg.Steps,
+                cfgScale: cfg.CFGScale,
+                client:   &http.Client{Timeout: time.Duration(cfg.Timeout)},
+        }
+}
+
+func (l *localDiffusionGenerator) Name() string {
+        return "local"
+}
+
+// Probe lists the server's checkpoints, which fails if the API is down
+func (l *localDiffusionGenerator) Probe(ctx context.Context) error {
+        return probeURL(ctx, l.client, l.baseURL+"/sdapi/v1/sd-models", "")
+}
+
+// Models returns the model loaded by the server, which is not known here and
+// is called "local". The limits are those of the txt2img API.
+func (l *localDiffusionGenerator) Models() []ImageModel {
+        return []ImageModel{{
+                Name:           "local",
+                Backend:        l.Name(),
+                NegativePrompt: true,
+                MaxWidth:       2048,
+                MaxHeight:      2048,
+                MaxSteps:       150,
+                Guidance:       true,
+                Seed:           true,
+        }}
+}
+
+func (l *localDiffusionGenerator) Generate(ctx context.Context, prompt string, params ImageParams) (*GeneratedImage, error) {
+        reportProgress(ctx, l.Name(), "local")
+
+        // Unset parameters take the configured defaults, or the server's
+        // for the size
+        applied := ImageParams{
+                NegativePrompt: params.NegativePrompt,
+                Width:          params.Width,
+                Height:         params.Height,
+                Steps:          params.Steps,
+                Guidance:       params.Guidance,
+                Model:          "local",
+        }.withSeed(seedFor(params))
+        if applied.Steps == 0 {
+                applied.Steps = l.steps
+        }
+        if applied.Guidance == 0 {
+                applied.Guidance = l.cfgScale
+        }
+        payload := map[string]interface{}{
+                "prompt":    prompt,
+                "steps":     applied.Steps,
+                "cfg_scale": applied.Guidance,
+                "seed":      *applied.Seed,
+        }
+        if applied.NegativePrompt != "" {
+                payload["negative_prompt"] = applied.NegativePrompt
+        }
+        if applied.Width > 0 {
+                payload["width"] = applied.Width
+        }
+        if applied.Height > 0 {
+                payload["height"] = applied.Height
+        }
+
+        jsonPayload, err := json.Marshal(payload)
+        if err != nil {
+                return nil, fmt.Errorf("failed to marshal payload: %v", err)
+        }
+
+        req, err := http.NewRequestWithContext(ctx, "POST", l.baseURL+"/sdapi/v1/txt2img", bytes.NewReader(jsonPayload))
+        if err != nil {
+                return nil, fmt.Errorf("failed to create request: %v", err)
+        }
+        req.Header.Set("Content-Type", "application/json")
+
+        startTime := time.Now()
+        resp, err := l.client.Do(req)
+        if err != nil {
+                return nil, fmt.Errorf("failed to send request: %v", err)
+        }
+        defer resp.Body.Close()
+
+        body, err := io.ReadAll(resp.Body)
+        if err != nil {
+                return nil, fmt.Errorf("failed to read response: %v", err)
+        }
+        slog.InfoContext(ctx, "Local diffusion response", "duration", time.Since(startTime), "status", resp.StatusCode, "body_length", len(body))
+
+        if resp.StatusCode != http.StatusOK {
+                return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body[:min(200, len(body))]))
+        }
+
+        var result struct {
+                Images []string `json:"images"`
+        }
+        if err := json.Unmarshal(body, &result); err != nil {
+                return nil, fmt.Errorf("failed to decode response: %v", err)
+        }
+        if len(result.Images) == 0 {
+                return nil, fmt.Errorf("response contained no images")
+        }
+
+        data, err := base64.StdEncoding.DecodeString(result.Images[0])
+        if err != nil {
+                return nil, fmt.Errorf("invalid base64 image data: %v", err)
+        }
+
+        img := &GeneratedImage{
+                Data:     data,
+                MimeType: http.DetectContentType(data),
+                Model:    "local",
+                Params:   applied,
+        }
+        observeGeneratedImage(l.Name(), img)
+        return img, nil
+}
+
+// fakeImageGenerator returns a PNG whose colours are derived from the prompt,
+// negative prompt and seed, so the same request always yields the same image.
+// It is meant for tests and local development without any image backend, and
+// accepts every parameter so that clients can exercise them.
+type fakeImageGenerator struct{}
+
+func (fakeImageGenerator) Name() string {
+        return "fake"
+}
+
+func (fakeImageGenerator) Probe(ctx context.Context) error {
+        return nil
+}
+
+func (f fakeImageGenerator) Models() []ImageModel {
+        return []ImageModel{{
+                Name:           "fake",
+                Backend:        f.Name(),
+                NegativePrompt: true,
+                MaxWidth:       512,
+                MaxHeight:      512,
+                MaxSteps:       150,
+                Guidance:       true,
+                Seed:           true,
+        }}
+}
+
+func (f fakeImageGenerator) Generate(ctx context.Context, prompt string, params ImageParams) (*GeneratedImage, error) {
+        reportProgress(ctx, f.Name(), "fake")
+
+        const defaultSize = 64
+        applied := params.withSeed(seedFor(params))
+        applied.NumImages = 0
+        applied.Model = "fake"
+        if applied.Width == 0 {
+                applied.Width = defaultSize
+        }
+        if applied.Height == 0 {
+                applied.Height = defaultSize
+        }
+        sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", prompt, applied.NegativePrompt, *applied.Seed)))
+
+        img := image.NewRGBA(image.Rect(0, 0, applied.Width, applied.Height))
+        for y := 0; y < applied.Height; y++ {
+                for x := 0; x < applied.Width; x++ {
+                        // Split the image into 4x4 tiles, each coloured from two hash bytes
+                        i := (y*4/applied.Height*4 + x*4/applied.Width) * 2
+                        img.Set(x, y, color.RGBA{R: sum[i%32], G: sum[(i+1)%32], B: sum[(i+7)%32], A: 255})
+                }
+        }
+
+        var buf bytes.Buffer
+        if err := png.Encode(&buf, img); err != nil {
+                return nil, fmt.Errorf("failed to encode image: %v", err)
+        }
+
+        generated := &GeneratedImage{
+                Data:     buf.Bytes(),
+                MimeType: "image/png",
+                Model:    "fake",
+                Params:   applied,
+        }
+        observeGeneratedImage("fake", generated)
+        return generated, nil
+}
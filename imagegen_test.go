@@ -0,0 +1,210 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "net/http"
+        "testing"
+        "time"
+)
+
+func TestServeChatImageJob(t *testing.T) {
+        s := newTestServer(t)
+        seed := int64(42)
+        req := &chatRequest{
+                Prompt:      "generate an image of a cat",
+                ImageParams: ImageParams{Width: 32, Height: 16, Seed: &seed, NumImages: 2},
+        }
+
+        code, resp := serveChat(t, s, req)
+        if code != http.StatusAccepted {
+                t.Fatalf("status = %d (%s), want 202", code, resp.Error)
+        }
+        if resp.JobID == "" || resp.ImageParams == nil || resp.ImageParams.NumImages != 2 {
+                t.Fatalf("response = %+v, want a job echoing the parameters", resp)
+        }
+
+        state := waitJob(t, s, resp.JobID)
+        if state.Status != jobSucceeded {
+                t.Fatalf("job status = %s (%s), want succeeded", state.Status, state.Error)
+        }
+        if len(state.Images) != 2 {
+                t.Fatalf("job has %d images, want 2", len(state.Images))
+        }
+        for i, image := range state.Images {
+                p := image.Params
+                if p.Model != "fake" || p.Width != 32 || p.Height != 16 || p.Seed == nil || *p.Seed != seed+int64(i) {
+                        t.Errorf("image %d params = %+v, want fake 32x16 with seed %d", i, p, seed+int64(i))
+                }
+        }
+
+        // The echoed parameters generate the same image again
+        again, err := fakeImageGenerator{}.Generate(context.Background(), req.Prompt, state.Images[1].Params)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if again.Base64() != state.Images[1].ImageBase64 {
+                t.Error("regenerating with the echoed parameters gave a different image")
+        }
+}
+
+func TestServeChatRejectsImageParams(t *testing.T) {
+        s := newTestServer(t)
+        tests := []struct {
+                name   string
+                params ImageParams
+        }{
+                {"size not a multiple of 8", ImageParams{Width: 30}},
+                {"size above the model limit", ImageParams{Width: 1024}},
+                {"too many images", ImageParams{NumImages: 10}},
+                {"unknown model", ImageParams{Model: "nope"}},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        code, resp := serveChat(t, s, &chatRequest{Prompt: "draw a dog", ImageParams: tt.params})
+                        if code != http.StatusBadRequest || resp.Error == "" {
+                                t.Errorf("status = %d, error = %q, want 400 with an error", code, resp.Error)
+                        }
+                })
+        }
+}
+
+func TestServeChatChargesEveryImage(t *testing.T) {
+        type request struct {
+                numImages int
+                want      int
+        }
+        tests := []struct {
+                name     string
+                limit    RateLimit
+                requests []request
+        }{
+                {"rate limit", RateLimit{PerMinute: 1, Burst: 4}, []request{
+                        {3, http.StatusAccepted},
+                        {2, http.StatusTooManyRequests},
+                        {1, http.StatusAccepted},
+                }},
+                {"daily quota", RateLimit{Daily: 5}, []request{
+                        {3, http.StatusAccepted},
+                        {3, http.StatusTooManyRequests},
+                        {2, http.StatusAccepted},
+                        {1, http.StatusTooManyRequests},
+                }},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        s := newTestServer(t)
+                        s.limiter = newLimiter(LimitsConfig{Image: tt.limit}, newMemoryStore())
+
+                        for i, r := range tt.requests {
+                                req := &chatRequest{Prompt: "draw a fox", ImageParams: ImageParams{NumImages: r.numImages}}
+                                if code, resp := serveChat(t, s, req); code != r.want {
+                                        t.Fatalf("request %d for %d images: status = %d (%s), want %d", i+1, r.numImages, code, resp.Error, r.want)
+                                }
+                        }
+                })
+        }
+}
+
+func TestServeChatStreamImageJob(t *testing.T) {
+        s := newTestServer(t)
+        events := serveChatStream(t, s, &chatRequest{Prompt: "draw a lighthouse", ImageParams: ImageParams{NumImages: 2}})
+
+        for _, e := range events[:len(events)-1] {
+                if e.name != "progress" || e.data.JobID == "" {
+                        t.Fatalf("got %s event %+v before done, want job progress", e.name, e.data)
+                }
+        }
+        done := events[len(events)-1].data
+        if done.Status != jobSucceeded || done.Error != "" {
+                t.Fatalf("done event = %+v, want a succeeded job", done)
+        }
+        if done.ImageBase64 == "" || len(done.Images) != 2 || done.ImageParams == nil || done.ImageParams.NumImages != 2 {
+                t.Errorf("done event has %d images and params %+v, want 2 images and the echoed parameters", len(done.Images), done.ImageParams)
+        }
+        for i, image := range done.Images {
+                if image.Params.Seed == nil {
+                        t.Errorf("image %d has no seed to regenerate it with", i)
+                }
+        }
+}
+
+func TestServeChatStreamImageJobOutlivesRequestTimeout(t *testing.T) {
+        s := newTestServer(t)
+        q, release := newBlockingJobQueue()
+        t.Cleanup(func() { q.Close(0) })
+        s.jobs = q
+        s.cfg.Server.RequestTimeout = Duration(10 * time.Millisecond)
+
+        events := serveChatStream(t, s, &chatRequest{Prompt: "draw a lighthouse"})
+        done := events[len(events)-1]
+        if done.name != "done" || done.data.JobID == "" || done.data.Status == jobCancelled || done.data.Error != "" {
+                t.Fatalf("last event %s %+v, want done with an unfinished job", done.name, done.data)
+        }
+
+        close(release)
+        if state := waitJob(t, s, done.data.JobID); state.Status != jobSucceeded {
+                t.Errorf("job status = %s, want %s", state.Status, jobSucceeded)
+        }
+}
+
+// failingImageGenerator is the fake generator with every generation failing
+type failingImageGenerator struct {
+        fakeImageGenerator
+}
+
+func (failingImageGenerator) Generate(ctx context.Context, prompt string, params ImageParams) (*GeneratedImage, error) {
+        return nil, errors.New("model unavailable")
+}
+
+func TestServeChatSavesFailedImageJob(t *testing.T) {
+        blocking, release := newBlockingJobQueue()
+        defer close(release)
+        queues := map[string]struct {
+                jobs   *jobQueue
+                cancel bool
+                want   string
+        }{
+                "failed":    {newJobQueue(failingImageGenerator{}, defaultConfig().Jobs), false, "Failed to generate image: model unavailable"},
+                "cancelled": {blocking, true, "Image generation was cancelled"},
+        }
+        for name, tt := range queues {
+                t.Run(name, func(t *testing.T) {
+                        s := newTestServer(t)
+                        s.jobs = tt.jobs
+                        t.Cleanup(func() { tt.jobs.Close(0) })
+                        conv, err := s.store.CreateConversation(context.Background(), "", "")
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+
+                        code, resp := serveChat(t, s, &chatRequest{ConversationID: conv.ID, Prompt: "draw a lighthouse"})
+                        if code != http.StatusAccepted {
+                                t.Fatalf("status = %d (%s), want 202", code, resp.Error)
+                        }
+                        if tt.cancel {
+                                j, err := s.jobs.get("", resp.JobID)
+                                if err != nil {
+                                        t.Fatal(err)
+                                }
+                                s.jobs.cancel(j)
+                        }
+                        waitJob(t, s, resp.JobID)
+
+                        // The turn is saved by the worker after the job reports its state
+                        var saved *Conversation
+                        for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+                                saved, err = s.store.GetConversation(context.Background(), "", conv.ID)
+                                if err != nil {
+                                        t.Fatal(err)
+                                }
+                                if len(saved.Messages) > 0 {
+                                        break
+                                }
+                        }
+                        if len(saved.Messages) != 2 || saved.Messages[0].Parts[0].Text != "draw a lighthouse" || saved.Messages[1].Parts[0].Text != tt.want {
+                                t.Errorf("saved messages = %+v, want the turn and %q", saved.Messages, tt.want)
+                        }
+                })
+        }
+}
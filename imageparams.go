@@ -0,0 +1,237 @@
+package main
+
+import (
+        "fmt"
+        "math/rand"
+        "net/http"
+        "strconv"
+        "strings"
+)
+
+// ImageParams are the generation settings of an image request. Zero values
+// leave the setting to the backend, and the settings a backend applied are
+// echoed with each image so that it can be generated again.
+type ImageParams struct {
+        NegativePrompt string  `json:"negativePrompt,omitempty"`
+        Width          int     `json:"width,omitempty"`
+        Height         int     `json:"height,omitempty"`
+        Steps          int     `json:"steps,omitempty"`
+        Guidance       float64 `json:"guidance,omitempty"`
+        // Seed is a pointer since 0 is a valid seed. Without one, backends pick
+        // a random seed for models that accept it.
+        Seed *int64 `json:"seed,omitempty"`
+        // NumImages is how many images a request generates, one when unset
+        NumImages int `json:"numImages,omitempty"`
+        // Model is tried before the other models when set
+        Model string `json:"model,omitempty"`
+}
+
+// Limits on image parameters that apply to every model
+const (
+        // imageSizeStep is the multiple width and height must be of, as diffusion
+        // models work on 8x8 latent blocks
+        imageSizeStep           = 8
+        maxSeed                 = 1<<32 - 1
+        maxGuidance             = 30
+        maxNegativePromptLength = 2000
+)
+
+// ImageModel describes a model of an image backend and the parameters it
+// accepts, as listed by /api/capabilities. A zero limit means the parameter
+// cannot be set.
+type ImageModel struct {
+        Name           string `json:"name"`
+        Backend        string `json:"backend"`
+        NegativePrompt bool   `json:"negativePrompt"`
+        MaxWidth       int    `json:"maxWidth,omitempty"`
+        MaxHeight      int    `json:"maxHeight,omitempty"`
+        MaxSteps       int    `json:"maxSteps,omitempty"`
+        Guidance       bool   `json:"guidance"`
+        Seed           bool   `json:"seed"`
+}
+
+// accepts returns an error naming the first parameter of p the model cannot
+// honor. The model and number of images are not checked.
+func (m ImageModel) accepts(p ImageParams) error {
+        switch {
+        case p.NegativePrompt != "" && !m.NegativePrompt:
+                return fmt.Errorf("model %s does not accept a negative prompt", m.Name)
+        case (p.Width > 0 || p.Height > 0) && (m.MaxWidth == 0 || m.MaxHeight == 0):
+                return fmt.Errorf("model %s does not accept an image size", m.Name)
+        case p.Width > m.MaxWidth:
+                return fmt.Errorf("model %s accepts a width of at most %d", m.Name, m.MaxWidth)
+        case p.Height > m.MaxHeight:
+                return fmt.Errorf("model %s accepts a height of at most %d", m.Name, m.MaxHeight)
+        case p.Steps > 0 && m.MaxSteps == 0:
+                return fmt.Errorf("model %s does not accept steps", m.Name)
+        case p.Steps > m.MaxSteps:
+                return fmt.Errorf("model %s accepts at most %d steps", m.Name, m.MaxSteps)
+        case p.Guidance > 0 && !m.Guidance:
+                return fmt.Errorf("model %s does not accept a guidance scale", m.Name)
+        case p.Seed != nil && !m.Seed:
+                return fmt.Errorf("model %s does not accept a seed", m.Name)
+        }
+        return nil
+}
+
+// acceptingModels returns the models that accept p, or the error of the first
+// one when none does
+func acceptingModels(models []ImageModel, p ImageParams) ([]ImageModel, error) {
+        var accepting []ImageModel
+        var firstError error
+        for _, m := range models {
+                if err := m.accepts(p); err != nil {
+                        if firstError == nil {
+                                firstError = err
+                        }
+                        continue
+                }
+                accepting = append(accepting, m)
+        }
+        if len(accepting) == 0 {
+                if firstError == nil {
+                        return nil, fmt.Errorf("no image model is available")
+                }
+                return nil, fmt.Errorf("no image model accepts these parameters: %v", firstError)
+        }
+        return accepting, nil
+}
+
+// hasModel reports whether models contains the model named name
+func hasModel(models []ImageModel, name string) bool {
+        for _, m := range models {
+                if m.Name == name {
+                        return true
+                }
+        }
+        return false
+}
+
+// validateImageParams validates p against the limits of every model and against
+// models, the models that may generate it. At most maxImages images may be
+// requested. It returns p with the number of images set.
+func validateImageParams(p ImageParams, models []ImageModel, maxImages int) (ImageParams, error) {
+        if p.NumImages == 0 {
+                p.NumImages = 1
+        }
+        switch {
+        case p.NumImages < 0 || p.NumImages > maxImages:
+                return p, fmt.Errorf("numImages must be between 1 and %d", maxImages)
+        case len(p.NegativePrompt) > maxNegativePromptLength:
+                return p, fmt.Errorf("negativePrompt must be at most %d characters", maxNegativePromptLength)
+        case p.Width < 0 || p.Width%imageSizeStep != 0:
+                return p, fmt.Errorf("width must be a positive multiple of %d", imageSizeStep)
+        case p.Height < 0 || p.Height%imageSizeStep != 0:
+                return p, fmt.Errorf("height must be a positive multiple of %d", imageSizeStep)
+        case p.Steps < 0:
+                return p, fmt.Errorf("steps must be positive")
+        case p.Guidance < 0 || p.Guidance > maxGuidance:
+                return p, fmt.Errorf("guidance must be between 0 and %d", maxGuidance)
+        case p.Seed != nil && (*p.Seed < 0 || *p.Seed > maxSeed):
+                return p, fmt.Errorf("seed must be between 0 and %d", maxSeed)
+        }
+
+        if p.Model != "" {
+                names := make([]string, len(models))
+                for i, m := range models {
+                        if m.Name == p.Model {
+                                return p, m.accepts(p)
+                        }
+                        names[i] = m.Name
+                }
+                return p, fmt.Errorf("unknown model %q (available: %s)", p.Model, strings.Join(names, ", "))
+        }
+        _, err := acceptingModels(models, p)
+        return p, err
+}
+
+// seedFor returns the seed to generate with: the requested one, or a random
+// seed when none was requested
+func seedFor(p ImageParams) int64 {
+        if p.Seed != nil {
+                return *p.Seed
+        }
+        return rand.Int63n(maxSeed + 1)
+}
+
+// withSeed returns p with seed set
+func (p ImageParams) withSeed(seed int64) ImageParams {
+        p.Seed = &seed
+        return p
+}
+
+// parseImageParamsForm reads the image parameters of a /api/chat form. Each
+// parameter is a form field named like its JSON field.
+func parseImageParamsForm(r *http.Request) (ImageParams, error) {
+        p := ImageParams{
+                NegativePrompt: r.FormValue("negativePrompt"),
+                Model:          r.FormValue("model"),
+        }
+        ints := []struct {
+                name  string
+                value *int
+        }{
+                {"width", &p.Width},
+                {"height", &p.Height},
+                {"steps", &p.Steps},
+                {"numImages", &p.NumImages},
+        }
+        for _, field := range ints {
+                value := r.FormValue(field.name)
+                if value == "" {
+                        continue
+                }
+                n, err := strconv.Atoi(value)
+                if err != nil {
+                        return p, fmt.Errorf("%s must be an integer, got %q", field.name, value)
+                }
+                *field.value = n
+        }
+        if value := r.FormValue("guidance"); value != "" {
+                guidance, err := strconv.ParseFloat(value, 64)
+                if err != nil {
+                        return p, fmt.Errorf("guidance must be a number, got %q", value)
+                }
+                p.Guidance = guidance
+        }
+        if value := r.FormValue("seed"); value != "" {
+                seed, err := strconv.ParseInt(value, 10, 64)
+                if err != nil {
+                        return p, fmt.Errorf("seed must be an integer, got %q", value)
+                }
+                p.Seed = &seed
+        }
+        return p, nil
+}
+
+// checkImageParams validates the image parameters of req against the models
+// of the image backends and fills in their defaults
+func (s *server) checkImageParams(req *chatRequest) error {
+        params, err := validateImageParams(req.ImageParams, s.images.Models(), s.cfg.Images.MaxImagesPerRequest)
+        if err != nil {
+                return err
+        }
+        req.ImageParams = params
+        return nil
+}
+
+// ImageResult is one generated image with the parameters it was generated
+// with, including the model and seed
+type ImageResult struct {
+        ImageBase64   string      `json:"imageBase64"`
+        ImageMimeType string      `json:"imageMimeType"`
+        Params        ImageParams `json:"params"`
+}
+
+// imageResults converts generated images for JSON responses
+func imageResults(images []*GeneratedImage) []ImageResult {
+        results := make([]ImageResult, len(images))
+        for i, image := range images {
+                results[i] = ImageResult{
+                        ImageBase64:   image.Base64(),
+                        ImageMimeType: image.MimeType,
+                        Params:        image.Params,
+                }
+        }
+        return results
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "fmt"
+        "log/slog"
+        "strings"
+        "time"
+
+        "github.com/google/generative-ai-go/genai"
+        "go.opentelemetry.io/otel/attribute"
+)
+
+// Intent is what the user wants done with their message
+type Intent string
+
+const (
+        IntentChat          Intent = "chat"
+        IntentGenerateImage Intent = "generate_image"
+        IntentEditImage     Intent = "edit_image"
+        IntentAnalyzeImage  Intent = "analyze_image"
+)
+
+// minImageIntentConfidence is the classifier confidence required before a
+// message is routed to image generation instead of chat
+const minImageIntentConfidence = 0.5
+
+// IntentResult is the outcome of intent classification
+type IntentResult struct {
+        Intent     Intent  `json:"intent"`
+        Confidence float64 `json:"confidence"`
+        // Source is "classifier" or "keywords" when the classifier failed
+        Source string `json:"source"`
+}
+
+// wantsImage reports whether the request should go to an image generator
+func (r *IntentResult) wantsImage() bool {
+        return r.Intent == IntentGenerateImage || r.Intent == IntentEditImage
+}
+
+// IntentClassifier decides how a chat request should be routed
+type IntentClassifier interface {
+        Classify(ctx context.Context, req *chatRequest) (*IntentResult, error)
+}
+
+const intentInstructions = `You route messages for a chat assistant that can chat, analyze images and generate images.
+Classify the user's latest message into exactly one intent:
+- "chat": questions, conversation or anything that needs a text answer, including questions about words like "photo" or "picture"
+- "generate_image": the user asks for a new image, drawing, illustration or picture to be created
+- "edit_image": the user asks to change, restyle or extend an image they provided or that was generated earlier
+- "analyze_image": the user asks to describe, explain or answer questions about an image
+Messages may be in Indonesian or English. Return a confidence between 0 and 1.`
+
+// geminiIntentClassifier classifies intent with a Gemini JSON-schema response
+type geminiIntentClassifier struct {
+        clients *geminiClientPool
+        model   string
+        timeout time.Duration
+}
+
+func newGeminiIntentClassifier(clients *geminiClientPool, model string, timeout time.Duration) *geminiIntentClassifier {
+        return &geminiIntentClassifier{clients: clients, model: model, timeout: timeout}
+}
+
+func (g *geminiIntentClassifier) Classify(ctx context.Context, req *chatRequest) (*IntentResult, error) {
+        // Classification sits in front of every request, so keep it short
+        ctx, cancel := context.WithTimeout(ctx, g.timeout)
+        defer cancel()
+
+        client, release, err := g.clients.acquire()
+        if err != nil {
+                return nil, err
+        }
+        defer release()
+
+        model := client.model("classifier/"+g.model, g.model, func(model *genai.GenerativeModel) {
+                model.SetTemperature(0)
+                model.SystemInstruction = &genai.Content{Parts: []genai.Part{genai.Text(intentInstructions)}}
+                model.ResponseMIMEType = "application/json"
+                model.ResponseSchema = &genai.Schema{
+                        Type: genai.TypeObject,
+                        Properties: map[string]*genai.Schema{
+                                "intent": {
+                                        Type: genai.TypeString,
+                                        Enum: []string{string(IntentChat), string(IntentGenerateImage), string(IntentEditImage), string(IntentAnalyzeImage)},
+                                },
+                                "confidence": {Type: genai.TypeNumber},
+                        },
+                        Required: []string{"intent", "confidence"},
+                }
+        })
+
+        spanCtx, span := startGeminiSpan(ctx, "gemini.classify", g.model)
+        resp, err := model.GenerateContent(spanCtx, genai.Text(describeForClassification(req)))
+        if err != nil {
+                endGeminiSpan(span, nil, err)
+                return nil, fmt.Errorf("failed to classify intent: %v", err)
+        }
+        endGeminiSpan(span, resp.UsageMetadata, nil)
+        observeTokenUsage(g.model, "classifier", resp.UsageMetadata)
+
+        var result IntentResult
+        if err := json.Unmarshal([]byte(responseText(resp)), &result); err != nil {
+                return nil, fmt.Errorf("failed to parse classifier response: %v", err)
+        }
+
+        switch result.Intent {
+        case IntentChat, IntentGenerateImage, IntentEditImage, IntentAnalyzeImage:
+        default:
+                return nil, fmt.Errorf("classifier returned unknown intent %q", result.Intent)
+        }
+        if result.Confidence < 0 || result.Confidence > 1 {
+                return nil, fmt.Errorf("classifier returned invalid confidence %v", result.Confidence)
+        }
+
+        result.Source = "classifier"
+        return &result, nil
+}
+
+// describeForClassification renders the latest turn, with a little preceding
+// context, as plain text for the classifier
+func describeForClassification(req *chatRequest) string {
+        history, turn := req.splitTurns()
+
+        var sb strings.Builder
+
+        // The last few turns are enough to resolve references like "make it bigger"
+        if len(history) > 4 {
+                history = history[len(history)-4:]
+        }
+        for _, msg := range history {
+                for _, part := range msg.Parts {
+                        if part.Text != "" {
+                                fmt.Fprintf(&sb, "[%s] %s\n", msg.Role, part.Text)
+                        } else if part.Data != "" {
+                                fmt.Fprintf(&sb, "[%s] <image>\n", msg.Role)
+                        }
+                }
+        }
+
+        sb.WriteString("Latest message:\n")
+        for _, part := range turn {
+                if part.Text != "" && !(req.Prompt == "" && part.Text == defaultImagePrompt) {
+                        sb.WriteString(part.Text)
+                        sb.WriteString("\n")
+                }
+        }
+        fmt.Fprintf(&sb, "Image attached: %t\n", req.hasImage())
+        return sb.String()
+}
+
+// classifyIntent asks the classifier how to route req and falls back to
+// keyword matching only when the classifier is unavailable or fails
+func classifyIntent(ctx context.Context, classifier IntentClassifier, req *chatRequest) (result *IntentResult) {
+        ctx, span := tracer.Start(ctx, "intent.classify")
+        defer func() {
+                span.SetAttributes(
+                        attribute.String("chat.intent", string(result.Intent)),
+                        attribute.Float64("chat.intent.confidence", result.Confidence),
+                        attribute.String("chat.intent.source", result.Source),
+                )
+                span.End()
+        }()
+
+        // Without any text there is nothing to classify
+        if req.Prompt == "" && req.hasImage() {
+                return &IntentResult{Intent: IntentAnalyzeImage, Confidence: 1, Source: "classifier"}
+        }
+
+        if classifier != nil {
+                result, err := classifier.Classify(ctx, req)
+                if err == nil {
+                        slog.InfoContext(ctx, "Classified intent", "intent", result.Intent, "confidence", result.Confidence)
+                        if result.wantsImage() && result.Confidence < minImageIntentConfidence {
+                                // Not sure enough to spend an image generation on it
+                                result.Intent = IntentChat
+                                if req.hasImage() {
+                                        result.Intent = IntentAnalyzeImage
+                                }
+                        }
+                        return result
+                }
+                slog.WarnContext(ctx, "Intent classifier failed, falling back to keywords", "err", err)
+        }
+
+        return keywordIntent(req)
+}
+
+// keywordIntent is the fallback classification based on keyword matching
+func keywordIntent(req *chatRequest) *IntentResult {
+        if detectImageGenerationRequest(req.Prompt, req.Messages) {
+                return &IntentResult{Intent: IntentGenerateImage, Confidence: 0.5, Source: "keywords"}
+        }
+        if req.hasImage() {
+                return &IntentResult{Intent: IntentAnalyzeImage, Confidence: 0.5, Source: "keywords"}
+        }
+        return &IntentResult{Intent: IntentChat, Confidence: 0.5, Source: "keywords"}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "log/slog"
+        "net/http"
+        "strings"
+        "sync"
+        "time"
+)
+
+// Job states reported by /api/jobs/{id}
+const (
+        jobQueued    = "queued"
+        jobRunning   = "running"
+        jobSucceeded = "succeeded"
+        jobFailed    = "failed"
+        jobCancelled = "cancelled"
+)
+
+// imageJobResponse is the reply text sent when an image job was queued
+const imageJobResponse = "Gambar Anda sedang dibuat, mohon tunggu sebentar."
+
+// errJobNotFound is returned for unknown, expired or other users' job IDs
+var errJobNotFound = errors.New("job not found")
+
+// Job is the state of a background image generation as served by
+// /api/jobs/{id}
+type Job struct {
+        ID     string `json:"id"`
+        Status string `json:"status"`
+        // Progress is set once a backend has started generating
+        Progress       *JobProgress `json:"progress,omitempty"`
+        ConversationID string       `json:"conversationId,omitempty"`
+        CreatedAt      time.Time    `json:"createdAt"`
+        UpdatedAt      time.Time    `json:"updatedAt"`
+
+        // Params are the requested image parameters
+        Params *ImageParams `json:"params,omitempty"`
+
+        // Set once the job succeeded. ImageBase64, ImageMimeType and Model
+        // are those of the first image.
+        Response      string        `json:"response,omitempty"`
+        ImageBase64   string        `json:"imageBase64,omitempty"`
+        ImageMimeType string        `json:"imageMimeType,omitempty"`
+        Model         string        `json:"model,omitempty"`
+        Images        []ImageResult `json:"images,omitempty"`
+
+        // Error is set once the job failed or was cancelled
+        Error string `json:"error,omitempty"`
+}
+
+// JobProgress tells which image a job is generating and which backend and
+// model it is trying
+type JobProgress struct {
+        Backend string `json:"backend"`
+        Model   string `json:"model"`
+        // Attempt counts the models tried so far for this image, including
+        // this one
+        Attempt int `json:"attempt"`
+        // Image counts the images generated so far, including this one, out
+        // of NumImages
+        Image     int `json:"image"`
+        NumImages int `json:"numImages"`
+}
+
+// finished reports whether the job reached a final state
+func (j *Job) finished() bool {
+        return j.Status == jobSucceeded || j.Status == jobFailed || j.Status == jobCancelled
+}
+
+// job is a queued or finished generation with its private state
+type job struct {
+        Job
+        owner  string
+        prompt string
+        params ImageParams
+        ctx    context.Context
+        cancel context.CancelFunc
+        // onDone runs in the worker once the job finished, with the images
+        // when it succeeded and with the error it reports otherwise
+        onDone func(ctx context.Context, images []*GeneratedImage, failure string)
+        // changed is closed and replaced whenever Job changes
+        changed chan struct{}
+        // result is set once the job succeeded
+        result []*GeneratedImage
+}
+
+// jobQueue runs image generations on a bounded pool of workers. Jobs outlive
+// the request that submitted them and are kept for a while after finishing
+// so clients can poll for the result.
+type jobQueue struct {
+        images  ImageGenerator
+        timeout time.Duration
+        ttl     time.Duration
+        queue   chan *job
+        wg      sync.WaitGroup
+
+        mu     sync.Mutex
+        jobs   map[string]*job
+        closed bool
+}
+
+// newJobQueue starts cfg.Workers workers generating images with images
+func newJobQueue(images ImageGenerator, cfg JobsConfig) *jobQueue {
+        q := &jobQueue{
+                images:  images,
+                timeout: time.Duration(cfg.Timeout),
+                ttl:     time.Duration(cfg.ResultTTL),
+                queue:   make(chan *job, cfg.QueueSize),
+                jobs:    make(map[string]*job),
+        }
+        for i := 0; i < cfg.Workers; i++ {
+                q.wg.Add(1)
+                go q.work()
+        }
+        return q
+}
+
+// submit queues the generation of params.NumImages images for prompt on
+// behalf of the user of ctx. The job keeps the request and trace IDs of ctx
+// for logging but not its deadline or cancellation. onDone, if set, runs
+// once the images are ready.
+func (q *jobQueue) submit(ctx context.Context, prompt string, params ImageParams, conversationID string, onDone func(context.Context, []*GeneratedImage, string)) (*job, error) {
+        id, err := newID()
+        if err != nil {
+                return nil, fmt.Errorf("failed to generate job ID: %v", err)
+        }
+
+        if params.NumImages == 0 {
+                params.NumImages = 1
+        }
+        now := time.Now().UTC()
+        j := &job{
+                Job:     Job{ID: id, Status: jobQueued, ConversationID: conversationID, Params: &params, CreatedAt: now, UpdatedAt: now},
+                owner:   userID(ctx),
+                prompt:  prompt,
+                params:  params,
+                onDone:  onDone,
+                changed: make(chan struct{}),
+        }
+        j.ctx, j.cancel = context.WithCancel(context.WithoutCancel(ctx))
+
+        q.mu.Lock()
+        defer q.mu.Unlock()
+        q.expire(now)
+
+        if q.closed {
+                j.cancel()
+                return nil, errors.New("server is shutting down")
+        }
+        select {
+        case q.queue <- j:
+        default:
+                j.cancel()
+                rateLimitedTotal.WithLabelValues(capabilityImage, "busy").Inc()
+                return nil, &rateLimitError{
+                        msg:        "Too many images are being generated right now, try again later",
+                        retryAfter: busyRetryAfter,
+                }
+        }
+        q.jobs[id] = j
+        slog.InfoContext(ctx, "Image generation queued", "job_id", id)
+        return j, nil
+}
+
+func (q *jobQueue) work() {
+        defer q.wg.Done()
+        for j := range q.queue {
+                q.run(j)
+        }
+}
+
+// run generates the images of j unless it was cancelled while queued. With a
+// seed, image i is generated with seed+i so that every image differs and can
+// be generated again on its own.
+func (q *jobQueue) run(j *job) {
+        if j.ctx.Err() != nil {
+                q.failed(j)
+                return
+        }
+        q.update(j, func(s *Job) { s.Status = jobRunning })
+
+        ctx, cancel := context.WithTimeout(j.ctx, q.timeout)
+        defer cancel()
+        current := 0
+        ctx = context.WithValue(ctx, progressKey{}, func(backend, model string) {
+                q.update(j, func(s *Job) {
+                        attempt := 1
+                        if s.Progress != nil && s.Progress.Image == current {
+                                attempt = s.Progress.Attempt + 1
+                        }
+                        s.Progress = &JobProgress{Backend: backend, Model: model, Attempt: attempt, Image: current, NumImages: j.params.NumImages}
+                })
+        })
+
+        images := make([]*GeneratedImage, 0, j.params.NumImages)
+        for i := 0; i < j.params.NumImages; i++ {
+                current = i + 1
+                params := j.params
+                if params.Seed != nil {
+                        params = params.withSeed((*params.Seed + int64(i)) % (maxSeed + 1))
+                }
+                image, err := q.images.Generate(ctx, j.prompt, params)
+                if err != nil {
+                        // A cancelled job already reports its state
+                        if j.ctx.Err() == nil {
+                                slog.WarnContext(ctx, "Image generation failed", "job_id", j.ID, "image", current, "err", err)
+                                q.update(j, func(s *Job) {
+                                        s.Status = jobFailed
+                                        s.Error = "Failed to generate image: " + err.Error()
+                                })
+                        }
+                        q.failed(j)
+                        return
+                }
+                images = append(images, image)
+        }
+
+        if j.onDone != nil {
+                j.onDone(j.ctx, images, "")
+        }
+        q.update(j, func(s *Job) {
+                j.result = images
+                s.Status = jobSucceeded
+                s.Response = generatedImageResponse
+                s.ImageBase64 = images[0].Base64()
+                s.ImageMimeType = images[0].MimeType
+                s.Model = images[0].Model
+                s.Images = imageResults(images)
+        })
+        slog.InfoContext(ctx, "Image generation finished", "job_id", j.ID, "model", images[0].Model, "images", len(images))
+}
+
+// failed runs the onDone callback of j, which failed or was cancelled, with
+// the error it reports. The callback may still save it although j.ctx ended.
+func (q *jobQueue) failed(j *job) {
+        if j.onDone == nil {
+                return
+        }
+        state, _ := q.watch(j)
+        j.onDone(context.WithoutCancel(j.ctx), nil, state.Error)
+}
+
+// update changes the state of j unless it already finished and wakes up
+// everyone watching it
+func (q *jobQueue) update(j *job, change func(*Job)) {
+        q.mu.Lock()
+        defer q.mu.Unlock()
+
+        if j.finished() {
+                return
+        }
+        change(&j.Job)
+        j.UpdatedAt = time.Now().UTC()
+        close(j.changed)
+        j.changed = make(chan struct{})
+}
+
+// watch returns a copy of the state of j and a channel closed when it changes
+func (q *jobQueue) watch(j *job) (Job, <-chan struct{}) {
+        q.mu.Lock()
+        defer q.mu.Unlock()
+        return j.Job, j.changed
+}
+
+// get returns the state of the job with id if it belongs to owner
+func (q *jobQueue) get(owner, id string) (*job, error) {
+        q.mu.Lock()
+        defer q.mu.Unlock()
+
+        q.expire(time.Now())
+        j, ok := q.jobs[id]
+        if !ok || j.owner != owner {
+                return nil, errJobNotFound
+        }
+        return j, nil
+}
+
+// cancel stops j, whether it is queued or running
+func (q *jobQueue) cancel(j *job) {
+        q.update(j, func(s *Job) {
+                s.Status = jobCancelled
+                s.Error = "Image generation was cancelled"
+        })
+        j.cancel()
+}
+
+// wait blocks until j finishes and returns its final state. The job is
+// cancelled when ctx ends first, so it stops when its client goes away.
+func (q *jobQueue) wait(ctx context.Context, j *job) (*Job, error) {
+        for {
+                state, changed := q.watch(j)
+                if state.finished() {
+                        return &state, nil
+                }
+                select {
+                case <-changed:
+                case <-ctx.Done():
+                        q.cancel(j)
+                        return nil, ctx.Err()
+                }
+        }
+}
+
+// expire forgets jobs that finished more than the result TTL ago
+func (q *jobQueue) expire(now time.Time) {
+        for id, j := range q.jobs {
+                if j.finished() && now.Sub(j.UpdatedAt) > q.ttl {
+                        delete(q.jobs, id)
+                }
+        }
+}
+
+// Close stops accepting jobs and cancels the queued ones. Running jobs may
+// finish for up to grace before they are cancelled too. It returns once the
+// workers stopped.
+func (q *jobQueue) Close(grace time.Duration) {
+        q.mu.Lock()
+        q.closed = true
+        close(q.queue)
+        var queued, running []*job
+        for _, j := range q.jobs {
+                switch j.Status {
+                case jobQueued:
+                        queued = append(queued, j)
+                case jobRunning:
+                        running = append(running, j)
+                }
+        }
+        q.mu.Unlock()
+
+        for _, j := range queued {
+                q.cancel(j)
+        }
+
+        stopped := make(chan struct{})
+        go func() {
+                q.wg.Wait()
+                close(stopped)
+        }()
+        select {
+        case <-stopped:
+                return
+        case <-time.After(grace):
+        }
+
+        slog.Warn("Shutdown grace period expired, cancelling running image jobs", "jobs", len(running))
+        for _, j := range running {
+                q.cancel(j)
+        }
+        <-stopped
+}
+
+// Name, Models and Generate let tool calls generate images through the queue,
+// so they count against the same worker pool
+func (q *jobQueue) Name() string {
+        return q.images.Name()
+}
+
+func (q *jobQueue) Models() []ImageModel {
+        return q.images.Models()
+}
+
+// Generate generates a single image whatever params.NumImages asks for
+func (q *jobQueue) Generate(ctx context.Context, prompt string, params ImageParams) (*GeneratedImage, error) {
+        params.NumImages = 1
+        j, err := q.submit(ctx, prompt, params, "", nil)
+        if err != nil {
+                return nil, err
+        }
+        state, err := q.wait(ctx, j)
+        if err != nil {
+                return nil, err
+        }
+        if state.Status != jobSucceeded {
+                return nil, errors.New(state.Error)
+        }
+
+        // Nobody polls for the jobs of tool calls
+        q.mu.Lock()
+        delete(q.jobs, j.ID)
+        q.mu.Unlock()
+        return j.result[0], nil
+}
+
+// submitImageJob queues the image generation of req. The turn is saved to
+// conv, if set, once the job finished: with the images, or with the error as
+// the reply when it failed or was cancelled.
+func (s *server) submitImageJob(ctx context.Context, req *chatRequest, conv *Conversation, userMessage Message) (*job, error) {
+        var onDone func(context.Context, []*GeneratedImage, string)
+        if conv != nil {
+                onDone = func(ctx context.Context, images []*GeneratedImage, failure string) {
+                        if failure != "" {
+                                saveTurn(ctx, s.store, conv, userMessage, failure)
+                                return
+                        }
+                        saveTurn(ctx, s.store, conv, userMessage, generatedImageResponse, images...)
+                }
+        }
+        return s.jobs.submit(ctx, req.Prompt, req.ImageParams, req.ConversationID, onDone)
+}
+
+type progressKey struct{}
+
+// reportProgress tells the job running in ctx, if any, which backend and model
+// it is trying
+func reportProgress(ctx context.Context, backend, model string) {
+        if report, ok := ctx.Value(progressKey{}).(func(backend, model string)); ok {
+                report(backend, model)
+        }
+}
+
+// handleJobs serves the jobs of image generations started by the chat APIs:
+//
+//	GET    /api/jobs/{id}  the state of a job, with the image once it succeeded
+//	DELETE /api/jobs/{id}  cancel a queued or running job
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/")
+        if id == "" || s.jobs == nil {
+                sendErrorResponse(w, "Job not found", http.StatusNotFound)
+                return
+        }
+        j, err := s.jobs.get(userID(r.Context()), id)
+        if err != nil {
+                sendErrorResponse(w, "Job not found", http.StatusNotFound)
+                return
+        }
+
+        switch r.Method {
+        case "GET":
+                state, _ := s.jobs.watch(j)
+                json.NewEncoder(w).Encode(state)
+
+        case "DELETE":
+                s.jobs.cancel(j)
+                slog.InfoContext(r.Context(), "Image generation cancelled", "job_id", id)
+                state, _ := s.jobs.watch(j)
+                json.NewEncoder(w).Encode(state)
+
+        default:
+                slog.WarnContext(r.Context(), "Invalid method", "method", r.Method)
+                sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+        "context"
+        "testing"
+        "time"
+)
+
+// blockingImageGenerator is the fake generator, with every generation
+// waiting until release is closed
+type blockingImageGenerator struct {
+        fakeImageGenerator
+        release chan struct{}
+}
+
+func (b blockingImageGenerator) Generate(ctx context.Context, prompt string, params ImageParams) (*GeneratedImage, error) {
+        select {
+        case <-b.release:
+                return b.fakeImageGenerator.Generate(ctx, prompt, params)
+        case <-ctx.Done():
+                return nil, ctx.Err()
+        }
+}
+
+// startJobs submits a job that starts running on the only worker and one
+// that waits in the queue behind it
+func startJobs(t *testing.T, q *jobQueue) (running, queued *job) {
+        t.Helper()
+
+        running, err := q.submit(context.Background(), "first", ImageParams{}, "", nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+        for {
+                state, changed := q.watch(running)
+                if state.Status == jobRunning {
+                        break
+                }
+                <-changed
+        }
+        queued, err = q.submit(context.Background(), "second", ImageParams{}, "", nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+        return running, queued
+}
+
+func newBlockingJobQueue() (*jobQueue, chan struct{}) {
+        release := make(chan struct{})
+        q := newJobQueue(blockingImageGenerator{release: release}, JobsConfig{
+                Workers:   1,
+                QueueSize: 1,
+                Timeout:   Duration(time.Minute),
+                ResultTTL: Duration(time.Minute),
+        })
+        return q, release
+}
+
+func TestJobQueueCloseFinishesRunningJobs(t *testing.T) {
+        q, release := newBlockingJobQueue()
+        running, queued := startJobs(t, q)
+
+        time.AfterFunc(10*time.Millisecond, func() { close(release) })
+        q.Close(time.Minute)
+
+        if running.Status != jobSucceeded {
+                t.Errorf("running job status = %s, want %s", running.Status, jobSucceeded)
+        }
+        if queued.Status != jobCancelled {
+                t.Errorf("queued job status = %s, want %s", queued.Status, jobCancelled)
+        }
+        if _, err := q.submit(context.Background(), "third", ImageParams{}, "", nil); err == nil {
+                t.Error("job submitted after Close")
+        }
+}
+
+func TestJobQueueCloseCancelsAfterGracePeriod(t *testing.T) {
+        q, _ := newBlockingJobQueue()
+        running, _ := startJobs(t, q)
+
+        start := time.Now()
+        q.Close(10 * time.Millisecond)
+
+        if running.Status != jobCancelled {
+                t.Errorf("running job status = %s, want %s", running.Status, jobCancelled)
+        }
+        if elapsed := time.Since(start); elapsed > time.Second {
+                t.Errorf("Close took %v", elapsed)
+        }
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+        "context"
+        "crypto/rand"
+        "encoding/hex"
+        "fmt"
+        "log/slog"
+        "net/http"
+        "os"
+        "strings"
+        "unicode/utf8"
+
+        "go.opentelemetry.io/otel/trace"
+)
+
+// requestIDHeader carries the request ID to and from clients
+const requestIDHeader = "X-Request-ID"
+
+// contentKeys are the log attribute keys holding user content or model
+// output. Their values are redacted or truncated according to the logging
+// content policy.
+var contentKeys = map[string]bool{
+        "prompt":   true,
+        "messages": true,
+        "response": true,
+        "body":     true,
+}
+
+// secretKeys are log attribute keys whose values are never logged
+var secretKeys = map[string]bool{
+        "api_key":       true,
+        "authorization": true,
+}
+
+// minSecretLength is the shortest secret scrubbed from log lines. Shorter
+// values, such as placeholders in development, would mangle ordinary words.
+const minSecretLength = 8
+
+// newLogger builds the process logger from cfg. Every configured secret is
+// scrubbed from messages and attribute values.
+func newLogger(cfg LoggingConfig, secrets ...string) *slog.Logger {
+        var level slog.Level
+        level.UnmarshalText([]byte(cfg.Level))
+
+        r := &redactor{content: cfg.Content, maxContentLength: cfg.MaxContentLength}
+        for _, secret := range secrets {
+                if len(secret) >= minSecretLength {
+                        r.secrets = append(r.secrets, secret)
+                }
+        }
+
+        opts := &slog.HandlerOptions{Level: level, ReplaceAttr: r.replaceAttr}
+        var handler slog.Handler
+        if cfg.Format == "json" {
+                handler = slog.NewJSONHandler(os.Stderr, opts)
+        } else {
+                handler = slog.NewTextHandler(os.Stderr, opts)
+        }
+        return slog.New(requestIDHandler{handler})
+}
+
+// fatal logs msg as an error and exits, for startup failures
+func fatal(msg string, args ...any) {
+        slog.Error(msg, args...)
+        os.Exit(1)
+}
+
+// redactor applies the logging content policy and removes secrets
+type redactor struct {
+        content          string
+        maxContentLength int
+        secrets          []string
+}
+
+func (r *redactor) replaceAttr(groups []string, a slog.Attr) slog.Attr {
+        if secretKeys[a.Key] {
+                return slog.String(a.Key, "[REDACTED]")
+        }
+        if contentKeys[a.Key] {
+                return slog.String(a.Key, r.scrub(r.limitContent(a.Value.String())))
+        }
+
+        switch a.Value.Kind() {
+        case slog.KindString:
+                return slog.String(a.Key, r.scrub(a.Value.String()))
+        case slog.KindAny:
+                switch v := a.Value.Any().(type) {
+                case []byte:
+                        // Image data and response bodies are summarized by size
+                        return slog.String(a.Key, fmt.Sprintf("[%d bytes]", len(v)))
+                case error:
+                        return slog.String(a.Key, r.scrub(v.Error()))
+                }
+        }
+        return a
+}
+
+// limitContent applies the content policy to user content or model output
+func (r *redactor) limitContent(s string) string {
+        switch r.content {
+        case "full":
+                return s
+        case "truncate":
+                if utf8.RuneCountInString(s) <= r.maxContentLength {
+                        return s
+                }
+                runes := []rune(s)
+                return fmt.Sprintf("%s... [%d chars]", string(runes[:r.maxContentLength]), len(runes))
+        }
+        return fmt.Sprintf("[%d chars]", utf8.RuneCountInString(s))
+}
+
+// scrub replaces every configured secret in s
+func (r *redactor) scrub(s string) string {
+        for _, secret := range r.secrets {
+                s = strings.ReplaceAll(s, secret, "[REDACTED]")
+        }
+        return s
+}
+
+// requestIDHandler adds the request, user and trace IDs from the context to
+// every record logged with one of the slog *Context functions
+type requestIDHandler struct {
+        slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+        if id := requestID(ctx); id != "" {
+                record.AddAttrs(slog.String("request_id", id))
+        }
+        if id := userID(ctx); id != "" {
+                record.AddAttrs(slog.String("user_id", id))
+        }
+        if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+                record.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+        }
+        return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+        return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+        return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the request ctx belongs to, or ""
+func requestID(ctx context.Context) string {
+        id, _ := ctx.Value(requestIDKey{}).(string)
+        return id
+}
+
+// withRequestID gives every request an ID, taken from a well-formed
+// X-Request-ID header or generated, and echoes it in the response header
+func withRequestID(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                id := r.Header.Get(requestIDHeader)
+                if !validRequestID(id) {
+                        id = newRequestID()
+                }
+                w.Header().Set(requestIDHeader, id)
+                next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+        })
+}
+
+// validRequestID accepts client IDs of up to 64 letters, digits, '-', '_'
+// and '.', so they are safe to log and echo back
+func validRequestID(id string) bool {
+        if id == "" || len(id) > 64 {
+                return false
+        }
+        for _, c := range id {
+                switch {
+                case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+                default:
+                        return false
+                }
+        }
+        return true
+}
+
+// newRequestID returns a random 64-bit hex identifier
+func newRequestID() string {
+        b := make([]byte, 8)
+        rand.Read(b)
+        return hex.EncodeToString(b)
+}
@@ -1,21 +1,18 @@
 package main
 
 import (
-        "bytes"
         "context"
         "encoding/base64"
         "encoding/json"
+        "errors"
         "fmt"
         "io"
-        "log"
+        "log/slog"
         "net/http"
         "os"
         "path/filepath"
         "strings"
         "time"
-
-        "github.com/google/generative-ai-go/genai"
-        "google.golang.org/api/option"
 )
 
 // min returns the minimum of two integers
@@ -26,6 +23,27 @@ func min(a, b int) int {
         return b
 }
 
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(s string) []string {
+        var items []string
+        for _, item := range strings.Split(s, ",") {
+                if item = strings.TrimSpace(item); item != "" {
+                        items = append(items, item)
+                }
+        }
+        return items
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+        for _, item := range list {
+                if item == s {
+                        return true
+                }
+        }
+        return false
+}
+
 // MessagePart represents a part of a message (text or image data)
 type MessagePart struct {
         Text     string `json:"text,omitempty"`
@@ -41,274 +59,512 @@ type Message struct {
 
 // ChatResponse represents the response sent back to the client
 type ChatResponse struct {
-        Response    string `json:"response"`
-        ImageBase64 string `json:"imageBase64,omitempty"`
-        Error       string `json:"error,omitempty"`
+        Response       string `json:"response"`
+        ImageBase64    string `json:"imageBase64,omitempty"`
+        ImageMimeType  string `json:"imageMimeType,omitempty"`
+        ConversationID string `json:"conversationId,omitempty"`
+        Error          string `json:"error,omitempty"`
+        // RequestID matches the X-Request-ID response header and the logs
+        RequestID string `json:"requestId,omitempty"`
+        // JobID names the background job generating a requested image, and
+        // ImageParams echoes its parameters
+        JobID       string       `json:"jobId,omitempty"`
+        ImageParams *ImageParams `json:"imageParams,omitempty"`
 }
 
 func main() {
-        // Get API keys from environment variables
-        // To set this up in Replit Secrets:
+        if err := run(); err != nil {
+                fatal("Server stopped", "err", err)
+        }
+}
+
+// run configures the backends and serves until SIGINT or SIGTERM. It returns
+// an error, after its deferred cleanup, when the server cannot serve.
+func run() error {
+        // Settings come from the optional config file named by CONFIG_FILE,
+        // with environment variables taking precedence. API keys are usually
+        // set as environment variables in Replit Secrets:
         // 1. Go to your Replit project
         // 2. Click on "Secrets" in the left sidebar
         // 3. Add GEMINI_API_KEY from: https://aistudio.google.com/
         // 4. Add HUGGINGFACE_API_KEY from: https://huggingface.co/settings/tokens
-        geminiAPIKey := os.Getenv("GEMINI_API_KEY")
-        huggingFaceAPIKey := os.Getenv("HUGGINGFACE_API_KEY")
-        
-        if geminiAPIKey == "" {
-                log.Fatal("GEMINI_API_KEY environment variable is required. Please set it in Replit Secrets.")
+        cfg, err := loadConfig(os.Getenv("CONFIG_FILE"))
+        if err != nil {
+                fatal("Invalid configuration", "err", err)
         }
-        if huggingFaceAPIKey == "" {
-                log.Fatal("HUGGINGFACE_API_KEY environment variable is required. Please set it in Replit Secrets.")
+        slog.SetDefault(newLogger(cfg.Logging, cfg.secrets()...))
+
+        shutdownTracing, err := setupTracing(context.Background(), cfg.Tracing)
+        if err != nil {
+                fatal("Failed to configure tracing", "err", err)
         }
+        defer func() {
+                // Flush spans still waiting in the batcher
+                ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+                defer cancel()
+                if err := shutdownTracing(ctx); err != nil {
+                        slog.Error("Failed to flush traces", "err", err)
+                }
+        }()
         
         // Log API key status (safely)
-        log.Printf("GEMINI_API_KEY loaded: %t (length: %d)", geminiAPIKey != "", len(geminiAPIKey))
-        log.Printf("HUGGINGFACE_API_KEY loaded: %t (length: %d)", huggingFaceAPIKey != "", len(huggingFaceAPIKey))
+        slog.Info("API keys loaded", "gemini", cfg.Gemini.APIKey != "", "huggingface", cfg.Images.HuggingFace.APIKey != "")
 
-        // Serve static files from public directory
-        fs := http.FileServer(http.Dir("./public/"))
-        http.Handle("/", fs)
+        // Configure the image generation fallback chain, e.g. huggingface,local
+        images, imageBackends, err := newImageGenerator(cfg.Images)
+        if err != nil {
+                fatal("Failed to configure image generation", "err", err)
+        }
 
-        // Handle chat API endpoint
-        http.HandleFunc("/api/chat", func(w http.ResponseWriter, r *http.Request) {
-                handleChat(w, r, geminiAPIKey, huggingFaceAPIKey)
-        })
+        // Probe the image models in the background to order the fallback chain
+        healthCtx, stopHealth := context.WithCancel(context.Background())
+        defer stopHealth()
+        watchModelHealth(healthCtx, images)
 
-        // Get port from environment or default to 5000
-        port := os.Getenv("PORT")
-        if port == "" {
-                port = "5000"
+        // Images are generated in the background by a bounded worker pool,
+        // which image tool calls share
+        var jobs *jobQueue
+        if images != nil {
+                jobs = newJobQueue(images, cfg.Jobs)
         }
 
-        fmt.Printf("Server starting on port %s...\n", port)
-        fmt.Println("Make sure to set GEMINI_API_KEY and HUGGINGFACE_API_KEY in your Replit Secrets!")
-        fmt.Println("Gemini: Text chat and image analysis")
-        fmt.Println("Hugging Face: Image generation with Stable Diffusion")
-        log.Fatal(http.ListenAndServe("0.0.0.0:"+port, nil))
-}
+        // Register the server-side tools Gemini can call
+        tools := newToolRegistry()
+        if images != nil {
+                slog.Info("Image generators configured", "generators", images.Name(), "workers", cfg.Jobs.Workers)
+                if err := tools.Register(newImageTool(jobs)); err != nil {
+                        fatal("Failed to register tool", "err", err)
+                }
+        }
+        slog.Info("Tools registered", "tools", tools.names())
+
+        // Configure chat providers. Gemini is added when its API key is set,
+        // sharing long-lived clients between requests, an OpenAI-compatible
+        // backend when openai.base_url is set, and the fake only when it is
+        // the default.
+        var chatProviders []ChatProvider
+        // Without Gemini, intent falls back to keyword matching
+        var classifier IntentClassifier
+        if cfg.Gemini.APIKey != "" {
+                geminiClients, err := newGeminiClientPool(context.Background(), cfg.Gemini.APIKey, cfg.Gemini.ClientPoolSize)
+                if err != nil {
+                        fatal("Failed to create Gemini clients", "err", err)
+                }
+                defer geminiClients.Close()
 
-func handleChat(w http.ResponseWriter, r *http.Request, geminiAPIKey, huggingFaceAPIKey string) {
-        // Set CORS headers
-        w.Header().Set("Access-Control-Allow-Origin", "*")
-        w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-        w.Header().Set("Content-Type", "application/json")
+                chatProviders = append(chatProviders, newGeminiProvider(geminiClients, cfg.Gemini, cfg.Generation, tools))
+                // Route requests with an LLM intent classifier
+                classifier = newGeminiIntentClassifier(geminiClients, cfg.Gemini.ClassifierModel, time.Duration(cfg.Gemini.ClassifierTimeout))
+        }
+        if cfg.OpenAI.BaseURL != "" {
+                chatProviders = append(chatProviders, newOpenAIProvider(cfg.OpenAI, cfg.Generation))
+        }
+        if cfg.Chat.DefaultProvider == "fake" {
+                chatProviders = append(chatProviders, fakeChatProvider{})
+        }
+
+        providers, err := newProviderSet(cfg.Chat.DefaultProvider, chatProviders...)
+        if err != nil {
+                fatal("Failed to configure chat providers", "err", err)
+        }
+        slog.Info("Chat providers configured", "providers", providers.names(), "default", cfg.Chat.DefaultProvider)
+
+        capabilities := detectCapabilities(cfg, providers, imageBackends)
+        if images != nil {
+                capabilities.ImageModels = images.Models()
+        }
+        logCapabilities(capabilities)
+
+        // Configure conversation storage
+        var store Store
+        switch cfg.Storage.Driver {
+        case "sqlite":
+                store, err = newSQLiteStore(cfg.Storage.SQLitePath)
+                if err != nil {
+                        fatal("Failed to open conversation database", "path", cfg.Storage.SQLitePath, "err", err)
+                }
+                slog.Info("Conversation store opened", "driver", "sqlite", "path", cfg.Storage.SQLitePath)
+        case "memory":
+                store = newMemoryStore()
+                slog.Info("Conversation store opened", "driver", "memory")
+        }
+        defer store.Close()
+        // Jobs are stopped before the store their results are saved to closes
+        if jobs != nil {
+                defer jobs.Close(time.Duration(cfg.Server.ShutdownGracePeriod))
+        }
+
+        auth, err := newAuthenticator(cfg.Auth)
+        if err != nil {
+                fatal("Failed to configure authentication", "err", err)
+        }
+        if cfg.Auth.Enabled {
+                slog.Info("Authentication enabled", "users", len(cfg.Auth.Tokens), "persistent_sessions", cfg.Auth.SessionSecret != "")
+        } else {
+                slog.Warn("Authentication disabled: anyone who can reach the server can use the API; set AUTH_ENABLED and AUTH_TOKENS to require tokens")
+        }
+
+        srv := &server{
+                cfg:          cfg,
+                providers:    providers,
+                images:       images,
+                store:        store,
+                limiter:      newLimiter(cfg.Limits, store),
+                files:        newFileStore(cfg.Uploads),
+                jobs:         jobs,
+                classifier:   classifier,
+                capabilities: capabilities,
+                status:       newStatusChecker(cfg.Server, providers, images),
+                auth:         auth,
+        }
+
+        slog.Info("Server starting", "port", cfg.Server.Port)
+        if !capabilities.ImageGeneration {
+                slog.Warn("Image generation disabled: set HUGGINGFACE_API_KEY in your Replit Secrets to enable it")
+        }
+
+        // Returning runs the deferred cleanup: the Gemini client pool waits for
+        // any remaining requests, running image jobs get another grace period
+        // to finish and the conversation store is closed
+        return srv.listenAndServe()
+}
 
-        if r.Method == "OPTIONS" {
+func (s *server) handleChat(w http.ResponseWriter, r *http.Request) {
+        // Clients asking for an event stream get the streaming handler
+        if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+                s.handleChatStream(w, r)
                 return
         }
 
+        w.Header().Set("Content-Type", "application/json")
+
         if r.Method != "POST" {
-                log.Printf("Invalid method: %s", r.Method)
+                slog.WarnContext(r.Context(), "Invalid method", "method", r.Method)
                 sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
                 return
         }
 
-        // Parse multipart form with 10MB limit
-        err := r.ParseMultipartForm(10 << 20)
+        req, err := parseChatRequest(w, r, s.cfg.Uploads)
         if err != nil {
-                log.Printf("Failed to parse multipart form: %v", err)
-                sendErrorResponse(w, "Failed to parse form data: "+err.Error(), http.StatusBadRequest)
+                sendErrorResponse(w, err.Error(), http.StatusBadRequest)
                 return
         }
 
-        // Extract messages JSON from form data
-        messagesJSON := r.FormValue("messages")
-        if messagesJSON == "" {
-                log.Println("Messages field is missing from request")
-                sendErrorResponse(w, "Messages field is required", http.StatusBadRequest)
+        s.serveChat(w, r, req)
+}
+
+// serveChat answers a decoded chat request from either chat API with a single
+// JSON response
+func (s *server) serveChat(w http.ResponseWriter, r *http.Request, req *chatRequest) {
+        ctx, cancel := s.requestContext(r)
+        defer cancel()
+
+        turn := s.prepareChat(w, r, ctx, req)
+        if turn == nil {
                 return
         }
 
-        log.Printf("Received messages JSON: %s", messagesJSON)
+        // The client polls /api/jobs/{id} for the images
+        if turn.job != nil {
+                w.WriteHeader(http.StatusAccepted)
+                json.NewEncoder(w).Encode(ChatResponse{
+                        Response:       imageJobResponse,
+                        ConversationID: req.ConversationID,
+                        JobID:          turn.job.ID,
+                        ImageParams:    &req.ImageParams,
+                        RequestID:      requestID(r.Context()),
+                })
+                return
+        }
 
-        // Parse messages array
-        var messages []Message
-        err = json.Unmarshal([]byte(messagesJSON), &messages)
+        // Text chat and image analysis go to the selected provider
+        result, err := turn.provider.Generate(ctx, req)
         if err != nil {
-                log.Printf("Failed to parse messages JSON: %v", err)
-                sendErrorResponse(w, "Failed to parse messages JSON: "+err.Error(), http.StatusBadRequest)
+                sendDownstreamError(w, r, ctx, "Failed to get response from "+turn.provider.Name(), err)
                 return
         }
+        response := result.Text
+        // The model may have generated an image through a tool call
+        image := result.Image
 
-        log.Printf("Successfully parsed %d messages", len(messages))
+        // The logging content policy truncates or redacts the response
+        slog.InfoContext(ctx, "Successfully got response", "intent", turn.intent.Intent, "response", response)
+        turn.save(ctx, s.store, response, image)
 
-        // Extract prompt text
-        prompt := r.FormValue("prompt")
-        log.Printf("Received prompt: %s", prompt)
+        // Send successful response
+        chatResponse := ChatResponse{
+                Response:       response,
+                ConversationID: req.ConversationID,
+                RequestID:      requestID(r.Context()),
+        }
+        if image != nil {
+                chatResponse.ImageBase64 = image.Base64()
+                chatResponse.ImageMimeType = image.MimeType
+        }
 
-        // Check for uploaded image
-        file, fileHeader, err := r.FormFile("image")
-        var hasImage bool
-        var imageData []byte
-        var mimeType string
+        w.WriteHeader(http.StatusOK)
+        json.NewEncoder(w).Encode(chatResponse)
+}
 
-        if err == nil {
-                hasImage = true
-                defer file.Close()
+// chatTurn is a chat request that passed the steps shared by both chat APIs
+// and is ready to be answered, by the provider or by an image job
+type chatTurn struct {
+        req      *chatRequest
+        provider ChatProvider
+        intent   *IntentResult
+        // conv is the stored conversation the turn is saved to, if any
+        conv        *Conversation
+        userMessage Message
+        // job is set when the request generates images in the background
+        job *job
+}
 
-                // Read image data
-                imageData, err = io.ReadAll(file)
+// prepareChat runs the steps both chat APIs take before answering req:
+// selecting the provider, loading the stored conversation, rate limiting,
+// classifying intent, checking capabilities and image parameters, and
+// submitting image jobs. When the request is refused it writes a JSON error
+// response and returns nil.
+func (s *server) prepareChat(w http.ResponseWriter, r *http.Request, ctx context.Context, req *chatRequest) *chatTurn {
+        w.Header().Set("Content-Type", "application/json")
+
+        provider, err := s.providers.get(req.Provider)
+        if err != nil {
+                sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+                return nil
+        }
+        turn := &chatTurn{req: req, provider: provider}
+
+        // Stored conversations supply their own history
+        if req.ConversationID != "" {
+                turn.conv, turn.userMessage, err = loadConversation(ctx, s.store, req)
+                if err == errConversationNotFound {
+                        sendErrorResponse(w, "Conversation not found", http.StatusNotFound)
+                        return nil
+                }
                 if err != nil {
-                        log.Printf("Failed to read image data: %v", err)
-                        sendErrorResponse(w, "Failed to read image data: "+err.Error(), http.StatusBadRequest)
-                        return
+                        slog.ErrorContext(ctx, "Failed to load conversation", "conversation_id", req.ConversationID, "err", err)
+                        sendErrorResponse(w, "Failed to load conversation", http.StatusInternalServerError)
+                        return nil
                 }
+        }
 
-                // Detect MIME type from file extension
-                ext := strings.ToLower(filepath.Ext(fileHeader.Filename))
-                switch ext {
-                case ".jpg", ".jpeg":
-                        mimeType = "image/jpeg"
-                case ".png":
-                        mimeType = "image/png"
-                case ".gif":
-                        mimeType = "image/gif"
-                case ".webp":
-                        mimeType = "image/webp"
-                default:
-                        // Try to detect content type
-                        mimeType = http.DetectContentType(imageData)
-                        if !strings.HasPrefix(mimeType, "image/") {
-                                mimeType = "image/jpeg" // fallback
-                        }
-                }
+        if err := s.limiter.allow(ctx, r, inputCapability(req), 1); err != nil {
+                sendRateLimitError(w, err)
+                return nil
+        }
+
+        // Decide whether the user wants an image generated or a chat reply
+        turn.intent = classifyIntent(ctx, s.classifier, req)
+        observeIntent(ctx, turn.intent)
+        if msg := s.checkCapabilities(req, provider, turn.intent); msg != "" {
+                sendErrorResponse(w, msg, http.StatusNotImplemented)
+                return nil
+        }
+        if !turn.intent.wantsImage() {
+                return turn
+        }
 
-                log.Printf("Processing image: size=%d bytes, mimeType=%s", len(imageData), mimeType)
+        if err := s.checkImageParams(req); err != nil {
+                sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+                return nil
+        }
+        // Every image requested counts against the image limits
+        if err := s.limiter.allow(ctx, r, capabilityImage, req.ImageParams.NumImages); err != nil {
+                sendRateLimitError(w, err)
+                return nil
         }
 
-        // Check if user wants to generate an image
-        isImageGeneration := detectImageGenerationRequest(prompt, messages)
-        
-        ctx := context.Background()
-        var response string
-        var imageBase64 string
+        // Images are generated by a background job, submitted before any
+        // response is written so a full queue is still answered with a 429. The
+        // backends are text-to-image only, so edits are regenerated from the
+        // prompt.
+        turn.job, err = s.submitImageJob(ctx, req, turn.conv, turn.userMessage)
+        if err != nil {
+                sendDownstreamError(w, r, ctx, "Failed to generate image", err)
+                return nil
+        }
+        return turn
+}
 
-        if isImageGeneration {
-                // Generate image using Hugging Face
-                imageBase64, err = generateImage(ctx, huggingFaceAPIKey, prompt)
-                if err != nil {
-                        log.Printf("Failed to generate image: %v", err)
-                        sendErrorResponse(w, "Failed to generate image: "+err.Error(), http.StatusInternalServerError)
-                        return
+// save stores the turn with the model's response in its conversation, if any
+func (t *chatTurn) save(ctx context.Context, store ConversationStore, response string, image *GeneratedImage) {
+        if t.conv != nil {
+                saveTurn(ctx, store, t.conv, t.userMessage, response, image)
+        }
+}
+
+// chatRequest holds the fields decoded from a /api/chat form submission or a
+// /api/v1/chat JSON body
+type chatRequest struct {
+        Messages       []Message
+        Prompt         string
+        Provider       string
+        ConversationID string
+        ImageData      []byte
+        MimeType       string
+        // ImageParams apply when the request generates images
+        ImageParams ImageParams
+}
+
+func (c *chatRequest) hasImage() bool {
+        return c.ImageData != nil
+}
+
+// splitTurns separates the earlier conversation from the turn being sent.
+// The browser appends the current user message to messages before posting,
+// so a trailing user message is treated as the new turn. The prompt field
+// takes precedence over that message's text, and an uploaded image replaces
+// any inline copy, with a default analysis prompt when no text was given.
+func (c *chatRequest) splitTurns() ([]Message, []MessagePart) {
+        history := c.Messages
+        var last []MessagePart
+        if len(history) > 0 && history[len(history)-1].Role == "user" {
+                last = history[len(history)-1].Parts
+                history = history[:len(history)-1]
+        }
+
+        var turn []MessagePart
+        if c.Prompt != "" {
+                turn = append(turn, MessagePart{Text: c.Prompt})
+        }
+        for _, part := range last {
+                if part.Text != "" && c.Prompt == "" {
+                        turn = append(turn, MessagePart{Text: part.Text})
                 }
-                response = "Saya telah membuat gambar sesuai permintaan Anda!"
-        } else {
-                // Initialize Gemini client for text/image analysis
-                client, err := genai.NewClient(ctx, option.WithAPIKey(geminiAPIKey))
-                if err != nil {
-                        log.Printf("Failed to initialize Gemini client: %v", err)
-                        sendErrorResponse(w, "Failed to initialize Gemini client: "+err.Error(), http.StatusInternalServerError)
-                        return
+                if part.Data != "" && !c.hasImage() {
+                        turn = append(turn, MessagePart{MimeType: part.MimeType, Data: part.Data})
                 }
-                defer client.Close()
-
-                if hasImage {
-                        // Use gemini-pro-vision for image analysis
-                        response, err = handleImageChat(ctx, client, messages, imageData, mimeType, prompt)
-                } else {
-                        // Use gemini-pro for text-only chat
-                        response, err = handleTextChat(ctx, client, messages, prompt)
+        }
+
+        if c.hasImage() {
+                if len(turn) == 0 {
+                        turn = append(turn, MessagePart{Text: defaultImagePrompt})
                 }
+                turn = append(turn, MessagePart{
+                        MimeType: c.MimeType,
+                        Data:     base64.StdEncoding.EncodeToString(c.ImageData),
+                })
+        }
 
-                if err != nil {
-                        log.Printf("Failed to get response from Gemini: %v", err)
-                        sendErrorResponse(w, "Failed to get response from Gemini: "+err.Error(), http.StatusInternalServerError)
-                        return
+        return history, turn
+}
+
+// textParts returns only the text parts of a message
+func textParts(parts []MessagePart) []MessagePart {
+        var texts []MessagePart
+        for _, part := range parts {
+                if part.Text != "" {
+                        texts = append(texts, MessagePart{Text: part.Text})
                 }
         }
+        return texts
+}
 
-        // Log successful response (truncated for readability)
-        responsePreview := response
-        if len(response) > 100 {
-                responsePreview = response[:100] + "..."
+// parseChatRequest decodes the multipart form shared by the chat endpoints,
+// enforcing the configured upload limits
+func parseChatRequest(w http.ResponseWriter, r *http.Request, limits UploadsConfig) (*chatRequest, error) {
+        // Parse multipart form within the request size limit
+        r.Body = http.MaxBytesReader(w, r.Body, limits.MaxRequestBytes)
+        err := r.ParseMultipartForm(limits.MaxRequestBytes)
+        if err != nil {
+                slog.WarnContext(r.Context(), "Failed to parse multipart form", "err", err)
+                return nil, fmt.Errorf("Failed to parse form data: %v", err)
         }
-        log.Printf("Successfully got response: %s", responsePreview)
 
-        // Send successful response
-        chatResponse := ChatResponse{
-                Response:    response,
-                ImageBase64: imageBase64,
+        // A stored conversation replaces the client-supplied history
+        req := &chatRequest{}
+        req.ConversationID = r.FormValue("conversationId")
+
+        // Extract messages JSON from form data
+        messagesJSON := r.FormValue("messages")
+        if messagesJSON == "" && req.ConversationID == "" {
+                slog.WarnContext(r.Context(), "Messages field is missing from request")
+                return nil, fmt.Errorf("Messages field is required")
         }
 
-        w.WriteHeader(http.StatusOK)
-        json.NewEncoder(w).Encode(chatResponse)
-}
+        if messagesJSON != "" {
+                slog.DebugContext(r.Context(), "Received messages JSON", "messages", messagesJSON)
 
-func handleTextChat(ctx context.Context, client *genai.Client, messages []Message, prompt string) (string, error) {
-        // Use gemini-1.5-flash model for text chat
-        model := client.GenerativeModel("gemini-1.5-flash")
-
-        // Prepare the prompt to send
-        var promptText string
-        if prompt != "" {
-                promptText = prompt
-        } else if len(messages) > 0 {
-                // Use the last message's text
-                lastMsg := messages[len(messages)-1]
-                for _, part := range lastMsg.Parts {
-                        if part.Text != "" {
-                                promptText = part.Text
-                                break
-                        }
+                // Parse messages array
+                err = json.Unmarshal([]byte(messagesJSON), &req.Messages)
+                if err != nil {
+                        slog.WarnContext(r.Context(), "Failed to parse messages JSON", "err", err)
+                        return nil, fmt.Errorf("Failed to parse messages JSON: %v", err)
                 }
-        }
 
-        if promptText == "" {
-                return "", fmt.Errorf("no text content to send to Gemini")
+                slog.DebugContext(r.Context(), "Parsed messages", "count", len(req.Messages))
         }
 
-        // Generate content directly
-        resp, err := model.GenerateContent(ctx, genai.Text(promptText))
+        // Extract prompt text
+        req.Prompt = r.FormValue("prompt")
+        slog.InfoContext(r.Context(), "Received prompt", "prompt", req.Prompt)
+
+        // Optional chat provider override; empty selects the default
+        req.Provider = r.FormValue("provider")
+
+        // Optional image generation parameters
+        req.ImageParams, err = parseImageParamsForm(r)
         if err != nil {
-                return "", fmt.Errorf("failed to generate content: %v", err)
+                return nil, err
         }
 
-        // Extract text from response
-        if len(resp.Candidates) > 0 && len(resp.Candidates[0].Content.Parts) > 0 {
-                if textPart, ok := resp.Candidates[0].Content.Parts[0].(genai.Text); ok {
-                        return string(textPart), nil
-                }
-        }
+        // Check for uploaded image
+        file, fileHeader, err := r.FormFile("image")
+        if err == nil {
+                defer file.Close()
 
-        return "Maaf, saya tidak dapat menghasilkan respons saat ini.", nil
-}
+                if fileHeader.Size > limits.MaxImageBytes {
+                        return nil, fmt.Errorf("Image is too large (%d bytes, limit %d bytes)", fileHeader.Size, limits.MaxImageBytes)
+                }
 
-func handleImageChat(ctx context.Context, client *genai.Client, messages []Message, imageData []byte, mimeType, prompt string) (string, error) {
-        // Use gemini-1.5-flash model for image analysis
-        model := client.GenerativeModel("gemini-1.5-flash")
+                // Read image data
+                req.ImageData, err = io.ReadAll(file)
+                if err != nil {
+                        slog.WarnContext(r.Context(), "Failed to read image data", "err", err)
+                        return nil, fmt.Errorf("Failed to read image data: %v", err)
+                }
 
-        // Prepare parts for the current request
-        var parts []genai.Part
+                req.MimeType = imageMimeType(fileHeader.Filename, req.ImageData)
+                if err := checkImageType(limits, req.MimeType); err != nil {
+                        return nil, err
+                }
 
-        // Add text prompt if provided
-        if prompt != "" {
-                parts = append(parts, genai.Text(prompt))
-        } else {
-                // Default prompt for image analysis
-                parts = append(parts, genai.Text("Analisis gambar ini dan jelaskan apa yang Anda lihat."))
+                slog.InfoContext(r.Context(), "Processing image", "size", len(req.ImageData), "mime_type", req.MimeType)
         }
 
-        // Add the current image
-        imagePart := genai.ImageData(mimeType, imageData)
-        parts = append(parts, imagePart)
+        return req, nil
+}
 
-        // Generate content with text and image
-        resp, err := model.GenerateContent(ctx, parts...)
-        if err != nil {
-                return "", fmt.Errorf("failed to generate content with image: %v", err)
+// imageMimeType returns the MIME type of an uploaded image from its file
+// extension, or from its content for other names
+func imageMimeType(filename string, data []byte) string {
+        // Detect MIME type from file extension
+        ext := strings.ToLower(filepath.Ext(filename))
+        switch ext {
+        case ".jpg", ".jpeg":
+                return "image/jpeg"
+        case ".png":
+                return "image/png"
+        case ".gif":
+                return "image/gif"
+        case ".webp":
+                return "image/webp"
         }
 
-        // Extract text from response
-        if len(resp.Candidates) > 0 && len(resp.Candidates[0].Content.Parts) > 0 {
-                if textPart, ok := resp.Candidates[0].Content.Parts[0].(genai.Text); ok {
-                        return string(textPart), nil
-                }
+        // Try to detect content type
+        mimeType := http.DetectContentType(data)
+        if !strings.HasPrefix(mimeType, "image/") {
+                return "image/jpeg" // fallback
         }
+        return mimeType
+}
 
-        return "Maaf, saya tidak dapat menganalisis gambar ini.", nil
+// checkImageType rejects image types that are not in the allowed upload types
+func checkImageType(limits UploadsConfig, mimeType string) error {
+        if !containsString(limits.AllowedImageTypes, mimeType) {
+                return fmt.Errorf("Unsupported image type %s (allowed: %s)", mimeType, strings.Join(limits.AllowedImageTypes, ", "))
+        }
+        return nil
 }
 
 // detectImageGenerationRequest checks if the user wants to generate an image
@@ -343,257 +599,61 @@ func detectImageGenerationRequest(prompt string, messages []Message) bool {
         return false
 }
 
-// checkModelAvailability checks if a model is available and ready
-func checkModelAvailability(ctx context.Context, apiKey, model string) bool {
-        url := fmt.Sprintf("https://api-inference.huggingface.co/models/%s", model)
-        
-        req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-        if err != nil {
-                return false
-        }
-        
-        req.Header.Set("Authorization", "Bearer "+apiKey)
-        
-        client := &http.Client{Timeout: 10 * time.Second}
-        resp, err := client.Do(req)
-        if err != nil {
-                return false
-        }
-        defer resp.Body.Close()
-        
-        log.Printf("Model %s availability check: status %d", model, resp.StatusCode)
-        return resp.StatusCode == 200
+// errClientCancelled and errRequestTimeout report that a downstream call was
+// cut short by the request context rather than failing on its own
+var (
+        errClientCancelled = errors.New("client cancelled the request")
+        errRequestTimeout  = errors.New("request timed out")
+)
+
+// requestContext derives the context for downstream calls from the request,
+// so they stop when the client disconnects, bounded by the request timeout.
+// It carries the rate-limited client for the tools the model calls.
+func (s *server) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+        ctx := s.limiter.withClient(r.Context(), r)
+        return context.WithTimeout(ctx, time.Duration(s.cfg.Server.RequestTimeout))
 }
 
-// generateImage generates an image using Hugging Face Stable Diffusion API
-func generateImage(ctx context.Context, apiKey, prompt string) (string, error) {
-        // Try models that are more likely to be available
-        models := []string{
-                "black-forest-labs/FLUX.1-dev",
-                "black-forest-labs/FLUX.1-schnell",
-                "stabilityai/stable-diffusion-xl-base-1.0",
-                "stabilityai/sdxl-turbo",
-                "Lykon/DreamShaper",
-                "prompthero/openjourney",
-                "nitrosocke/Arcane-Diffusion",
-                "runwayml/stable-diffusion-v1-5",
-                "CompVis/stable-diffusion-v1-4",
-                "stabilityai/stable-diffusion-2-1",
-        }
-        
-        log.Printf("Starting image generation with prompt: %s", prompt)
-        
-        var lastError error
-        var workingModel string
-        
-        // First, find a working model
-        for _, model := range models {
-                if checkModelAvailability(ctx, apiKey, model) {
-                        workingModel = model
-                        log.Printf("Found working model: %s", model)
-                        break
-                }
+// contextError reports whether a failed downstream call was cut short by the
+// client going away or by the request deadline, or nil if it failed by itself
+func contextError(ctx context.Context, r *http.Request) error {
+        if r.Context().Err() != nil {
+                return errClientCancelled
         }
-        
-        if workingModel == "" {
-                // If no model responds to availability check, try them anyway
-                log.Printf("No model responded to availability check, trying all models anyway")
-                workingModel = models[0]
+        if ctx.Err() != nil {
+                return errRequestTimeout
         }
-        
-        // Try to generate with the working model first, then fallback to others
-        modelsToTry := []string{workingModel}
-        for _, model := range models {
-                if model != workingModel {
-                        modelsToTry = append(modelsToTry, model)
-                }
+        return nil
+}
+
+// sendDownstreamError responds to a failed backend call. Nothing is written
+// for a client that cancelled since nobody is reading, a request that ran
+// out of time gets a 504 and one refused by a full image queue a 429.
+func sendDownstreamError(w http.ResponseWriter, r *http.Request, ctx context.Context, msg string, err error) {
+        var limited *rateLimitError
+        if errors.As(err, &limited) {
+                slog.WarnContext(ctx, msg, "err", err)
+                sendRateLimitError(w, limited)
+                return
         }
-        
-        for _, model := range modelsToTry {
-                log.Printf("Trying image generation with model: %s", model)
-                url := fmt.Sprintf("https://api-inference.huggingface.co/models/%s", model)
-                
-                // Prepare request payload - simplified for better compatibility
-                payload := map[string]interface{}{
-                        "inputs": prompt,
-                }
-                
-                // Add parameters only for stable diffusion models
-                if strings.Contains(model, "stable-diffusion") || strings.Contains(model, "sdxl") {
-                        payload["parameters"] = map[string]interface{}{
-                                "num_inference_steps": 25,
-                                "guidance_scale":      7.5,
-                        }
-                }
-                
-                jsonPayload, err := json.Marshal(payload)
-                if err != nil {
-                        lastError = fmt.Errorf("failed to marshal payload: %v", err)
-                        continue
-                }
-                
-                log.Printf("Sending request to %s with payload: %s", url, string(jsonPayload))
-                
-                // Create HTTP request
-                req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonPayload))
-                if err != nil {
-                        lastError = fmt.Errorf("failed to create request: %v", err)
-                        continue
-                }
-                
-                req.Header.Set("Authorization", "Bearer "+apiKey)
-                req.Header.Set("Content-Type", "application/json")
-                req.Header.Set("User-Agent", "GeminiChatApp/1.0")
-                
-                // Send request with longer timeout for image generation
-                client := &http.Client{
-                        Timeout: 120 * time.Second, // Increased timeout
-                }
-                
-                log.Printf("Sending request to model %s...", model)
-                startTime := time.Now()
-                
-                resp, err := client.Do(req)
-                if err != nil {
-                        lastError = fmt.Errorf("failed to send request: %v", err)
-                        log.Printf("Request failed for model %s after %v: %v", model, time.Since(startTime), err)
-                        continue
-                }
-                defer resp.Body.Close()
-                
-                log.Printf("Received response from model %s after %v, status: %d", model, time.Since(startTime), resp.StatusCode)
-                
-                // Read response body with timeout
-                bodyChannel := make(chan []byte, 1)
-                errorChannel := make(chan error, 1)
-                
-                go func() {
-                        body, err := io.ReadAll(resp.Body)
-                        if err != nil {
-                                errorChannel <- err
-                                return
-                        }
-                        bodyChannel <- body
-                }()
-                
-                select {
-                case body := <-bodyChannel:
-                        log.Printf("Model %s response: status=%d, body_length=%d", model, resp.StatusCode, len(body))
-                        
-                        // Log first 200 characters of response for debugging
-                        if len(body) > 0 {
-                                preview := string(body)
-                                if len(preview) > 200 {
-                                        preview = preview[:200] + "..."
-                                }
-                                log.Printf("Response preview: %s", preview)
-                        }
-                
-                if resp.StatusCode == 503 {
-                                log.Printf("Model %s is loading (503), will retry in 20 seconds", model)
-                                time.Sleep(20 * time.Second)
-                                
-                                // Retry once
-                                retryStartTime := time.Now()
-                                resp2, err2 := client.Do(req)
-                                if err2 != nil {
-                                        lastError = fmt.Errorf("retry failed: %v", err2)
-                                        continue
-                                }
-                                defer resp2.Body.Close()
-                                
-                                body, err = io.ReadAll(resp2.Body)
-                                if err != nil {
-                                        lastError = fmt.Errorf("failed to read retry response: %v", err)
-                                        continue
-                                }
-                                
-                                resp = resp2
-                                log.Printf("Retry for model %s completed after %v: status=%d, body_length=%d", model, time.Since(retryStartTime), resp.StatusCode, len(body))
-                        } else if resp.StatusCode == 404 {
-                                log.Printf("Model %s not found (404), trying next model", model)
-                                lastError = fmt.Errorf("model %s not found", model)
-                                continue
-                        } else if resp.StatusCode == 401 {
-                                log.Printf("Unauthorized (401) - check your Hugging Face API key")
-                                lastError = fmt.Errorf("unauthorized - invalid API key")
-                                continue
-                        } else if resp.StatusCode == 429 {
-                                log.Printf("Rate limit exceeded (429), waiting and trying next model")
-                                lastError = fmt.Errorf("rate limit exceeded")
-                                continue
-                        }
-                        
-                        if resp.StatusCode != http.StatusOK {
-                                log.Printf("API request failed for model %s with status %d: %s", model, resp.StatusCode, string(body))
-                                lastError = fmt.Errorf("API request failed for model %s with status %d: %s", model, resp.StatusCode, string(body))
-                                continue
-                        }
-                        
-                        // Check if response is JSON error
-                        var errorResp map[string]interface{}
-                        if json.Unmarshal(body, &errorResp) == nil {
-                                if errorMsg, exists := errorResp["error"]; exists {
-                                        log.Printf("Model %s returned error: %v", model, errorMsg)
-                                        lastError = fmt.Errorf("model %s returned error: %v", model, errorMsg)
-                                        continue
-                                }
-                        }
-                        
-                        // Validate response is image data
-                        if len(body) < 100 {
-                                log.Printf("Response too short to be an image: %d bytes", len(body))
-                                lastError = fmt.Errorf("response too short for model %s", model)
-                                continue
-                        }
-                        
-                        // Check if it's actually image data by checking magic bytes
-                        if len(body) >= 4 {
-                                // Check for common image file signatures
-                                isImage := false
-                                if body[0] == 0xFF && body[1] == 0xD8 && body[2] == 0xFF { // JPEG
-                                        isImage = true
-                                } else if body[0] == 0x89 && body[1] == 0x50 && body[2] == 0x4E && body[3] == 0x47 { // PNG
-                                        isImage = true
-                                } else if body[0] == 0x47 && body[1] == 0x49 && body[2] == 0x46 { // GIF
-                                        isImage = true
-                                } else if body[0] == 0x52 && body[1] == 0x49 && body[2] == 0x46 && body[3] == 0x46 { // WEBP (starts with RIFF)
-                                        isImage = true
-                                }
-                                
-                                if !isImage {
-                                        log.Printf("Response doesn't appear to be image data for model %s", model)
-                                        log.Printf("First 20 bytes: %v", body[:min(20, len(body))])
-                                        lastError = fmt.Errorf("invalid image data from model %s", model)
-                                        continue
-                                }
-                        }
-                        
-                        // Success! Convert to base64
-                        imageBase64 := base64.StdEncoding.EncodeToString(body)
-                        log.Printf("Successfully generated image using model: %s (image size: %d bytes)", model, len(body))
-                        return imageBase64, nil
-                        
-                case err := <-errorChannel:
-                        lastError = fmt.Errorf("failed to read response body: %v", err)
-                        log.Printf("Error reading response body for model %s: %v", model, err)
-                        continue
-                        
-                case <-time.After(60 * time.Second):
-                        lastError = fmt.Errorf("timeout reading response body for model %s", model)
-                        log.Printf("Timeout reading response body for model %s", model)
-                        continue
-                }
+
+        switch contextError(ctx, r) {
+        case errClientCancelled:
+                slog.InfoContext(ctx, msg, "err", errClientCancelled)
+        case errRequestTimeout:
+                slog.WarnContext(ctx, msg+": "+errRequestTimeout.Error(), "err", err)
+                sendErrorResponse(w, msg+": "+errRequestTimeout.Error(), http.StatusGatewayTimeout)
+        default:
+                slog.ErrorContext(ctx, msg, "err", err)
+                sendErrorResponse(w, fmt.Sprintf("%s: %v", msg, err), http.StatusInternalServerError)
         }
-        
-        // All models failed
-        return "", fmt.Errorf("all image generation models failed, last error: %v", lastError)
 }
 
 func sendErrorResponse(w http.ResponseWriter, errorMsg string, statusCode int) {
         w.WriteHeader(statusCode)
         response := ChatResponse{
-                Error: errorMsg,
+                Error:     errorMsg,
+                RequestID: w.Header().Get(requestIDHeader),
         }
         json.NewEncoder(w).Encode(response)
 }
\ No newline at end of file
@@ -0,0 +1,141 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "sync/atomic"
+        "testing"
+)
+
+// newTestServer returns a server backed by the fake chat provider and image
+// generator and an in-memory store, without rate limits
+func newTestServer(t *testing.T) *server {
+        t.Helper()
+
+        cfg := defaultConfig()
+        cfg.Limits = LimitsConfig{}
+        providers, err := newProviderSet("fake", fakeChatProvider{})
+        if err != nil {
+                t.Fatal(err)
+        }
+        images := fakeImageGenerator{}
+        store := newMemoryStore()
+        jobs := newJobQueue(images, cfg.Jobs)
+        t.Cleanup(func() {
+                jobs.Close(0)
+                store.Close()
+        })
+
+        return &server{
+                cfg:       cfg,
+                providers: providers,
+                images:    images,
+                store:     store,
+                limiter:   newLimiter(cfg.Limits, store),
+                files:     newFileStore(cfg.Uploads),
+                jobs:      jobs,
+        }
+}
+
+// serveChat runs req through serveChat and decodes the response
+func serveChat(t *testing.T, s *server, req *chatRequest) (int, ChatResponse) {
+        t.Helper()
+
+        rec := httptest.NewRecorder()
+        s.serveChat(rec, httptest.NewRequest("POST", "/api/chat", nil), req)
+        var resp ChatResponse
+        if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+                t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+        }
+        return rec.Code, resp
+}
+
+// waitJob waits for the job with id to finish and returns its final state
+func waitJob(t *testing.T, s *server, id string) *Job {
+        t.Helper()
+
+        j, err := s.jobs.get("", id)
+        if err != nil {
+                t.Fatalf("job %s: %v", id, err)
+        }
+        state, err := s.jobs.wait(context.Background(), j)
+        if err != nil {
+                t.Fatalf("job %s: %v", id, err)
+        }
+        return state
+}
+
+func TestServeChatText(t *testing.T) {
+        s := newTestServer(t)
+        req := &chatRequest{
+                Messages: []Message{
+                        {Role: "user", Parts: []MessagePart{{Text: "hi"}}},
+                        {Role: "model", Parts: []MessagePart{{Text: "hello"}}},
+                },
+                Prompt: "how are you",
+        }
+
+        code, resp := serveChat(t, s, req)
+        if code != http.StatusOK {
+                t.Fatalf("status = %d (%s), want 200", code, resp.Error)
+        }
+        if want := "You said: how are you (2 earlier messages, 0 images)"; resp.Response != want {
+                t.Errorf("response = %q, want %q", resp.Response, want)
+        }
+        if resp.JobID != "" || resp.ImageBase64 != "" {
+                t.Errorf("chat reply came with an image or job: %+v", resp)
+        }
+}
+
+func TestServeChatSavesConversation(t *testing.T) {
+        s := newTestServer(t)
+        conv, err := s.store.CreateConversation(context.Background(), "", "")
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        code, resp := serveChat(t, s, &chatRequest{ConversationID: conv.ID, Prompt: "remember this"})
+        if code != http.StatusOK {
+                t.Fatalf("status = %d (%s), want 200", code, resp.Error)
+        }
+
+        saved, err := s.store.GetConversation(context.Background(), "", conv.ID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if len(saved.Messages) != 2 || saved.Messages[1].Parts[0].Text != resp.Response {
+                t.Errorf("saved messages = %+v, want the turn and %q", saved.Messages, resp.Response)
+        }
+        if saved.Title != "remember this" {
+                t.Errorf("title = %q, want the prompt", saved.Title)
+        }
+}
+
+// countingClassifier classifies every request as chat and counts the calls
+type countingClassifier struct {
+        calls atomic.Int32
+}
+
+func (c *countingClassifier) Classify(ctx context.Context, req *chatRequest) (*IntentResult, error) {
+        c.calls.Add(1)
+        return &IntentResult{Intent: IntentChat, Confidence: 1, Source: "classifier"}, nil
+}
+
+func TestServeChatRateLimitedBeforeClassifying(t *testing.T) {
+        s := newTestServer(t)
+        s.limiter = newLimiter(LimitsConfig{Text: RateLimit{PerMinute: 1, Burst: 1}}, newMemoryStore())
+        classifier := &countingClassifier{}
+        s.classifier = classifier
+
+        for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+                code, _ := serveChat(t, s, &chatRequest{Prompt: "hi"})
+                if code != want {
+                        t.Fatalf("request %d: status = %d, want %d", i+1, code, want)
+                }
+        }
+        if calls := classifier.calls.Load(); calls != 1 {
+                t.Errorf("classifier called %d times, want 1", calls)
+        }
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+        "context"
+        "net/http"
+        "strconv"
+        "time"
+
+        "github.com/google/generative-ai-go/genai"
+        "github.com/prometheus/client_golang/prometheus"
+        "github.com/prometheus/client_golang/prometheus/promauto"
+        "go.opentelemetry.io/otel/attribute"
+        "go.opentelemetry.io/otel/trace"
+)
+
+// Prometheus metrics served on /metrics
+var (
+        httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+                Name: "chat_http_requests_total",
+                Help: "HTTP requests by route, classified intent and status code.",
+        }, []string{"route", "intent", "code"})
+
+        httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+                Name: "chat_http_request_duration_seconds",
+                Help: "HTTP request latency by route and classified intent.",
+                // Chat replies take seconds and image generation up to minutes
+                Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+        }, []string{"route", "intent"})
+
+        httpRequestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+                Name: "chat_http_requests_in_flight",
+                Help: "HTTP requests currently being served by route.",
+        }, []string{"route"})
+
+        geminiTokensTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+                Name: "chat_gemini_tokens_total",
+                Help: "Gemini tokens reported in UsageMetadata by model, use (chat or classifier) and type (prompt or candidates).",
+        }, []string{"model", "use", "type"})
+
+        huggingFaceRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+                Name: "chat_huggingface_requests_total",
+                Help: "Hugging Face inference requests by model and result (success, failure, unavailable for 503, rate_limited for 429).",
+        }, []string{"model", "result"})
+
+        imageBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+                Name: "chat_generated_image_bytes_total",
+                Help: "Bytes of generated images by backend and model.",
+        }, []string{"backend", "model"})
+
+        imagesGeneratedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+                Name: "chat_generated_images_total",
+                Help: "Generated images by backend and model.",
+        }, []string{"backend", "model"})
+
+        imageModelAvailable = promauto.NewGaugeVec(prometheus.GaugeOpts{
+                Name: "chat_image_model_available",
+                Help: "Whether the last probe or generation found an image model available (1) or not (0), by backend and model.",
+        }, []string{"backend", "model"})
+
+        imageCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+                Name: "chat_image_circuit_state",
+                Help: "Circuit breaker state of an image model by backend and model (0 closed, 1 half-open, 2 open).",
+        }, []string{"backend", "model"})
+
+        rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+                Name: "chat_rate_limited_total",
+                Help: "Requests refused with 429 by capability and reason (rate, quota, or busy when the image generation queue is full).",
+        }, []string{"capability", "reason"})
+)
+
+// Results recorded in chat_huggingface_requests_total
+const (
+        hfResultSuccess     = "success"
+        hfResultFailure     = "failure"
+        hfResultUnavailable = "unavailable"
+        hfResultRateLimited = "rate_limited"
+)
+
+// observeHuggingFaceStatus records an inference response that failed with
+// status. Successful responses are recorded once the image is validated.
+func observeHuggingFaceStatus(model string, status int) {
+        switch status {
+        case http.StatusOK:
+        case http.StatusServiceUnavailable:
+                huggingFaceRequestsTotal.WithLabelValues(model, hfResultUnavailable).Inc()
+        case http.StatusTooManyRequests:
+                huggingFaceRequestsTotal.WithLabelValues(model, hfResultRateLimited).Inc()
+        default:
+                huggingFaceRequestsTotal.WithLabelValues(model, hfResultFailure).Inc()
+        }
+}
+
+// requestMetrics carries labels that are only known once a handler has
+// looked at the request
+type requestMetrics struct {
+        intent string
+}
+
+type requestMetricsKey struct{}
+
+// observeIntent labels the current request's metrics with the classified
+// intent. It is a no-op outside instrumented routes.
+func observeIntent(ctx context.Context, intent *IntentResult) {
+        if m, ok := ctx.Value(requestMetricsKey{}).(*requestMetrics); ok {
+                m.intent = string(intent.Intent)
+        }
+        trace.SpanFromContext(ctx).SetAttributes(attribute.String("chat.intent", string(intent.Intent)))
+}
+
+// statusRecorder captures the response status code. It keeps http.Flusher
+// available for Server-Sent Events.
+type statusRecorder struct {
+        http.ResponseWriter
+        status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+        if r.status == 0 {
+                r.status = status
+        }
+        r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+        if r.status == 0 {
+                r.status = http.StatusOK
+        }
+        return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+        if f, ok := r.ResponseWriter.(http.Flusher); ok {
+                if r.status == 0 {
+                        r.status = http.StatusOK
+                }
+                f.Flush()
+        }
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+        return r.ResponseWriter
+}
+
+// instrument records request count, latency and in-flight requests for
+// handler under route, and names the request's trace span after the route
+func instrument(route string, handler http.HandlerFunc) http.HandlerFunc {
+        inFlight := httpRequestsInFlight.WithLabelValues(route)
+        return func(w http.ResponseWriter, r *http.Request) {
+                inFlight.Inc()
+                defer inFlight.Dec()
+
+                span := trace.SpanFromContext(r.Context())
+                span.SetName(r.Method + " " + route)
+                span.SetAttributes(attribute.String("http.route", route), attribute.String("request.id", requestID(r.Context())))
+
+                m := &requestMetrics{intent: "none"}
+                rec := &statusRecorder{ResponseWriter: w}
+                start := time.Now()
+                handler(rec, r.WithContext(context.WithValue(r.Context(), requestMetricsKey{}, m)))
+
+                if rec.status == 0 {
+                        rec.status = http.StatusOK
+                }
+                httpRequestsTotal.WithLabelValues(route, m.intent, strconv.Itoa(rec.status)).Inc()
+                httpRequestDuration.WithLabelValues(route, m.intent).Observe(time.Since(start).Seconds())
+        }
+}
+
+// observeTokenUsage records the token counts Gemini reported for one call
+func observeTokenUsage(model, use string, usage *genai.UsageMetadata) {
+        if usage == nil {
+                return
+        }
+        geminiTokensTotal.WithLabelValues(model, use, "prompt").Add(float64(usage.PromptTokenCount))
+        geminiTokensTotal.WithLabelValues(model, use, "candidates").Add(float64(usage.CandidatesTokenCount))
+}
+
+// observeGeneratedImage records an image produced by backend
+func observeGeneratedImage(backend string, img *GeneratedImage) {
+        imagesGeneratedTotal.WithLabelValues(backend, img.Model).Inc()
+        imageBytesTotal.WithLabelValues(backend, img.Model).Add(float64(len(img.Data)))
+}
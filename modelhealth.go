@@ -0,0 +1,289 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "fmt"
+        "log/slog"
+        "net/http"
+        "sort"
+        "sync"
+        "time"
+
+        "go.opentelemetry.io/otel/attribute"
+        "go.opentelemetry.io/otel/trace"
+)
+
+// Model states recorded by a modelHealth registry
+const (
+        modelAvailable   = "available"
+        modelUnknown     = "unknown"
+        modelLoading     = "loading"
+        modelUnavailable = "unavailable"
+)
+
+// modelStateRank orders the fallback chain: models that worked recently come
+// first, models that failed last
+var modelStateRank = map[string]int{
+        modelAvailable:   0,
+        modelUnknown:     1,
+        modelLoading:     2,
+        modelUnavailable: 3,
+}
+
+// Where a ModelHealth result came from
+const (
+        checkProbe      = "probe"
+        checkGeneration = "generation"
+)
+
+// ModelHealth is the most recent known health of one image model
+type ModelHealth struct {
+        Model string `json:"model"`
+        State string `json:"state"`
+        // LastStatus is the HTTP status of the last check, 0 when it got no
+        // response
+        LastStatus int    `json:"lastStatus,omitempty"`
+        LatencyMs  int64  `json:"latencyMs"`
+        Error      string `json:"error,omitempty"`
+        // Source is "probe" or "generation"
+        Source    string     `json:"source,omitempty"`
+        CheckedAt *time.Time `json:"checkedAt,omitempty"`
+        // Circuit is set for backends with a circuit breaker per model
+        Circuit *CircuitState `json:"circuit,omitempty"`
+}
+
+// modelCheck is the outcome of a probe or a generation request to one model
+type modelCheck struct {
+        status  int
+        loading bool
+        latency time.Duration
+        err     error
+}
+
+// state classifies the check: a model that is loading answers later, one
+// that answered without error is available and any other is unavailable
+func (c modelCheck) state() string {
+        switch {
+        case c.loading:
+                return modelLoading
+        case c.err != nil:
+                return modelUnavailable
+        }
+        return modelAvailable
+}
+
+// modelHealth records the health of a backend's models. Background probes
+// refresh it on a schedule and generations report their outcome, so the
+// fallback chain can start with the models most likely to work without
+// checking any of them on the request path.
+type modelHealth struct {
+        backend  string
+        models   []string
+        probe    func(ctx context.Context, model string) modelCheck
+        interval time.Duration
+        timeout  time.Duration
+
+        mu     sync.Mutex
+        health map[string]ModelHealth
+}
+
+// newModelHealth tracks models, probing each with probe every interval. A zero
+// interval disables background probing.
+func newModelHealth(backend string, models []string, probe func(context.Context, string) modelCheck, interval, timeout time.Duration) *modelHealth {
+        m := &modelHealth{
+                backend:  backend,
+                models:   models,
+                probe:    probe,
+                interval: interval,
+                timeout:  timeout,
+                health:   make(map[string]ModelHealth, len(models)),
+        }
+        for _, model := range models {
+                m.health[model] = ModelHealth{Model: model, State: modelUnknown}
+        }
+        return m
+}
+
+// run probes every model now and then every interval until ctx ends
+func (m *modelHealth) run(ctx context.Context) {
+        if m.interval <= 0 {
+                return
+        }
+        slog.Info("Model health checks started", "backend", m.backend, "models", len(m.models), "interval", m.interval)
+
+        ticker := time.NewTicker(m.interval)
+        defer ticker.Stop()
+        for {
+                m.probeAll(ctx)
+                select {
+                case <-ticker.C:
+                case <-ctx.Done():
+                        return
+                }
+        }
+}
+
+// probeAll probes every model concurrently and records the results
+func (m *modelHealth) probeAll(ctx context.Context) {
+        ctx, span := tracer.Start(ctx, "model_health.probe", trace.WithAttributes(
+                attribute.String("backend", m.backend),
+                attribute.Int("models", len(m.models)),
+        ))
+        defer span.End()
+
+        var wg sync.WaitGroup
+        for _, model := range m.models {
+                wg.Add(1)
+                go func(model string) {
+                        defer wg.Done()
+                        probeCtx, cancel := context.WithTimeout(ctx, m.timeout)
+                        defer cancel()
+
+                        check := m.probe(probeCtx, model)
+                        // Probes cut short by shutdown say nothing about the model
+                        if ctx.Err() != nil {
+                                return
+                        }
+                        m.record(model, check, checkProbe)
+                }(model)
+        }
+        wg.Wait()
+}
+
+// record stores the outcome of a check of model
+func (m *modelHealth) record(model string, check modelCheck, source string) {
+        now := time.Now().UTC()
+        h := ModelHealth{
+                Model:      model,
+                State:      check.state(),
+                LastStatus: check.status,
+                LatencyMs:  check.latency.Milliseconds(),
+                Source:     source,
+                CheckedAt:  &now,
+        }
+        if check.err != nil {
+                h.Error = check.err.Error()
+        }
+
+        m.mu.Lock()
+        previous := m.health[model].State
+        m.health[model] = h
+        m.mu.Unlock()
+
+        imageModelAvailable.WithLabelValues(m.backend, model).Set(boolGauge(h.State == modelAvailable))
+        if h.State != previous {
+                slog.Info("Model health changed", "backend", m.backend, "model", model, "from", previous, "to", h.State, "source", source, "err", check.err)
+        }
+}
+
+// order returns the models sorted by health, keeping the configured order
+// between models in the same state
+func (m *modelHealth) order() []string {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        ordered := append([]string(nil), m.models...)
+        sort.SliceStable(ordered, func(i, j int) bool {
+                return modelStateRank[m.health[ordered[i]].State] < modelStateRank[m.health[ordered[j]].State]
+        })
+        return ordered
+}
+
+// snapshot returns the health of every model in fallback order
+func (m *modelHealth) snapshot() []ModelHealth {
+        models := m.order()
+
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        health := make([]ModelHealth, 0, len(models))
+        for _, model := range models {
+                health = append(health, m.health[model])
+        }
+        return health
+}
+
+// available returns an error unless at least one model is available
+func (m *modelHealth) available() error {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        var lastError string
+        for _, model := range m.models {
+                h := m.health[model]
+                if h.State == modelAvailable {
+                        return nil
+                }
+                if h.Error != "" {
+                        lastError = fmt.Sprintf("%s: %s", model, h.Error)
+                }
+        }
+        if lastError == "" {
+                return fmt.Errorf("no model is available")
+        }
+        return fmt.Errorf("no model is available, last error: %s", lastError)
+}
+
+// modelHealthTracker is implemented by image backends that keep a model
+// health registry
+type modelHealthTracker interface {
+        healthRegistry() *modelHealth
+}
+
+// watchModelHealth starts the background probes of every backend in images
+// that tracks model health. They stop when ctx ends.
+func watchModelHealth(ctx context.Context, images ImageGenerator) {
+        for _, g := range imageBackends(images) {
+                if t, ok := g.(modelHealthTracker); ok {
+                        go t.healthRegistry().run(ctx)
+                }
+        }
+}
+
+// boolGauge is the gauge value of b
+func boolGauge(b bool) float64 {
+        if b {
+                return 1
+        }
+        return 0
+}
+
+// modelHealthResponse is the body of GET /api/admin/models
+type modelHealthResponse struct {
+        Backends []backendModelHealth `json:"backends"`
+}
+
+type backendModelHealth struct {
+        Backend string `json:"backend"`
+        // Models are listed in the order the fallback chain tries them
+        Models []ModelHealth `json:"models"`
+}
+
+// handleModelHealth serves GET /api/admin/models with the model health
+// registry and circuit breakers of every image backend that keeps them
+func (s *server) handleModelHealth(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        if r.Method != "GET" {
+                slog.WarnContext(r.Context(), "Invalid method", "method", r.Method)
+                sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        resp := modelHealthResponse{Backends: []backendModelHealth{}}
+        for _, g := range imageBackends(s.images) {
+                t, ok := g.(modelHealthTracker)
+                if !ok {
+                        continue
+                }
+                models := t.healthRegistry().snapshot()
+                if c, ok := g.(circuitTracker); ok {
+                        for i := range models {
+                                circuit := c.circuitBreakers().state(models[i].Model)
+                                models[i].Circuit = &circuit
+                        }
+                }
+                resp.Backends = append(resp.Backends, backendModelHealth{Backend: g.Name(), Models: models})
+        }
+        json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "net/http"
+        "net/http/httptest"
+        "reflect"
+        "strings"
+        "testing"
+        "time"
+)
+
+func TestModelHealthOrder(t *testing.T) {
+        m := newModelHealth("test", []string{"down", "ok1", "loading", "unknown", "ok2", "down2"}, nil, 0, time.Second)
+        m.record("down", modelCheck{status: 500, err: errors.New("status 500")}, checkProbe)
+        m.record("ok1", modelCheck{status: 200}, checkProbe)
+        m.record("loading", modelCheck{status: 503, loading: true, err: errors.New("model is loading")}, checkProbe)
+        m.record("ok2", modelCheck{status: 200}, checkProbe)
+        m.record("down2", modelCheck{err: errors.New("failed to send request")}, checkProbe)
+
+        // Within a state the configured order is kept
+        want := []string{"ok1", "ok2", "unknown", "loading", "down", "down2"}
+        if got := m.order(); !reflect.DeepEqual(got, want) {
+                t.Errorf("order = %v, want %v", got, want)
+        }
+}
+
+func TestModelHealthGenerationOverridesProbe(t *testing.T) {
+        m := newModelHealth("test", []string{"a", "b"}, nil, 0, time.Second)
+        m.record("a", modelCheck{status: 200}, checkProbe)
+        m.record("b", modelCheck{status: 200}, checkProbe)
+
+        // A generation that failed after the last probe demotes the model
+        m.record("a", modelCheck{status: 500, err: errors.New("status 500")}, checkGeneration)
+        if got := m.order(); !reflect.DeepEqual(got, []string{"b", "a"}) {
+                t.Errorf("order = %v, want [b a]", got)
+        }
+        health := m.snapshot()
+        if h := health[1]; h.State != modelUnavailable || h.Source != checkGeneration || h.LastStatus != 500 {
+                t.Errorf("health of a = %+v, want unavailable from the generation", h)
+        }
+
+        // and a generation that succeeded promotes it again
+        m.record("a", modelCheck{status: 200}, checkGeneration)
+        if got := m.order(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+                t.Errorf("order = %v, want [a b]", got)
+        }
+}
+
+func TestHuggingFaceProbe(t *testing.T) {
+        responses := map[string]struct {
+                status int
+                body   string
+        }{
+                "org/down":    {http.StatusInternalServerError, `{"error":"internal error"}`},
+                "org/loading": {http.StatusServiceUnavailable, `{"error":"Model is loading","estimated_time":20}`},
+                "org/cold":    {http.StatusOK, `{"loaded":false}`},
+                "org/ready":   {http.StatusOK, `{"loaded":true}`},
+        }
+        srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                resp := responses[strings.TrimPrefix(r.URL.Path, "/models/")]
+                w.WriteHeader(resp.status)
+                w.Write([]byte(resp.body))
+        }))
+        defer srv.Close()
+
+        cfg := defaultConfig().Images.HuggingFace
+        cfg.BaseURL = srv.URL
+        cfg.Models = []string{"org/down", "org/loading", "org/cold", "org/ready"}
+        h := newHuggingFaceGenerator(cfg)
+        if err := h.Probe(context.Background()); err != nil {
+                t.Fatalf("Probe: %v", err)
+        }
+
+        want := map[string]string{
+                "org/down":    modelUnavailable,
+                "org/loading": modelLoading,
+                "org/cold":    modelLoading,
+                "org/ready":   modelAvailable,
+        }
+        for _, health := range h.health.snapshot() {
+                if health.State != want[health.Model] || health.Source != checkProbe {
+                        t.Errorf("%s: state %s from %s, want %s from a probe", health.Model, health.State, health.Source, want[health.Model])
+                }
+        }
+        if got := h.health.order(); !reflect.DeepEqual(got, []string{"org/ready", "org/loading", "org/cold", "org/down"}) {
+                t.Errorf("order = %v", got)
+        }
+
+        // A preferred model comes first whatever its health
+        if got := h.candidates(ImageParams{Model: "org/down"}); !reflect.DeepEqual(got, []string{"org/down", "org/ready", "org/loading", "org/cold"}) {
+                t.Errorf("candidates = %v", got)
+        }
+}
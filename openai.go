@@ -0,0 +1,287 @@
+package main
+
+import (
+        "bufio"
+        "bytes"
+        "context"
+        "encoding/json"
+        "fmt"
+        "io"
+        "net/http"
+        "strings"
+        "time"
+)
+
+// openAIProvider implements ChatProvider against any server exposing the
+// OpenAI chat completions API (OpenAI, vLLM, Ollama, LM Studio, ...)
+type openAIProvider struct {
+        baseURL    string
+        apiKey     string
+        model      string
+        vision     bool
+        generation GenerationConfig
+        client     *http.Client
+}
+
+func newOpenAIProvider(cfg OpenAIConfig, generation GenerationConfig) *openAIProvider {
+        return &openAIProvider{
+                baseURL:    strings.TrimRight(cfg.BaseURL, "/"),
+                apiKey:     cfg.APIKey,
+                model:      cfg.Model,
+                vision:     cfg.Vision,
+                generation: generation,
+                client:     &http.Client{Timeout: time.Duration(cfg.Timeout)},
+        }
+}
+
+func (o *openAIProvider) Name() string {
+        return "openai"
+}
+
+func (o *openAIProvider) SupportsVision() bool {
+        return o.vision
+}
+
+// Probe lists the server's models, which checks both reachability and the
+// API key without generating anything
+func (o *openAIProvider) Probe(ctx context.Context) error {
+        return probeURL(ctx, o.client, o.baseURL+"/models", o.apiKey)
+}
+
+// openAIMessage is a chat completions message. Content is either a string or
+// a list of openAIContentPart when the message carries images.
+type openAIMessage struct {
+        Role    string      `json:"role"`
+        Content interface{} `json:"content"`
+}
+
+type openAIContentPart struct {
+        Type     string          `json:"type"`
+        Text     string          `json:"text,omitempty"`
+        ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+        URL string `json:"url"`
+}
+
+type openAIRequest struct {
+        Model         string               `json:"model"`
+        Messages      []openAIMessage      `json:"messages"`
+        Stream        bool                 `json:"stream,omitempty"`
+        StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+        Temperature   *float32             `json:"temperature,omitempty"`
+        TopP          *float32             `json:"top_p,omitempty"`
+        MaxTokens     *int32               `json:"max_tokens,omitempty"`
+}
+
+type openAIStreamOptions struct {
+        IncludeUsage bool `json:"include_usage"`
+}
+
+type openAIUsage struct {
+        PromptTokens     int32 `json:"prompt_tokens"`
+        CompletionTokens int32 `json:"completion_tokens"`
+        TotalTokens      int32 `json:"total_tokens"`
+}
+
+// openAIResponse covers both full responses (message) and stream chunks (delta)
+type openAIResponse struct {
+        Choices []struct {
+                Message struct {
+                        Content string `json:"content"`
+                } `json:"message"`
+                Delta struct {
+                        Content string `json:"content"`
+                } `json:"delta"`
+                FinishReason string `json:"finish_reason"`
+        } `json:"choices"`
+        Usage *openAIUsage `json:"usage"`
+        Error *struct {
+                Message string `json:"message"`
+        } `json:"error"`
+}
+
+func (o *openAIProvider) Generate(ctx context.Context, req *chatRequest) (*ChatResult, error) {
+        resp, err := o.send(ctx, req, false)
+        if err != nil {
+                return nil, err
+        }
+        defer resp.Body.Close()
+
+        var body openAIResponse
+        if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+                return nil, fmt.Errorf("failed to decode response: %v", err)
+        }
+        if body.Error != nil {
+                return nil, fmt.Errorf("provider returned error: %s", body.Error.Message)
+        }
+
+        result := &ChatResult{}
+        addOpenAIMetadata(result, &body)
+        if len(body.Choices) > 0 {
+                result.Text = body.Choices[0].Message.Content
+        }
+        if result.Text == "" {
+                result.Text = "Maaf, saya tidak dapat menghasilkan respons saat ini."
+        }
+        return result, nil
+}
+
+func (o *openAIProvider) Stream(ctx context.Context, req *chatRequest, onChunk func(string) error) (*ChatResult, error) {
+        resp, err := o.send(ctx, req, true)
+        if err != nil {
+                return nil, err
+        }
+        defer resp.Body.Close()
+
+        result := &ChatResult{}
+        scanner := bufio.NewScanner(resp.Body)
+        scanner.Buffer(make([]byte, 64*1024), 1<<20)
+        for scanner.Scan() {
+                line := scanner.Text()
+                if !strings.HasPrefix(line, "data:") {
+                        continue
+                }
+                data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+                if data == "[DONE]" {
+                        break
+                }
+
+                var chunk openAIResponse
+                if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+                        return result, fmt.Errorf("failed to decode stream chunk: %v", err)
+                }
+                if chunk.Error != nil {
+                        return result, fmt.Errorf("provider returned error: %s", chunk.Error.Message)
+                }
+
+                if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+                        text := chunk.Choices[0].Delta.Content
+                        result.Text += text
+                        if err := onChunk(text); err != nil {
+                                // The client went away; stop consuming the stream
+                                return result, fmt.Errorf("failed to write response: %v", err)
+                        }
+                }
+                addOpenAIMetadata(result, &chunk)
+        }
+        if err := scanner.Err(); err != nil {
+                return result, fmt.Errorf("failed to read stream: %v", err)
+        }
+
+        return result, nil
+}
+
+// CountTokens is not part of the OpenAI-compatible API, so callers must rely
+// on the usage reported with each response instead
+func (o *openAIProvider) CountTokens(ctx context.Context, req *chatRequest) (int, error) {
+        return 0, errTokenCountUnsupported
+}
+
+// send posts the conversation to the chat completions endpoint and returns
+// the response once a 200 status has been received
+func (o *openAIProvider) send(ctx context.Context, req *chatRequest, stream bool) (*http.Response, error) {
+        payload := openAIRequest{
+                Model:    o.model,
+                Messages: toOpenAIMessages(req),
+                Stream:   stream,
+                // Chat completions has no top_k parameter
+                Temperature: o.generation.Temperature,
+                TopP:        o.generation.TopP,
+                MaxTokens:   o.generation.MaxOutputTokens,
+        }
+        if stream {
+                payload.StreamOptions = &openAIStreamOptions{IncludeUsage: true}
+        }
+
+        jsonPayload, err := json.Marshal(payload)
+        if err != nil {
+                return nil, fmt.Errorf("failed to marshal payload: %v", err)
+        }
+
+        httpReq, err := http.NewRequestWithContext(ctx, "POST", o.baseURL+"/chat/completions", bytes.NewReader(jsonPayload))
+        if err != nil {
+                return nil, fmt.Errorf("failed to create request: %v", err)
+        }
+        httpReq.Header.Set("Content-Type", "application/json")
+        if o.apiKey != "" {
+                httpReq.Header.Set("Authorization", "Bearer "+o.apiKey)
+        }
+
+        resp, err := o.client.Do(httpReq)
+        if err != nil {
+                return nil, fmt.Errorf("failed to send request: %v", err)
+        }
+        if resp.StatusCode != http.StatusOK {
+                defer resp.Body.Close()
+                body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+                return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+        }
+        return resp, nil
+}
+
+// toOpenAIMessages maps the conversation into chat completions messages,
+// sending images inline as data URLs
+func toOpenAIMessages(req *chatRequest) []openAIMessage {
+        history, turn := req.splitTurns()
+        conversation := make([]Message, 0, len(history)+1)
+        conversation = append(conversation, history...)
+        conversation = append(conversation, Message{Role: "user", Parts: turn})
+
+        var messages []openAIMessage
+        for _, msg := range conversation {
+                role := "user"
+                msgParts := msg.Parts
+                if msg.Role == "model" || msg.Role == "assistant" {
+                        role = "assistant"
+                        // Assistant messages cannot carry images
+                        msgParts = textParts(msgParts)
+                }
+
+                var parts []openAIContentPart
+                hasImage := false
+                for _, part := range msgParts {
+                        if part.Text != "" {
+                                parts = append(parts, openAIContentPart{Type: "text", Text: part.Text})
+                        }
+                        if part.Data != "" {
+                                hasImage = true
+                                parts = append(parts, openAIContentPart{
+                                        Type:     "image_url",
+                                        ImageURL: &openAIImageURL{URL: "data:" + part.MimeType + ";base64," + part.Data},
+                                })
+                        }
+                }
+                if len(parts) == 0 {
+                        continue
+                }
+
+                // Plain strings are the most widely supported form for text-only messages
+                if !hasImage {
+                        var sb strings.Builder
+                        for _, part := range parts {
+                                sb.WriteString(part.Text)
+                        }
+                        messages = append(messages, openAIMessage{Role: role, Content: sb.String()})
+                        continue
+                }
+                messages = append(messages, openAIMessage{Role: role, Content: parts})
+        }
+        return messages
+}
+
+// addOpenAIMetadata copies the finish reason and token usage into result,
+// keeping earlier values when a chunk omits them
+func addOpenAIMetadata(result *ChatResult, resp *openAIResponse) {
+        if len(resp.Choices) > 0 && resp.Choices[0].FinishReason != "" {
+                result.FinishReason = resp.Choices[0].FinishReason
+        }
+        if resp.Usage != nil {
+                result.Usage = &TokenUsage{
+                        PromptTokens:     resp.Usage.PromptTokens,
+                        CandidatesTokens: resp.Usage.CompletionTokens,
+                        TotalTokens:      resp.Usage.TotalTokens,
+                }
+        }
+}
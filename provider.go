@@ -0,0 +1,160 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "sort"
+        "strings"
+)
+
+// defaultImagePrompt is sent when an image is uploaded without any text
+const defaultImagePrompt = "Analisis gambar ini dan jelaskan apa yang Anda lihat."
+
+// ChatProvider is a text and vision LLM backend used by the chat handlers.
+// Implementations receive the whole parsed request so they can map the
+// conversation history and any uploaded image into their own wire format.
+type ChatProvider interface {
+        // Name is the identifier clients use to select the provider
+        Name() string
+
+        // SupportsVision reports whether requests may include images
+        SupportsVision() bool
+
+        // Generate returns the complete response for the latest turn
+        Generate(ctx context.Context, req *chatRequest) (*ChatResult, error)
+
+        // Stream passes response text to onChunk as it is produced and returns
+        // the complete result once the response has finished
+        Stream(ctx context.Context, req *chatRequest, onChunk func(string) error) (*ChatResult, error)
+
+        // CountTokens reports how many input tokens the request would use
+        CountTokens(ctx context.Context, req *chatRequest) (int, error)
+}
+
+// ChatResult is a provider-neutral model response
+type ChatResult struct {
+        Text         string
+        FinishReason string
+        Usage        *TokenUsage
+        // Image is set when a tool generated an image during the response
+        Image *GeneratedImage
+}
+
+// providerSet holds the configured chat providers and the default choice
+type providerSet struct {
+        providers   map[string]ChatProvider
+        defaultName string
+}
+
+func newProviderSet(defaultName string, providers ...ChatProvider) (*providerSet, error) {
+        set := &providerSet{
+                providers:   make(map[string]ChatProvider),
+                defaultName: defaultName,
+        }
+        for _, p := range providers {
+                set.providers[p.Name()] = p
+        }
+        if _, ok := set.providers[defaultName]; !ok {
+                return nil, fmt.Errorf("default chat provider %q is not configured (available: %v)", defaultName, set.names())
+        }
+        return set, nil
+}
+
+// get returns the named provider, or the default provider when name is empty
+func (s *providerSet) get(name string) (ChatProvider, error) {
+        if name == "" {
+                name = s.defaultName
+        }
+        p, ok := s.providers[name]
+        if !ok {
+                return nil, fmt.Errorf("unknown chat provider %q (available: %v)", name, s.names())
+        }
+        return p, nil
+}
+
+func (s *providerSet) names() []string {
+        names := make([]string, 0, len(s.providers))
+        for name := range s.providers {
+                names = append(names, name)
+        }
+        sort.Strings(names)
+        return names
+}
+
+// errTokenCountUnsupported is returned by providers that cannot count tokens
+var errTokenCountUnsupported = errors.New("token counting is not supported by this provider")
+
+// fakeChatProvider answers every request with a reply derived from its
+// latest turn, so the same request always gets the same answer. It is meant
+// for tests and local development without any chat backend.
+type fakeChatProvider struct{}
+
+func (fakeChatProvider) Name() string {
+        return "fake"
+}
+
+func (fakeChatProvider) SupportsVision() bool {
+        return true
+}
+
+func (f fakeChatProvider) Generate(ctx context.Context, req *chatRequest) (*ChatResult, error) {
+        if err := ctx.Err(); err != nil {
+                return nil, err
+        }
+        return f.result(req), nil
+}
+
+// Stream sends the reply a word at a time
+func (f fakeChatProvider) Stream(ctx context.Context, req *chatRequest, onChunk func(string) error) (*ChatResult, error) {
+        result := f.result(req)
+        for _, word := range strings.SplitAfter(result.Text, " ") {
+                if err := ctx.Err(); err != nil {
+                        return nil, err
+                }
+                if err := onChunk(word); err != nil {
+                        return nil, err
+                }
+        }
+        return result, nil
+}
+
+// CountTokens counts the words of every text part, one token per word
+func (fakeChatProvider) CountTokens(ctx context.Context, req *chatRequest) (int, error) {
+        history, turn := req.splitTurns()
+        tokens := 0
+        for _, message := range append(history, Message{Parts: turn}) {
+                for _, part := range message.Parts {
+                        tokens += len(strings.Fields(part.Text))
+                }
+        }
+        return tokens, nil
+}
+
+// result echoes the text of the latest turn, noting any image and how many
+// earlier messages were sent along
+func (f fakeChatProvider) result(req *chatRequest) *ChatResult {
+        history, turn := req.splitTurns()
+        var texts []string
+        images := 0
+        for _, part := range turn {
+                if part.Text != "" {
+                        texts = append(texts, part.Text)
+                } else if part.Data != "" {
+                        images++
+                }
+        }
+
+        text := fmt.Sprintf("You said: %s (%d earlier messages, %d images)", strings.Join(texts, " "), len(history), images)
+        tokens, _ := f.CountTokens(context.Background(), req)
+        words := int32(len(strings.Fields(text)))
+        return &ChatResult{
+                Text:         text,
+                FinishReason: "STOP",
+                Usage: &TokenUsage{
+                        PromptTokens:     int32(tokens),
+                        CandidatesTokens: words,
+                        TotalTokens:      int32(tokens) + words,
+                },
+        }
+}
@@ -1,12 +1,18 @@
 class GeminiChat {
     constructor() {
         this.messages = [];
+        this.conversationId = localStorage.getItem('conversationId');
         this.selectedImageFile = null;
         this.isLoading = false;
         
         this.initializeElements();
         this.attachEventListeners();
         this.updateSendButtonState();
+
+        // Restore the conversation stored on the server, if any
+        if (this.conversationId) {
+            this.loadConversation();
+        }
         
         // Focus the input field on load
         if (this.userInput) {
@@ -26,6 +32,7 @@ class GeminiChat {
         this.clearImagePreview = document.getElementById('clear-image-preview');
         this.loadingIndicator = document.getElementById('loading-indicator');
         this.errorMessageArea = document.getElementById('error-message-area');
+        this.newChatButton = document.getElementById('new-chat-button');
     }
 
     attachEventListeners() {
@@ -51,6 +58,90 @@ class GeminiChat {
 
         // Clear image preview
         this.clearImagePreview.addEventListener('click', () => this.clearImage());
+
+        // Start a new conversation
+        this.newChatButton.addEventListener('click', () => this.startNewConversation());
+    }
+
+    // Fetch an API endpoint, signing in first when the server requires it.
+    // The access token is exchanged for a session cookie and never stored.
+    async apiFetch(url, options = {}) {
+        const response = await fetch(url, options);
+        if (response.status !== 401) {
+            return response;
+        }
+
+        const token = window.prompt('Masukkan token akses:');
+        if (!token) {
+            return response;
+        }
+
+        const session = await fetch('/api/session', {
+            method: 'POST',
+            headers: { 'Authorization': `Bearer ${token}` }
+        });
+        if (!session.ok) {
+            return session;
+        }
+        return fetch(url, options);
+    }
+
+    async loadConversation() {
+        try {
+            const response = await this.apiFetch(`/api/conversations/${this.conversationId}`);
+
+            if (response.status === 404) {
+                // The server no longer knows this conversation
+                this.setConversationId(null);
+                return;
+            }
+
+            if (!response.ok) {
+                throw new Error(`HTTP error! status: ${response.status}`);
+            }
+
+            const conversation = await response.json();
+            this.messages = conversation.messages || [];
+
+            if (this.messages.length > 0) {
+                this.showChatUI();
+                this.messages.forEach(message => this.renderMessage(message));
+            }
+        } catch (error) {
+            console.error('Error loading conversation:', error);
+            this.showError('Gagal memuat percakapan sebelumnya.');
+        }
+    }
+
+    async ensureConversation() {
+        if (this.conversationId) return;
+
+        const response = await this.apiFetch('/api/conversations', { method: 'POST' });
+        if (!response.ok) {
+            throw new Error(`HTTP error! status: ${response.status}`);
+        }
+
+        const conversation = await response.json();
+        this.setConversationId(conversation.id);
+    }
+
+    setConversationId(id) {
+        this.conversationId = id;
+        if (id) {
+            localStorage.setItem('conversationId', id);
+        } else {
+            localStorage.removeItem('conversationId');
+        }
+    }
+
+    startNewConversation() {
+        if (this.isLoading) return;
+
+        this.setConversationId(null);
+        this.messages = [];
+        this.chatContainer.innerHTML = '';
+        this.hideError();
+        this.userInput.focus();
     }
 
     autoResizeTextarea() {
@@ -103,6 +194,22 @@ class GeminiChat {
         reader.readAsDataURL(file);
     }
 
+    readImageAsPart(file) {
+        return new Promise((resolve, reject) => {
+            const reader = new FileReader();
+            reader.onload = (e) => {
+                // Strip the "data:<mime>;base64," prefix
+                const dataUrl = e.target.result;
+                resolve({
+                    mimeType: file.type,
+                    data: dataUrl.substring(dataUrl.indexOf(',') + 1)
+                });
+            };
+            reader.onerror = () => reject(reader.error);
+            reader.readAsDataURL(file);
+        });
+    }
+
     clearImage() {
         this.imagePreviewContainer.classList.remove('visible');
         setTimeout(() => {
@@ -148,6 +255,15 @@ class GeminiChat {
             userMessage.parts.push({ text: text });
         }
 
+        // Keep the image in history so later turns can refer back to it
+        if (image) {
+            try {
+                userMessage.parts.push(await this.readImageAsPart(image));
+            } catch (error) {
+                console.error('Error reading image:', error);
+            }
+        }
+
         // Add user message to conversation history
         this.messages.push(userMessage);
 
@@ -163,11 +279,12 @@ class GeminiChat {
         this.showLoadingIndicator();
 
         try {
+            // The server keeps the conversation history
+            await this.ensureConversation();
+
             // Prepare form data for backend
             const formData = new FormData();
-            
-            // Add conversation history
-            formData.append('messages', JSON.stringify(this.messages));
+            formData.append('conversationId', this.conversationId);
             
             // Add current prompt text
             if (text) {
@@ -179,8 +296,8 @@ class GeminiChat {
                 formData.append('image', image);
             }
 
-            // Send request to backend
-            const response = await fetch('/api/chat', {
+            // Send request to the streaming backend endpoint
+            const response = await this.apiFetch('/api/chat/stream', {
                 method: 'POST',
                 body: formData
             });
@@ -189,23 +306,40 @@ class GeminiChat {
                 throw new Error(`HTTP error! status: ${response.status}`);
             }
 
-            const data = await response.json();
-            
-            if (data.error) {
-                throw new Error(data.error);
-            }
-
-            // Create AI response message
+            // Create AI response message and render it as text arrives
             const aiMessage = {
                 role: 'model',
-                parts: [{ text: data.response }]
+                parts: [{ text: '' }]
             };
+            let messageDiv = null;
+
+            await this.readEventStream(response, (event, data) => {
+                // Image jobs report progress; keep the typing indicator until done
+                if (event === 'progress') {
+                    return;
+                }
+
+                if (data.text && event === 'chunk') {
+                    aiMessage.parts[0].text += data.text;
+                } else if (data.text && !aiMessage.parts[0].text) {
+                    aiMessage.parts[0].text = data.text;
+                }
+
+                if (event === 'done' && data.error) {
+                    throw new Error(data.error);
+                }
+
+                if (!messageDiv) {
+                    // First output arrived: swap the typing indicator for the message
+                    this.hideLoadingIndicator();
+                    messageDiv = this.renderMessage(aiMessage, null, data.imageBase64);
+                } else {
+                    this.updateMessage(messageDiv, aiMessage, data.imageBase64);
+                }
+            });
 
             // Add to conversation history
             this.messages.push(aiMessage);
-
-            // Render AI message in UI (with generated image if present)
-            this.renderMessage(aiMessage, null, data.imageBase64);
             
         } catch (error) {
             console.error('Error sending message:', error);
@@ -232,6 +366,16 @@ class GeminiChat {
             content += `<img src="data:image/png;base64,${generatedImageBase64}" alt="Generated image" class="message-image generated-image">`;
         }
 
+        // Add images stored inline in the message (restored conversations)
+        if (!imageFile && !generatedImageBase64) {
+            message.parts.forEach(part => {
+                if (part.data) {
+                    const imageClass = message.role === 'model' ? 'message-image generated-image' : 'message-image';
+                    content += `<img src="data:${part.mimeType || 'image/png'};base64,${part.data}" alt="Image" class="${imageClass}">`;
+                }
+            });
+        }
+
         // Add text content
         message.parts.forEach(part => {
             if (part.text) {
@@ -246,6 +390,63 @@ class GeminiChat {
         messageDiv.innerHTML = content;
         this.chatContainer.appendChild(messageDiv);
         this.scrollToBottom();
+        return messageDiv;
+    }
+
+    updateMessage(messageDiv, message, generatedImageBase64 = null) {
+        // Keep an image that was already rendered for this message
+        const existingImage = messageDiv.querySelector('.generated-image');
+
+        let content = '';
+        if (generatedImageBase64) {
+            content += `<img src="data:image/png;base64,${generatedImageBase64}" alt="Generated image" class="message-image generated-image">`;
+        } else if (existingImage) {
+            content += existingImage.outerHTML;
+        }
+
+        message.parts.forEach(part => {
+            if (part.text) {
+                content += this.formatAIResponse(part.text);
+            }
+        });
+
+        messageDiv.innerHTML = content;
+        this.scrollToBottom();
+    }
+
+    async readEventStream(response, onEvent) {
+        // Parse Server-Sent Events from a fetch response body
+        const reader = response.body.getReader();
+        const decoder = new TextDecoder();
+        let buffer = '';
+
+        while (true) {
+            const { value, done } = await reader.read();
+            if (done) break;
+
+            buffer += decoder.decode(value, { stream: true });
+
+            // Events are separated by a blank line
+            let boundary;
+            while ((boundary = buffer.indexOf('\n\n')) !== -1) {
+                const rawEvent = buffer.slice(0, boundary);
+                buffer = buffer.slice(boundary + 2);
+
+                let event = 'message';
+                let data = '';
+                rawEvent.split('\n').forEach(line => {
+                    if (line.startsWith('event:')) {
+                        event = line.slice(6).trim();
+                    } else if (line.startsWith('data:')) {
+                        data += line.slice(5).trim();
+                    }
+                });
+
+                if (data) {
+                    onEvent(event, JSON.parse(data));
+                }
+            }
+        }
     }
 
     formatAIResponse(text) {
@@ -0,0 +1,241 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "log/slog"
+        "math"
+        "net"
+        "net/http"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+)
+
+// Capabilities that are rate limited separately
+const (
+        capabilityText   = "text"
+        capabilityVision = "vision"
+        capabilityImage  = "image"
+        capabilityUpload = "upload"
+        capabilityAuth   = "auth"
+)
+
+// busyRetryAfter is suggested to clients when the image generation queue is
+// full
+const busyRetryAfter = 30 * time.Second
+
+// rateLimitError reports a request refused by a rate limit, a daily quota or
+// a full image generation queue
+type rateLimitError struct {
+        msg        string
+        retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+        return e.msg
+}
+
+// sendRateLimitError responds 429 with a Retry-After header in whole seconds
+func sendRateLimitError(w http.ResponseWriter, err *rateLimitError) {
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(err.retryAfter)))
+        sendErrorResponse(w, err.msg, http.StatusTooManyRequests)
+}
+
+// retrySeconds rounds a wait up to whole seconds, as used by Retry-After
+func retrySeconds(wait time.Duration) int {
+        return int(math.Ceil(wait.Seconds()))
+}
+
+// UsageStore counts requests per client and day for daily quotas
+type UsageStore interface {
+        // AddUsage counts n requests by client for capability on day, a date
+        // such as 2024-06-01, unless they would take the client over limit
+        // requests. It reports whether the requests were counted, never for a
+        // limit of 0. Counts of earlier days are dropped.
+        AddUsage(ctx context.Context, client, capability, day string, n, limit int) (bool, error)
+}
+
+// tokenBucket holds the tokens of one client for one capability
+type tokenBucket struct {
+        tokens  float64
+        updated time.Time
+        limit   RateLimit
+}
+
+// refill adds the tokens earned since the last update, up to the burst size
+func (b *tokenBucket) refill(now time.Time) {
+        perSecond := b.limit.PerMinute / 60
+        b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+        b.updated = now
+}
+
+// limiter applies per-client token bucket rate limits and daily quotas for
+// each capability. Clients are users when authentication is enabled and IP
+// addresses otherwise.
+type limiter struct {
+        limits            map[string]RateLimit
+        trustForwardedFor bool
+        usage             UsageStore
+
+        mu        sync.Mutex
+        buckets   map[string]*tokenBucket
+        lastSweep time.Time
+}
+
+func newLimiter(cfg LimitsConfig, usage UsageStore) *limiter {
+        return &limiter{
+                limits: map[string]RateLimit{
+                        capabilityText:   cfg.Text,
+                        capabilityVision: cfg.Vision,
+                        capabilityImage:  cfg.Image,
+                        capabilityUpload: cfg.Upload,
+                        capabilityAuth:   cfg.Auth,
+                },
+                trustForwardedFor: cfg.TrustForwardedFor,
+                usage:             usage,
+                buckets:           make(map[string]*tokenBucket),
+                lastSweep:         time.Now(),
+        }
+}
+
+// allow takes n tokens from the client's bucket for capability and counts n
+// requests against the daily quota, n being 1 except for requests that
+// generate several images. A quota that cannot be checked because the store
+// failed lets the request through.
+func (l *limiter) allow(ctx context.Context, r *http.Request, capability string, n int) *rateLimitError {
+        return l.allowClient(ctx, l.client(r), capability, n)
+}
+
+// allowClient is allow for a client identified by limiter.client
+func (l *limiter) allowClient(ctx context.Context, client, capability string, n int) *rateLimitError {
+        limit := l.limits[capability]
+        now := time.Now()
+
+        if wait := l.take(client, capability, limit, n, now); wait > 0 {
+                rateLimitedTotal.WithLabelValues(capability, "rate").Inc()
+                slog.WarnContext(ctx, "Rate limit exceeded", "client", client, "capability", capability, "retry_after", wait)
+                return &rateLimitError{
+                        msg:        fmt.Sprintf("Rate limit exceeded for %s requests, try again in %ds", capability, retrySeconds(wait)),
+                        retryAfter: wait,
+                }
+        }
+
+        if limit.Daily == 0 {
+                return nil
+        }
+        day := now.UTC().Format(time.DateOnly)
+        ok, err := l.usage.AddUsage(ctx, client, capability, day, n, limit.Daily)
+        if err != nil {
+                slog.ErrorContext(ctx, "Failed to check daily quota", "client", client, "capability", capability, "err", err)
+                return nil
+        }
+        if !ok {
+                rateLimitedTotal.WithLabelValues(capability, "quota").Inc()
+                slog.WarnContext(ctx, "Daily quota exceeded", "client", client, "capability", capability, "quota", limit.Daily)
+                midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+                return &rateLimitError{
+                        msg:        fmt.Sprintf("Daily quota of %d %s requests used up, it resets at midnight UTC", limit.Daily, capability),
+                        retryAfter: midnight.Sub(now),
+                }
+        }
+        return nil
+}
+
+// take removes n tokens from the bucket of client for capability, or returns
+// how long until they are available
+func (l *limiter) take(client, capability string, limit RateLimit, n int, now time.Time) time.Duration {
+        if limit.PerMinute == 0 {
+                return 0
+        }
+
+        l.mu.Lock()
+        defer l.mu.Unlock()
+
+        l.sweep(now)
+
+        key := capability + " " + client
+        b, ok := l.buckets[key]
+        if !ok {
+                b = &tokenBucket{tokens: float64(limit.Burst), updated: now, limit: limit}
+                l.buckets[key] = b
+        }
+        b.refill(now)
+
+        if b.tokens < float64(n) {
+                return time.Duration((float64(n) - b.tokens) / (limit.PerMinute / 60) * float64(time.Second))
+        }
+        b.tokens -= float64(n)
+        return 0
+}
+
+// sweep drops buckets that have refilled completely, which behave like new
+// ones, so idle clients do not accumulate. It runs at most once a minute.
+func (l *limiter) sweep(now time.Time) {
+        if now.Sub(l.lastSweep) < time.Minute {
+                return
+        }
+        l.lastSweep = now
+        for key, b := range l.buckets {
+                b.refill(now)
+                if b.tokens >= float64(b.limit.Burst) {
+                        delete(l.buckets, key)
+                }
+        }
+}
+
+// client identifies who a request is counted against: the signed-in user, or
+// the client IP address when authentication is disabled
+func (l *limiter) client(r *http.Request) string {
+        if user := userID(r.Context()); user != "" {
+                return "user:" + user
+        }
+        if l.trustForwardedFor {
+                if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+                        first, _, _ := strings.Cut(forwarded, ",")
+                        return "ip:" + strings.TrimSpace(first)
+                }
+        }
+        host, _, err := net.SplitHostPort(r.RemoteAddr)
+        if err != nil {
+                host = r.RemoteAddr
+        }
+        return "ip:" + host
+}
+
+type limitedClientKey struct{}
+
+// limitedClient is a client together with the limiter it is counted by
+type limitedClient struct {
+        limiter *limiter
+        client  string
+}
+
+// withClient returns a copy of ctx carrying the client r is counted against,
+// so that work the model starts during the request, such as tool calls, is
+// charged to the same client
+func (l *limiter) withClient(ctx context.Context, r *http.Request) context.Context {
+        return context.WithValue(ctx, limitedClientKey{}, limitedClient{limiter: l, client: l.client(r)})
+}
+
+// allowContext is allow for the client carried by ctx. Without one, as for
+// work not started by a request, nothing is limited.
+func allowContext(ctx context.Context, capability string, n int) *rateLimitError {
+        c, ok := ctx.Value(limitedClientKey{}).(limitedClient)
+        if !ok {
+                return nil
+        }
+        return c.limiter.allowClient(ctx, c.client, capability, n)
+}
+
+// inputCapability returns the capability a chat request is charged before
+// its intent is classified, as classifying already calls the model. Requests
+// classified as image generation are charged capabilityImage on top.
+func inputCapability(req *chatRequest) string {
+        if req.hasImage() {
+                return capabilityVision
+        }
+        return capabilityText
+}
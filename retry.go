@@ -0,0 +1,105 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "fmt"
+        "io"
+        "log/slog"
+        "math/rand"
+        "net/http"
+        "time"
+)
+
+// retryPolicy retries HTTP requests with exponential backoff and jitter
+type retryPolicy struct {
+        // maxRetries is how many times a request is retried after the first try
+        maxRetries int
+        // baseDelay is the backoff before the first retry, doubled for each
+        // following one up to maxDelay
+        baseDelay time.Duration
+        maxDelay  time.Duration
+}
+
+// backoff returns the delay before retry number n, counting from 0. It is
+// drawn between half and all of the exponential delay so that clients
+// retrying together spread out.
+func (p retryPolicy) backoff(n int) time.Duration {
+        d := p.baseDelay
+        for i := 0; i < n && d < p.maxDelay; i++ {
+                d *= 2
+        }
+        if d > p.maxDelay {
+                d = p.maxDelay
+        }
+        if d <= 0 {
+                return 0
+        }
+        return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// do sends the request built by newRequest until retryable turns a response
+// down, the retries run out or ctx ends. newRequest is called for every try
+// since sending a request consumes its body. retryable sees every response
+// but the last one and returns whether to retry and how long the server asked
+// to wait, or 0 to use the backoff. The returned response has been read into
+// the returned body and closed.
+func (p retryPolicy) do(ctx context.Context, client *http.Client, newRequest func(context.Context) (*http.Request, error), retryable func(*http.Response, []byte) (bool, time.Duration)) (*http.Response, []byte, error) {
+        for n := 0; ; n++ {
+                req, err := newRequest(ctx)
+                if err != nil {
+                        return nil, nil, fmt.Errorf("failed to create request: %v", err)
+                }
+                resp, err := client.Do(req)
+                if err != nil {
+                        return nil, nil, fmt.Errorf("failed to send request: %v", err)
+                }
+                body, err := io.ReadAll(resp.Body)
+                resp.Body.Close()
+                if err != nil {
+                        return nil, nil, fmt.Errorf("failed to read response body: %v", err)
+                }
+
+                if n >= p.maxRetries {
+                        return resp, body, nil
+                }
+                retry, wait := retryable(resp, body)
+                if !retry {
+                        return resp, body, nil
+                }
+                if wait <= 0 {
+                        wait = p.backoff(n)
+                } else if wait > p.maxDelay {
+                        wait = p.maxDelay
+                }
+
+                slog.InfoContext(ctx, "Retrying request", "url", req.URL.String(), "status", resp.StatusCode, "retry", n+1, "delay", wait)
+                timer := time.NewTimer(wait)
+                select {
+                case <-timer.C:
+                case <-ctx.Done():
+                        timer.Stop()
+                        return nil, nil, ctx.Err()
+                }
+        }
+}
+
+// huggingFaceRetryAfter returns how long a Hugging Face model asked to be
+// left alone: the Retry-After header or, for a model that is loading, the
+// estimated_time in seconds from the 503 JSON body. It is 0 when neither is
+// given.
+func huggingFaceRetryAfter(resp *http.Response, body []byte) time.Duration {
+        if d := parseRetryAfter(resp.Header.Get("Retry-After")); d > 0 {
+                return d
+        }
+        if resp.StatusCode != http.StatusServiceUnavailable {
+                return 0
+        }
+        var loading struct {
+                EstimatedTime float64 `json:"estimated_time"`
+        }
+        if json.Unmarshal(body, &loading) != nil || loading.EstimatedTime <= 0 {
+                return 0
+        }
+        return time.Duration(loading.EstimatedTime * float64(time.Second))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "io"
+        "net/http"
+        "net/http/httptest"
+        "sync"
+        "testing"
+        "time"
+)
+
+// scriptedServer answers the nth request with responses[n], repeating the
+// last one, and records the body of every request
+type scriptedServer struct {
+        *httptest.Server
+
+        mu     sync.Mutex
+        bodies []string
+}
+
+type scriptedResponse struct {
+        status     int
+        retryAfter string
+        body       string
+}
+
+func newScriptedServer(t *testing.T, responses ...scriptedResponse) *scriptedServer {
+        t.Helper()
+
+        s := &scriptedServer{}
+        s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                body, _ := io.ReadAll(r.Body)
+                s.mu.Lock()
+                n := len(s.bodies)
+                s.bodies = append(s.bodies, string(body))
+                s.mu.Unlock()
+
+                resp := responses[min(n, len(responses)-1)]
+                if resp.retryAfter != "" {
+                        w.Header().Set("Retry-After", resp.retryAfter)
+                }
+                w.WriteHeader(resp.status)
+                io.WriteString(w, resp.body)
+        }))
+        t.Cleanup(s.Close)
+        return s
+}
+
+func (s *scriptedServer) requests() []string {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        return append([]string(nil), s.bodies...)
+}
+
+// retryTo sends payload to srv with p, retrying 503s like the Hugging Face
+// backend does
+func retryTo(ctx context.Context, p retryPolicy, srv *scriptedServer, payload string) (*http.Response, []byte, error) {
+        newRequest := func(ctx context.Context) (*http.Request, error) {
+                return http.NewRequestWithContext(ctx, "POST", srv.URL, bytes.NewReader([]byte(payload)))
+        }
+        retryable := func(resp *http.Response, body []byte) (bool, time.Duration) {
+                return resp.StatusCode == http.StatusServiceUnavailable, huggingFaceRetryAfter(resp, body)
+        }
+        return p.do(ctx, srv.Client(), newRequest, retryable)
+}
+
+func TestRetryModelLoading(t *testing.T) {
+        srv := newScriptedServer(t,
+                scriptedResponse{status: http.StatusServiceUnavailable, body: `{"error":"Model is loading","estimated_time":0.01}`},
+                scriptedResponse{status: http.StatusOK, body: "image"},
+        )
+        p := retryPolicy{maxRetries: 3, baseDelay: time.Millisecond, maxDelay: time.Second}
+
+        resp, body, err := retryTo(context.Background(), p, srv, `{"inputs":"a cat"}`)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if resp.StatusCode != http.StatusOK || string(body) != "image" {
+                t.Fatalf("got %d %q, want 200 %q", resp.StatusCode, body, "image")
+        }
+        requests := srv.requests()
+        if len(requests) != 2 {
+                t.Fatalf("sent %d requests, want 2", len(requests))
+        }
+        for i, body := range requests {
+                if body != `{"inputs":"a cat"}` {
+                        t.Errorf("request %d has body %q, want the full payload", i+1, body)
+                }
+        }
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+        loading := scriptedResponse{status: http.StatusServiceUnavailable, retryAfter: "120", body: `{"estimated_time":0.001}`}
+        srv := newScriptedServer(t, loading, scriptedResponse{status: http.StatusOK})
+
+        // Retry-After wins over estimated_time
+        resp := &http.Response{StatusCode: loading.status, Header: http.Header{"Retry-After": {loading.retryAfter}}}
+        if wait := huggingFaceRetryAfter(resp, []byte(loading.body)); wait != 120*time.Second {
+                t.Errorf("huggingFaceRetryAfter = %v, want 2m0s", wait)
+        }
+
+        // and is capped at maxDelay, which is far above the backoff
+        const maxDelay = 50 * time.Millisecond
+        p := retryPolicy{maxRetries: 1, baseDelay: time.Microsecond, maxDelay: maxDelay}
+        start := time.Now()
+        resp, _, err := retryTo(context.Background(), p, srv, "{}")
+        if err != nil {
+                t.Fatal(err)
+        }
+        elapsed := time.Since(start)
+        if resp.StatusCode != http.StatusOK {
+                t.Errorf("status = %d, want 200", resp.StatusCode)
+        }
+        if elapsed < maxDelay || elapsed > 10*time.Second {
+                t.Errorf("retried after %v, want the wait capped at %v", elapsed, maxDelay)
+        }
+}
+
+func TestRetryGivesUpAfterMaxRetries(t *testing.T) {
+        srv := newScriptedServer(t, scriptedResponse{status: http.StatusServiceUnavailable, body: `{"error":"Model is loading"}`})
+        p := retryPolicy{maxRetries: 2, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+
+        resp, body, err := retryTo(context.Background(), p, srv, "{}")
+        if err != nil {
+                t.Fatal(err)
+        }
+        if resp.StatusCode != http.StatusServiceUnavailable || len(body) == 0 {
+                t.Errorf("got %d %q, want the last 503 with its body", resp.StatusCode, body)
+        }
+        if n := len(srv.requests()); n != 3 {
+                t.Errorf("sent %d requests, want 3", n)
+        }
+}
+
+func TestRetryCancelledWhileWaiting(t *testing.T) {
+        srv := newScriptedServer(t, scriptedResponse{status: http.StatusServiceUnavailable, body: `{"estimated_time":60}`})
+        p := retryPolicy{maxRetries: 3, baseDelay: time.Millisecond, maxDelay: time.Minute}
+
+        ctx, cancel := context.WithCancel(context.Background())
+        time.AfterFunc(20*time.Millisecond, cancel)
+        start := time.Now()
+        _, _, err := retryTo(ctx, p, srv, "{}")
+        if err != context.Canceled {
+                t.Fatalf("err = %v, want %v", err, context.Canceled)
+        }
+        if elapsed := time.Since(start); elapsed > 10*time.Second {
+                t.Errorf("returned %v after the cancellation", elapsed)
+        }
+        if n := len(srv.requests()); n != 1 {
+                t.Errorf("sent %d requests, want 1", n)
+        }
+}
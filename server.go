@@ -0,0 +1,146 @@
+package main
+
+import (
+        "context"
+        "log/slog"
+        "net"
+        "net/http"
+        "os"
+        "os/signal"
+        "sync/atomic"
+        "syscall"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// server holds the configuration and backends shared by the HTTP handlers
+type server struct {
+        cfg       *Config
+        providers *providerSet
+        // images is nil when no image backend is configured
+        images  ImageGenerator
+        store   ConversationStore
+        limiter *limiter
+        files   *fileStore
+        // jobs is nil when no image backend is configured
+        jobs         *jobQueue
+        classifier   IntentClassifier
+        capabilities *Capabilities
+        status       *statusChecker
+        auth         *authenticator
+
+        // ready is false until the server is listening and again once it starts
+        // draining for shutdown
+        ready atomic.Bool
+}
+
+// routes registers the HTTP handlers
+func (s *server) routes() *http.ServeMux {
+        mux := http.NewServeMux()
+        cors := newCORSPolicy(s.cfg.Server)
+
+        // Serve static files from public directory
+        mux.HandleFunc("/", instrument("/", http.FileServer(http.Dir(s.cfg.Server.StaticDir)).ServeHTTP))
+
+        // Handle chat API endpoint
+        mux.HandleFunc("/api/chat", instrument("/api/chat", cors.handler(s.requireUser(s.handleChat))))
+
+        // Handle streaming chat API endpoint (Server-Sent Events)
+        mux.HandleFunc("/api/chat/stream", instrument("/api/chat/stream", cors.handler(s.requireUser(s.handleChatStream))))
+
+        // Handle conversation storage endpoints
+        mux.HandleFunc("/api/conversations", instrument("/api/conversations", cors.handler(s.requireUser(s.handleConversations))))
+        mux.HandleFunc("/api/conversations/", instrument("/api/conversations/", cors.handler(s.requireUser(s.handleConversations))))
+
+        // Handle background image generation jobs
+        mux.HandleFunc("/api/jobs/", instrument("/api/jobs/", cors.handler(s.requireUser(s.handleJobs))))
+
+        // Handle the versioned JSON API
+        mux.HandleFunc("/api/v1/chat", instrument("/api/v1/chat", cors.handler(s.requireUser(s.handleChatV1))))
+        mux.HandleFunc("/api/v1/files", instrument("/api/v1/files", cors.handler(s.requireUser(s.handleFilesV1))))
+        mux.HandleFunc("/api/v1/tokens", instrument("/api/v1/tokens", cors.handler(s.requireUser(s.handleTokensV1))))
+        mux.HandleFunc("/api/v1/openapi.yaml", instrument("/api/v1/openapi.yaml", cors.handler(s.handleOpenAPI)))
+
+        // Handle the admin endpoints
+        mux.HandleFunc("/api/admin/models", instrument("/api/admin/models", cors.handler(s.requireAdmin(s.handleModelHealth))))
+
+        // Handle sign-in for browser sessions
+        mux.HandleFunc("/api/session", instrument("/api/session", cors.handler(s.handleSession)))
+
+        // Handle feature detection endpoint
+        mux.HandleFunc("/api/capabilities", instrument("/api/capabilities", cors.handler(s.handleCapabilities)))
+
+        // Handle backend reachability endpoint
+        mux.HandleFunc("/api/status", instrument("/api/status", cors.handler(s.handleStatus)))
+
+        // Handle Prometheus metrics
+        mux.Handle("/metrics", promhttp.Handler())
+
+        // Handle liveness and readiness probes
+        mux.HandleFunc("/healthz", s.handleHealthz)
+        mux.HandleFunc("/readyz", s.handleReadyz)
+
+        return mux
+}
+
+// listenAndServe serves HTTP until SIGINT or SIGTERM, then stops accepting
+// connections and lets in-flight chat and image requests finish for up to the
+// shutdown grace period before cancelling them
+func (s *server) listenAndServe() error {
+        cfg := s.cfg.Server
+
+        // Request contexts derive from base so that requests still running when
+        // the grace period ends can be cancelled
+        base, cancelRequests := context.WithCancel(context.Background())
+        defer cancelRequests()
+
+        httpServer := &http.Server{
+                Addr:              "0.0.0.0:" + cfg.Port,
+                Handler:           withRequestID(traceHandler(s.routes())),
+                ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+                ReadTimeout:       time.Duration(cfg.ReadTimeout),
+                WriteTimeout:      time.Duration(cfg.WriteTimeout),
+                IdleTimeout:       time.Duration(cfg.IdleTimeout),
+                BaseContext:       func(net.Listener) context.Context { return base },
+        }
+
+        stop := make(chan os.Signal, 1)
+        signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+        defer signal.Stop(stop)
+
+        // Bind before reporting ready so that a port in use fails startup
+        // instead of briefly passing readiness checks
+        ln, err := net.Listen("tcp", httpServer.Addr)
+        if err != nil {
+                return err
+        }
+        s.ready.Store(true)
+
+        serveErr := make(chan error, 1)
+        go func() {
+                serveErr <- httpServer.Serve(ln)
+        }()
+
+        select {
+        case err := <-serveErr:
+                return err
+        case sig := <-stop:
+                slog.Info("Draining in-flight requests", "signal", sig.String(), "grace_period", time.Duration(cfg.ShutdownGracePeriod))
+        }
+
+        // Report unready first so load balancers stop routing new requests here
+        s.ready.Store(false)
+        time.Sleep(time.Duration(cfg.ShutdownDelay))
+
+        ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownGracePeriod))
+        defer cancel()
+        if err := httpServer.Shutdown(ctx); err != nil {
+                slog.Warn("Shutdown grace period expired, cancelling remaining requests", "err", err)
+                cancelRequests()
+                return httpServer.Close()
+        }
+
+        slog.Info("All requests drained, shutting down")
+        return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+        "context"
+        "crypto/rand"
+        "encoding/hex"
+        "errors"
+        "fmt"
+        "sort"
+        "sync"
+        "time"
+)
+
+// errConversationNotFound is returned by a ConversationStore for unknown IDs
+var errConversationNotFound = errors.New("conversation not found")
+
+// Conversation is a chat thread stored on the server
+type Conversation struct {
+        ID    string `json:"id"`
+        Title string `json:"title"`
+        // Owner is the ID of the user the conversation belongs to, "" for
+        // conversations created while authentication was disabled
+        Owner     string    `json:"-"`
+        CreatedAt time.Time `json:"createdAt"`
+        UpdatedAt time.Time `json:"updatedAt"`
+        Messages  []Message `json:"messages,omitempty"`
+}
+
+// ConversationStore persists conversations and their messages, including
+// uploaded and generated images carried in MessagePart.Data. Conversations
+// belong to an owner and look like unknown IDs to everybody else.
+type ConversationStore interface {
+        CreateConversation(ctx context.Context, owner, title string) (*Conversation, error)
+
+        // ListConversations returns the owner's conversations without their
+        // messages, most recently updated first
+        ListConversations(ctx context.Context, owner string) ([]Conversation, error)
+
+        // GetConversation returns the conversation with all of its messages
+        GetConversation(ctx context.Context, owner, id string) (*Conversation, error)
+
+        DeleteConversation(ctx context.Context, owner, id string) error
+
+        // SetTitle and AppendMessages take a conversation already checked
+        // with GetConversation
+        SetTitle(ctx context.Context, id, title string) error
+        AppendMessages(ctx context.Context, id string, messages ...Message) error
+        Close() error
+}
+
+// Store is the server's persistent state: conversations and the request
+// counts behind daily quotas
+type Store interface {
+        ConversationStore
+        UsageStore
+}
+
+// newID returns a random 128-bit hex identifier for a conversation, job or
+// uploaded file
+func newID() (string, error) {
+        b := make([]byte, 16)
+        if _, err := rand.Read(b); err != nil {
+                return "", err
+        }
+        return hex.EncodeToString(b), nil
+}
+
+// memoryStore keeps conversations in process memory; they are lost on restart
+type memoryStore struct {
+        mu            sync.RWMutex
+        conversations map[string]*Conversation
+
+        // usage counts requests of usageDay by client and capability
+        usage    map[string]int
+        usageDay string
+}
+
+func newMemoryStore() *memoryStore {
+        return &memoryStore{conversations: make(map[string]*Conversation), usage: make(map[string]int)}
+}
+
+func (m *memoryStore) CreateConversation(ctx context.Context, owner, title string) (*Conversation, error) {
+        id, err := newID()
+        if err != nil {
+                return nil, fmt.Errorf("failed to generate conversation ID: %v", err)
+        }
+
+        now := time.Now().UTC()
+        conv := &Conversation{ID: id, Title: title, Owner: owner, CreatedAt: now, UpdatedAt: now}
+
+        m.mu.Lock()
+        m.conversations[id] = conv
+        m.mu.Unlock()
+
+        copied := *conv
+        return &copied, nil
+}
+
+func (m *memoryStore) ListConversations(ctx context.Context, owner string) ([]Conversation, error) {
+        m.mu.RLock()
+        defer m.mu.RUnlock()
+
+        list := []Conversation{}
+        for _, conv := range m.conversations {
+                if conv.Owner != owner {
+                        continue
+                }
+                summary := *conv
+                summary.Messages = nil
+                list = append(list, summary)
+        }
+        sort.Slice(list, func(i, j int) bool {
+                return list[i].UpdatedAt.After(list[j].UpdatedAt)
+        })
+        return list, nil
+}
+
+func (m *memoryStore) GetConversation(ctx context.Context, owner, id string) (*Conversation, error) {
+        m.mu.RLock()
+        defer m.mu.RUnlock()
+
+        conv, ok := m.conversations[id]
+        if !ok || conv.Owner != owner {
+                return nil, errConversationNotFound
+        }
+
+        copied := *conv
+        copied.Messages = append([]Message(nil), conv.Messages...)
+        return &copied, nil
+}
+
+func (m *memoryStore) DeleteConversation(ctx context.Context, owner, id string) error {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        if conv, ok := m.conversations[id]; !ok || conv.Owner != owner {
+                return errConversationNotFound
+        }
+        delete(m.conversations, id)
+        return nil
+}
+
+func (m *memoryStore) SetTitle(ctx context.Context, id, title string) error {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        conv, ok := m.conversations[id]
+        if !ok {
+                return errConversationNotFound
+        }
+        conv.Title = title
+        return nil
+}
+
+func (m *memoryStore) AppendMessages(ctx context.Context, id string, messages ...Message) error {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        conv, ok := m.conversations[id]
+        if !ok {
+                return errConversationNotFound
+        }
+        conv.Messages = append(conv.Messages, messages...)
+        conv.UpdatedAt = time.Now().UTC()
+        return nil
+}
+
+func (m *memoryStore) AddUsage(ctx context.Context, client, capability, day string, n, limit int) (bool, error) {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        // Counts of previous days are no longer needed
+        if day != m.usageDay {
+                m.usage = make(map[string]int)
+                m.usageDay = day
+        }
+
+        key := capability + " " + client
+        if m.usage[key]+n > limit {
+                return false, nil
+        }
+        m.usage[key] += n
+        return true, nil
+}
+
+func (m *memoryStore) Close() error {
+        return nil
+}
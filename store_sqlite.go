@@ -0,0 +1,267 @@
+package main
+
+import (
+        "context"
+        "database/sql"
+        "encoding/json"
+        "fmt"
+        "sync"
+        "time"
+
+        _ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS conversations (
+        id         TEXT PRIMARY KEY,
+        title      TEXT NOT NULL DEFAULT '',
+        owner      TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMP NOT NULL,
+        updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+        id              INTEGER PRIMARY KEY AUTOINCREMENT,
+        conversation_id TEXT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+        role            TEXT NOT NULL,
+        parts           TEXT NOT NULL,
+        created_at      TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS messages_conversation_id ON messages(conversation_id, id);
+
+CREATE TABLE IF NOT EXISTS usage (
+        client     TEXT NOT NULL,
+        capability TEXT NOT NULL,
+        day        TEXT NOT NULL,
+        count      INTEGER NOT NULL,
+        PRIMARY KEY (client, capability, day)
+);
+`
+
+// sqliteMigrations upgrade databases created by older versions. Each one is
+// skipped when the column it adds already exists.
+var sqliteMigrations = []struct {
+        table, column, statement string
+}{
+        {"conversations", "owner", `ALTER TABLE conversations ADD COLUMN owner TEXT NOT NULL DEFAULT ''`},
+}
+
+// sqliteIndexes are created after the migrations since they use added columns
+const sqliteIndexes = `
+CREATE INDEX IF NOT EXISTS conversations_owner ON conversations(owner, updated_at);
+`
+
+// sqliteStore persists conversations in a SQLite database. Message parts,
+// including base64 image data, are stored as a JSON column.
+type sqliteStore struct {
+        db *sql.DB
+
+        // usageDay is the last day usage was counted for
+        mu       sync.Mutex
+        usageDay string
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+        db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_busy_timeout=5000")
+        if err != nil {
+                return nil, fmt.Errorf("failed to open database: %v", err)
+        }
+
+        // SQLite allows a single writer; serializing access avoids "database is locked"
+        db.SetMaxOpenConns(1)
+
+        if _, err := db.Exec(sqliteSchema); err != nil {
+                db.Close()
+                return nil, fmt.Errorf("failed to create schema: %v", err)
+        }
+        if err := migrateSQLite(db); err != nil {
+                db.Close()
+                return nil, err
+        }
+        return &sqliteStore{db: db}, nil
+}
+
+// migrateSQLite applies the migrations a database still needs
+func migrateSQLite(db *sql.DB) error {
+        for _, m := range sqliteMigrations {
+                var exists bool
+                err := db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?`, m.table, m.column).Scan(&exists)
+                if err != nil {
+                        return fmt.Errorf("failed to inspect table %s: %v", m.table, err)
+                }
+                if exists {
+                        continue
+                }
+                if _, err := db.Exec(m.statement); err != nil {
+                        return fmt.Errorf("failed to add column %s.%s: %v", m.table, m.column, err)
+                }
+        }
+        if _, err := db.Exec(sqliteIndexes); err != nil {
+                return fmt.Errorf("failed to create indexes: %v", err)
+        }
+        return nil
+}
+
+func (s *sqliteStore) CreateConversation(ctx context.Context, owner, title string) (*Conversation, error) {
+        id, err := newID()
+        if err != nil {
+                return nil, fmt.Errorf("failed to generate conversation ID: %v", err)
+        }
+
+        now := time.Now().UTC()
+        _, err = s.db.ExecContext(ctx,
+                `INSERT INTO conversations (id, title, owner, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+                id, title, owner, now, now)
+        if err != nil {
+                return nil, fmt.Errorf("failed to create conversation: %v", err)
+        }
+        return &Conversation{ID: id, Title: title, Owner: owner, CreatedAt: now, UpdatedAt: now}, nil
+}
+
+func (s *sqliteStore) ListConversations(ctx context.Context, owner string) ([]Conversation, error) {
+        rows, err := s.db.QueryContext(ctx,
+                `SELECT id, title, owner, created_at, updated_at FROM conversations WHERE owner = ? ORDER BY updated_at DESC`, owner)
+        if err != nil {
+                return nil, fmt.Errorf("failed to list conversations: %v", err)
+        }
+        defer rows.Close()
+
+        list := []Conversation{}
+        for rows.Next() {
+                var conv Conversation
+                if err := rows.Scan(&conv.ID, &conv.Title, &conv.Owner, &conv.CreatedAt, &conv.UpdatedAt); err != nil {
+                        return nil, fmt.Errorf("failed to read conversation: %v", err)
+                }
+                list = append(list, conv)
+        }
+        return list, rows.Err()
+}
+
+func (s *sqliteStore) GetConversation(ctx context.Context, owner, id string) (*Conversation, error) {
+        var conv Conversation
+        err := s.db.QueryRowContext(ctx,
+                `SELECT id, title, owner, created_at, updated_at FROM conversations WHERE id = ? AND owner = ?`, id, owner).
+                Scan(&conv.ID, &conv.Title, &conv.Owner, &conv.CreatedAt, &conv.UpdatedAt)
+        if err == sql.ErrNoRows {
+                return nil, errConversationNotFound
+        }
+        if err != nil {
+                return nil, fmt.Errorf("failed to get conversation: %v", err)
+        }
+
+        rows, err := s.db.QueryContext(ctx,
+                `SELECT role, parts FROM messages WHERE conversation_id = ? ORDER BY id`, id)
+        if err != nil {
+                return nil, fmt.Errorf("failed to get messages: %v", err)
+        }
+        defer rows.Close()
+
+        for rows.Next() {
+                var msg Message
+                var parts string
+                if err := rows.Scan(&msg.Role, &parts); err != nil {
+                        return nil, fmt.Errorf("failed to read message: %v", err)
+                }
+                if err := json.Unmarshal([]byte(parts), &msg.Parts); err != nil {
+                        return nil, fmt.Errorf("failed to decode message parts: %v", err)
+                }
+                conv.Messages = append(conv.Messages, msg)
+        }
+        return &conv, rows.Err()
+}
+
+func (s *sqliteStore) DeleteConversation(ctx context.Context, owner, id string) error {
+        result, err := s.db.ExecContext(ctx, `DELETE FROM conversations WHERE id = ? AND owner = ?`, id, owner)
+        if err != nil {
+                return fmt.Errorf("failed to delete conversation: %v", err)
+        }
+        if n, _ := result.RowsAffected(); n == 0 {
+                return errConversationNotFound
+        }
+        return nil
+}
+
+func (s *sqliteStore) SetTitle(ctx context.Context, id, title string) error {
+        result, err := s.db.ExecContext(ctx, `UPDATE conversations SET title = ? WHERE id = ?`, title, id)
+        if err != nil {
+                return fmt.Errorf("failed to update conversation: %v", err)
+        }
+        if n, _ := result.RowsAffected(); n == 0 {
+                return errConversationNotFound
+        }
+        return nil
+}
+
+func (s *sqliteStore) AppendMessages(ctx context.Context, id string, messages ...Message) error {
+        tx, err := s.db.BeginTx(ctx, nil)
+        if err != nil {
+                return fmt.Errorf("failed to begin transaction: %v", err)
+        }
+        defer tx.Rollback()
+
+        now := time.Now().UTC()
+        result, err := tx.ExecContext(ctx, `UPDATE conversations SET updated_at = ? WHERE id = ?`, now, id)
+        if err != nil {
+                return fmt.Errorf("failed to update conversation: %v", err)
+        }
+        if n, _ := result.RowsAffected(); n == 0 {
+                return errConversationNotFound
+        }
+
+        for _, msg := range messages {
+                parts, err := json.Marshal(msg.Parts)
+                if err != nil {
+                        return fmt.Errorf("failed to encode message parts: %v", err)
+                }
+                _, err = tx.ExecContext(ctx,
+                        `INSERT INTO messages (conversation_id, role, parts, created_at) VALUES (?, ?, ?, ?)`,
+                        id, msg.Role, string(parts), now)
+                if err != nil {
+                        return fmt.Errorf("failed to insert message: %v", err)
+                }
+        }
+
+        return tx.Commit()
+}
+
+func (s *sqliteStore) AddUsage(ctx context.Context, client, capability, day string, n, limit int) (bool, error) {
+        // The insert below would count the first requests whatever the limit
+        if n > limit {
+                return false, nil
+        }
+
+        // Counts of previous days are no longer needed, which is checked on
+        // the first request of each day, including the first after startup
+        s.mu.Lock()
+        newDay := day != s.usageDay
+        s.usageDay = day
+        s.mu.Unlock()
+        if newDay {
+                if _, err := s.db.ExecContext(ctx, `DELETE FROM usage WHERE day < ?`, day); err != nil {
+                        // Try again with the next request
+                        s.mu.Lock()
+                        s.usageDay = ""
+                        s.mu.Unlock()
+                        return false, fmt.Errorf("failed to delete old usage: %v", err)
+                }
+        }
+
+        // The update is skipped, affecting no rows, once the quota is used up
+        result, err := s.db.ExecContext(ctx,
+                `INSERT INTO usage (client, capability, day, count) VALUES (?, ?, ?, ?)
+                 ON CONFLICT (client, capability, day) DO UPDATE SET count = count + excluded.count WHERE count + excluded.count <= ?`,
+                client, capability, day, n, limit)
+        if err != nil {
+                return false, fmt.Errorf("failed to count usage: %v", err)
+        }
+        affected, err := result.RowsAffected()
+        if err != nil {
+                return false, fmt.Errorf("failed to count usage: %v", err)
+        }
+        return affected > 0, nil
+}
+
+func (s *sqliteStore) Close() error {
+        return s.db.Close()
+}
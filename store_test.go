@@ -0,0 +1,95 @@
+package main
+
+import (
+        "context"
+        "path/filepath"
+        "testing"
+)
+
+// testStores returns one store of each driver
+func testStores(t *testing.T) map[string]Store {
+        t.Helper()
+
+        sqlite, err := newSQLiteStore(filepath.Join(t.TempDir(), "chat.db"))
+        if err != nil {
+                t.Fatal(err)
+        }
+        t.Cleanup(func() { sqlite.Close() })
+        return map[string]Store{"memory": newMemoryStore(), "sqlite": sqlite}
+}
+
+func TestAddUsage(t *testing.T) {
+        for name, store := range testStores(t) {
+                t.Run(name, func(t *testing.T) {
+                        ctx := context.Background()
+                        add := func(client, day string, n, limit int) bool {
+                                t.Helper()
+                                ok, err := store.AddUsage(ctx, client, capabilityImage, day, n, limit)
+                                if err != nil {
+                                        t.Fatal(err)
+                                }
+                                return ok
+                        }
+
+                        if add("ip:10.0.0.1", "2024-06-01", 1, 0) {
+                                t.Error("request counted with a limit of 0")
+                        }
+                        for i, want := range []bool{true, true, false} {
+                                if got := add("ip:10.0.0.1", "2024-06-01", 1, 2); got != want {
+                                        t.Errorf("request %d counted = %v, want %v", i+1, got, want)
+                                }
+                        }
+                        if !add("ip:10.0.0.2", "2024-06-01", 1, 2) {
+                                t.Error("request of another client refused")
+                        }
+                        if !add("ip:10.0.0.1", "2024-06-02", 1, 2) {
+                                t.Error("request on the next day refused")
+                        }
+
+                        // Several requests at once are counted only if they all fit
+                        for i, tt := range []struct {
+                                n    int
+                                want bool
+                        }{{6, false}, {3, true}, {3, false}, {2, true}, {1, false}} {
+                                if got := add("ip:10.0.0.3", "2024-06-01", tt.n, 5); got != tt.want {
+                                        t.Errorf("adding %d (step %d) counted = %v, want %v", tt.n, i+1, got, tt.want)
+                                }
+                        }
+                })
+        }
+}
+
+func TestSQLiteAddUsageDropsEarlierDays(t *testing.T) {
+        store, err := newSQLiteStore(filepath.Join(t.TempDir(), "chat.db"))
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer store.Close()
+        ctx := context.Background()
+
+        for _, client := range []string{"ip:10.0.0.1", "ip:10.0.0.2"} {
+                if _, err := store.AddUsage(ctx, client, capabilityText, "2024-06-01", 1, 5); err != nil {
+                        t.Fatal(err)
+                }
+        }
+        if _, err := store.AddUsage(ctx, "ip:10.0.0.1", capabilityText, "2024-06-02", 1, 5); err != nil {
+                t.Fatal(err)
+        }
+
+        var days []string
+        rows, err := store.db.Query(`SELECT day FROM usage`)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer rows.Close()
+        for rows.Next() {
+                var day string
+                if err := rows.Scan(&day); err != nil {
+                        t.Fatal(err)
+                }
+                days = append(days, day)
+        }
+        if len(days) != 1 || days[0] != "2024-06-02" {
+                t.Errorf("usage rows are for days %v, want only 2024-06-02", days)
+        }
+}
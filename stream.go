@@ -0,0 +1,186 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "fmt"
+        "log/slog"
+        "net/http"
+)
+
+// StreamEvent is the JSON payload of each Server-Sent Event on /api/chat/stream.
+// "chunk" events carry incremental text and "progress" events the state of an
+// image generation job; the final "done" event carries the finish reason,
+// token usage, any generated image and any error.
+type StreamEvent struct {
+        Text           string      `json:"text,omitempty"`
+        ImageBase64    string      `json:"imageBase64,omitempty"`
+        ImageMimeType  string      `json:"imageMimeType,omitempty"`
+        FinishReason   string      `json:"finishReason,omitempty"`
+        Usage          *TokenUsage `json:"usage,omitempty"`
+        ConversationID string      `json:"conversationId,omitempty"`
+        Error          string      `json:"error,omitempty"`
+
+        // Set on the events of an image generation job. The "done" event of
+        // a job that succeeded lists every image with its parameters.
+        JobID       string        `json:"jobId,omitempty"`
+        Status      string        `json:"status,omitempty"`
+        Progress    *JobProgress  `json:"progress,omitempty"`
+        ImageParams *ImageParams  `json:"imageParams,omitempty"`
+        Images      []ImageResult `json:"images,omitempty"`
+}
+
+// TokenUsage reports Gemini token counts for a response
+type TokenUsage struct {
+        PromptTokens     int32 `json:"promptTokens"`
+        CandidatesTokens int32 `json:"candidatesTokens"`
+        TotalTokens      int32 `json:"totalTokens"`
+}
+
+// sseWriter writes Server-Sent Events and flushes each one to the client
+type sseWriter struct {
+        w       http.ResponseWriter
+        flusher http.Flusher
+}
+
+func (s *sseWriter) send(event string, payload StreamEvent) error {
+        data, err := json.Marshal(payload)
+        if err != nil {
+                return err
+        }
+        if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+                return err
+        }
+        s.flusher.Flush()
+        return nil
+}
+
+func (s *server) handleChatStream(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "POST" {
+                slog.WarnContext(r.Context(), "Invalid method", "method", r.Method)
+                w.Header().Set("Content-Type", "application/json")
+                sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        req, err := parseChatRequest(w, r, s.cfg.Uploads)
+        if err != nil {
+                w.Header().Set("Content-Type", "application/json")
+                sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        s.serveChatStream(w, r, req)
+}
+
+// serveChatStream answers a decoded chat request from either chat API with
+// Server-Sent Events
+func (s *server) serveChatStream(w http.ResponseWriter, r *http.Request, req *chatRequest) {
+        flusher, ok := w.(http.Flusher)
+        if !ok {
+                w.Header().Set("Content-Type", "application/json")
+                sendErrorResponse(w, "Streaming not supported", http.StatusInternalServerError)
+                return
+        }
+
+        ctx, cancel := s.requestContext(r)
+        defer cancel()
+
+        turn := s.prepareChat(w, r, ctx, req)
+        if turn == nil {
+                return
+        }
+
+        // Errors past this point are reported in the final "done" event
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.Header().Set("Connection", "keep-alive")
+        w.WriteHeader(http.StatusOK)
+        sse := &sseWriter{w: w, flusher: flusher}
+
+        // Image generation has no partial output, only progress reports
+        if turn.job != nil {
+                s.streamJob(r, ctx, sse, turn.job)
+                return
+        }
+
+        // Text chat and image analysis go to the selected provider
+        result, err := turn.provider.Stream(ctx, req, func(text string) error {
+                return sse.send("chunk", StreamEvent{Text: text})
+        })
+
+        final := StreamEvent{ConversationID: req.ConversationID}
+        if result != nil {
+                final.FinishReason = result.FinishReason
+                final.Usage = result.Usage
+                if result.Image != nil {
+                        final.ImageBase64 = result.Image.Base64()
+                        final.ImageMimeType = result.Image.MimeType
+                }
+        }
+        if err != nil {
+                msg, ok := streamErrorMessage(r, ctx, "Failed to get response from "+turn.provider.Name(), err)
+                if !ok {
+                        return
+                }
+                final.Error = msg
+        } else {
+                turn.save(ctx, s.store, result.Text, result.Image)
+        }
+        sse.send("done", final)
+}
+
+// streamJob sends a "progress" event whenever j changes and a "done" event once
+// it finishes. The job is cancelled if the client disconnects first. When ctx
+// reaches the request timeout the job keeps running, bounded by the job
+// timeout, and the "done" event carries its current status for the client to
+// poll /api/jobs/{id}.
+func (s *server) streamJob(r *http.Request, ctx context.Context, sse *sseWriter, j *job) {
+        for {
+                state, changed := s.jobs.watch(j)
+                if state.finished() {
+                        sse.send("done", StreamEvent{
+                                Text:           state.Response,
+                                ImageBase64:    state.ImageBase64,
+                                ImageMimeType:  state.ImageMimeType,
+                                ConversationID: state.ConversationID,
+                                JobID:          state.ID,
+                                Status:         state.Status,
+                                ImageParams:    state.Params,
+                                Images:         state.Images,
+                                Error:          state.Error,
+                        })
+                        return
+                }
+                sse.send("progress", StreamEvent{JobID: state.ID, Status: state.Status, Progress: state.Progress})
+
+                select {
+                case <-changed:
+                case <-ctx.Done():
+                        if contextError(ctx, r) == errClientCancelled {
+                                slog.InfoContext(ctx, "Image job cancelled", "job_id", state.ID, "err", errClientCancelled)
+                                s.jobs.cancel(j)
+                                return
+                        }
+                        slog.InfoContext(ctx, "Image job outlived the stream", "job_id", state.ID, "err", errRequestTimeout)
+                        sse.send("done", StreamEvent{JobID: state.ID, Status: state.Status, Progress: state.Progress})
+                        return
+                }
+        }
+}
+
+// streamErrorMessage is the stream counterpart of sendDownstreamError: it
+// returns the error to report in the final event, or false when the client
+// cancelled and there is nobody left to send it to
+func streamErrorMessage(r *http.Request, ctx context.Context, msg string, err error) (string, bool) {
+        switch contextError(ctx, r) {
+        case errClientCancelled:
+                slog.InfoContext(ctx, msg, "err", errClientCancelled)
+                return "", false
+        case errRequestTimeout:
+                slog.WarnContext(ctx, msg+": "+errRequestTimeout.Error(), "err", err)
+                return msg + ": " + errRequestTimeout.Error(), true
+        }
+        slog.ErrorContext(ctx, msg, "err", err)
+        return fmt.Sprintf("%s: %v", msg, err), true
+}
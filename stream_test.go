@@ -0,0 +1,66 @@
+package main
+
+import (
+        "encoding/json"
+        "net/http/httptest"
+        "strings"
+        "testing"
+)
+
+// sseEvent is one Server-Sent Event read back from a response
+type sseEvent struct {
+        name string
+        data StreamEvent
+}
+
+// serveChatStream runs req through serveChatStream and returns its events
+func serveChatStream(t *testing.T, s *server, req *chatRequest) []sseEvent {
+        t.Helper()
+
+        rec := httptest.NewRecorder()
+        s.serveChatStream(rec, httptest.NewRequest("POST", "/api/chat/stream", nil), req)
+        if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+                t.Fatalf("Content-Type = %q (%s), want text/event-stream", ct, rec.Body.String())
+        }
+
+        var events []sseEvent
+        for _, block := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n\n") {
+                name, data, ok := strings.Cut(block, "\ndata: ")
+                if !ok || !strings.HasPrefix(name, "event: ") {
+                        t.Fatalf("malformed event %q", block)
+                }
+                var event StreamEvent
+                if err := json.Unmarshal([]byte(data), &event); err != nil {
+                        t.Fatalf("invalid event data %q: %v", data, err)
+                }
+                events = append(events, sseEvent{name: strings.TrimPrefix(name, "event: "), data: event})
+        }
+        if len(events) == 0 || events[len(events)-1].name != "done" {
+                t.Fatalf("events = %+v, want a final done event", events)
+        }
+        return events
+}
+
+func TestServeChatStreamText(t *testing.T) {
+        s := newTestServer(t)
+        events := serveChatStream(t, s, &chatRequest{Prompt: "stream this please"})
+
+        var text strings.Builder
+        for _, e := range events[:len(events)-1] {
+                if e.name != "chunk" {
+                        t.Fatalf("got %s event before done, want only chunks", e.name)
+                }
+                text.WriteString(e.data.Text)
+        }
+        if want := "You said: stream this please (0 earlier messages, 0 images)"; text.String() != want {
+                t.Errorf("streamed text = %q, want %q", text.String(), want)
+        }
+        if len(events) < 3 {
+                t.Errorf("got %d events, want the reply split into chunks", len(events))
+        }
+
+        done := events[len(events)-1].data
+        if done.Error != "" || done.FinishReason != "STOP" || done.Usage == nil || done.Usage.PromptTokens != 3 {
+                t.Errorf("done event = %+v, want STOP with usage for 3 prompt tokens", done)
+        }
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "log/slog"
+        "sort"
+
+        "github.com/google/generative-ai-go/genai"
+)
+
+// maxToolIterations bounds how many rounds of function calls the model can
+// make for a single turn before the response is abandoned
+const maxToolIterations = 5
+
+// Tool is a server-side function the model can call. Parameters is the JSON
+// schema of the arguments object advertised to the model.
+type Tool struct {
+        Name        string
+        Description string
+        Parameters  *genai.Schema
+        Handler     func(ctx context.Context, args map[string]any) (*ToolOutput, error)
+}
+
+// ToolOutput is the result of a tool call. Response is sent back to the
+// model; Image is returned to the user alongside the model's reply.
+type ToolOutput struct {
+        Response map[string]any
+        Image    *GeneratedImage
+}
+
+// ToolRegistry holds the tools advertised to the model
+type ToolRegistry struct {
+        tools map[string]*Tool
+}
+
+func newToolRegistry() *ToolRegistry {
+        return &ToolRegistry{tools: make(map[string]*Tool)}
+}
+
+// Register adds a tool, rejecting duplicate names and missing handlers
+func (r *ToolRegistry) Register(tool *Tool) error {
+        if tool.Name == "" || tool.Handler == nil {
+                return fmt.Errorf("tool must have a name and a handler")
+        }
+        if _, ok := r.tools[tool.Name]; ok {
+                return fmt.Errorf("tool %q is already registered", tool.Name)
+        }
+        r.tools[tool.Name] = tool
+        return nil
+}
+
+func (r *ToolRegistry) names() []string {
+        names := make([]string, 0, len(r.tools))
+        for name := range r.tools {
+                names = append(names, name)
+        }
+        sort.Strings(names)
+        return names
+}
+
+// genaiTools returns the registered tools as Gemini function declarations
+func (r *ToolRegistry) genaiTools() []*genai.Tool {
+        if r == nil || len(r.tools) == 0 {
+                return nil
+        }
+
+        var declarations []*genai.FunctionDeclaration
+        for _, name := range r.names() {
+                tool := r.tools[name]
+                declarations = append(declarations, &genai.FunctionDeclaration{
+                        Name:        tool.Name,
+                        Description: tool.Description,
+                        Parameters:  tool.Parameters,
+                })
+        }
+        return []*genai.Tool{{FunctionDeclarations: declarations}}
+}
+
+// call runs the tool named by fc. Failures are reported to the model in the
+// response rather than aborting the turn, so it can recover or explain them.
+func (r *ToolRegistry) call(ctx context.Context, fc genai.FunctionCall) (genai.FunctionResponse, *GeneratedImage) {
+        fail := func(err error) (genai.FunctionResponse, *GeneratedImage) {
+                slog.WarnContext(ctx, "Tool failed", "tool", fc.Name, "err", err)
+                return genai.FunctionResponse{Name: fc.Name, Response: map[string]any{"error": err.Error()}}, nil
+        }
+
+        tool, ok := r.tools[fc.Name]
+        if !ok {
+                return fail(fmt.Errorf("unknown tool %q", fc.Name))
+        }
+        if tool.Parameters != nil {
+                for _, field := range tool.Parameters.Required {
+                        if _, ok := fc.Args[field]; !ok {
+                                return fail(fmt.Errorf("missing required argument %q", field))
+                        }
+                }
+        }
+
+        slog.InfoContext(ctx, "Calling tool", "tool", fc.Name)
+        output, err := tool.Handler(ctx, fc.Args)
+        if err != nil {
+                return fail(err)
+        }
+        return genai.FunctionResponse{Name: fc.Name, Response: output.Response}, output.Image
+}
+
+// newImageTool exposes image generation to the model
+func newImageTool(images ImageGenerator) *Tool {
+        return &Tool{
+                Name:        "generate_image",
+                Description: "Generate an image from a text description. Use this when the user asks for a picture, drawing or illustration to be created. The image is shown to the user automatically.",
+                Parameters: &genai.Schema{
+                        Type: genai.TypeObject,
+                        Properties: map[string]*genai.Schema{
+                                "prompt": {
+                                        Type:        genai.TypeString,
+                                        Description: "Detailed English description of the image to generate",
+                                },
+                        },
+                        Required: []string{"prompt"},
+                },
+                Handler: func(ctx context.Context, args map[string]any) (*ToolOutput, error) {
+                        prompt, _ := args["prompt"].(string)
+                        if prompt == "" {
+                                return nil, fmt.Errorf("prompt must be a non-empty string")
+                        }
+                        // Images the model asks for count like requested ones
+                        if err := allowContext(ctx, capabilityImage, 1); err != nil {
+                                return nil, err
+                        }
+
+                        image, err := images.Generate(ctx, prompt, ImageParams{})
+                        if err != nil {
+                                return nil, err
+                        }
+                        return &ToolOutput{
+                                Response: map[string]any{"status": "generated", "model": image.Model},
+                                Image:    image,
+                        }, nil
+                },
+        }
+}
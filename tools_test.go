@@ -0,0 +1,22 @@
+package main
+
+import (
+        "context"
+        "net/http/httptest"
+        "testing"
+)
+
+func TestImageToolRateLimited(t *testing.T) {
+        l := newLimiter(LimitsConfig{Image: RateLimit{PerMinute: 1, Burst: 1}}, newMemoryStore())
+        ctx := l.withClient(context.Background(), httptest.NewRequest("POST", "/api/chat", nil))
+        tool := newImageTool(fakeImageGenerator{})
+        args := map[string]any{"prompt": "a cat"}
+
+        if _, err := tool.Handler(ctx, args); err != nil {
+                t.Fatalf("first call: %v", err)
+        }
+        _, err := tool.Handler(ctx, args)
+        if _, ok := err.(*rateLimitError); !ok {
+                t.Fatalf("second call: err = %v, want a rate limit error", err)
+        }
+}
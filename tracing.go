@@ -0,0 +1,102 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "net/http"
+        "os"
+
+        "github.com/google/generative-ai-go/genai"
+        "go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+        "go.opentelemetry.io/otel"
+        "go.opentelemetry.io/otel/attribute"
+        "go.opentelemetry.io/otel/codes"
+        "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+        "go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+        "go.opentelemetry.io/otel/propagation"
+        "go.opentelemetry.io/otel/sdk/resource"
+        sdktrace "go.opentelemetry.io/otel/sdk/trace"
+        "go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the application spans. It uses the global provider, so
+// spans are dropped until setupTracing installs an exporter.
+var tracer = otel.Tracer("gemini-chat")
+
+// setupTracing installs the global tracer provider for cfg.Exporter. The
+// returned shutdown flushes pending spans and must be called before exit.
+func setupTracing(ctx context.Context, cfg TracingConfig) (shutdown func(context.Context) error, err error) {
+        otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+        var exporter sdktrace.SpanExporter
+        switch cfg.Exporter {
+        case "none":
+                return func(context.Context) error { return nil }, nil
+        case "stdout":
+                exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+        case "otlp":
+                var opts []otlptracehttp.Option
+                if cfg.OTLPEndpoint != "" {
+                        opts = append(opts, otlptracehttp.WithEndpoint(cfg.OTLPEndpoint))
+                }
+                if cfg.OTLPInsecure {
+                        opts = append(opts, otlptracehttp.WithInsecure())
+                }
+                exporter, err = otlptracehttp.New(ctx, opts...)
+        default:
+                return nil, fmt.Errorf("unknown tracing exporter %q", cfg.Exporter)
+        }
+        if err != nil {
+                return nil, fmt.Errorf("failed to create %s trace exporter: %v", cfg.Exporter, err)
+        }
+
+        res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName)))
+        if err != nil {
+                return nil, fmt.Errorf("failed to build trace resource: %v", err)
+        }
+
+        provider := sdktrace.NewTracerProvider(
+                sdktrace.WithBatcher(exporter),
+                sdktrace.WithResource(res),
+                sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+        )
+        otel.SetTracerProvider(provider)
+        return provider.Shutdown, nil
+}
+
+// traceHandler starts a server span for every request. instrument renames it
+// after the matched route.
+func traceHandler(next http.Handler) http.Handler {
+        return otelhttp.NewHandler(next, "http.request", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+                return r.Method
+        }))
+}
+
+// startGeminiSpan starts a span for one Gemini API call
+func startGeminiSpan(ctx context.Context, name, model string) (context.Context, trace.Span) {
+        return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+                attribute.String("gen_ai.system", "gemini"),
+                attribute.String("gen_ai.request.model", model),
+        ))
+}
+
+// endGeminiSpan records the token usage or error of a Gemini call and ends
+// its span
+func endGeminiSpan(span trace.Span, usage *genai.UsageMetadata, err error) {
+        if usage != nil {
+                span.SetAttributes(
+                        attribute.Int("gen_ai.usage.input_tokens", int(usage.PromptTokenCount)),
+                        attribute.Int("gen_ai.usage.output_tokens", int(usage.CandidatesTokenCount)),
+                )
+        }
+        endSpan(span, err)
+}
+
+// endSpan marks span as failed when err is set and ends it
+func endSpan(span trace.Span, err error) {
+        if err != nil {
+                span.RecordError(err)
+                span.SetStatus(codes.Error, err.Error())
+        }
+        span.End()
+}